@@ -0,0 +1,185 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+)
+
+// archiveData is the data of a File read on demand from an archive,
+// which is never modified. Files are copied into memory the first time
+// they're written. Data stored without compression is read directly
+// from r, while compressed data is read with a decompressor returned
+// by open, starting at the given offset, which is kept while the file
+// is read sequentially. Skipping forward more than reopen bytes opens
+// a new one, if it's not zero.
+type archiveData struct {
+	size int64
+	// stored is the size of the data in the archive
+	stored int64
+	r      io.ReaderAt
+	open   func(off int64) (io.ReadCloser, error)
+	reopen int64
+	// mu protects the decompressor, since its File is only read
+	// locked while reading
+	mu sync.Mutex
+	rc io.ReadCloser
+	// off is the offset of the decompressor
+	off int64
+}
+
+func (a *archiveData) readAt(p []byte, off int64) (int, error) {
+	if off >= a.size {
+		return 0, nil
+	}
+	p = p[:min(int64(len(p)), a.size-off)]
+	if a.r != nil {
+		n, err := a.r.ReadAt(p, off)
+		if err == io.EOF && n == len(p) {
+			err = nil
+		}
+		return n, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rc != nil && (off < a.off || a.reopen > 0 && off-a.off > a.reopen) {
+		// Seeking backwards, or far forward, requires a
+		// new decompressor
+		a.reset()
+	}
+	if a.rc == nil {
+		rc, err := a.open(off)
+		if err != nil {
+			return 0, err
+		}
+		a.rc, a.off = rc, off
+	}
+	if off > a.off {
+		n, err := io.CopyN(io.Discard, a.rc, off-a.off)
+		a.off += n
+		if err != nil {
+			a.reset()
+			return 0, unexpectedEOF(err)
+		}
+	}
+	n, err := io.ReadFull(a.rc, p)
+	a.off += int64(n)
+	if err != nil || a.off == a.size {
+		a.reset()
+	}
+	return n, unexpectedEOF(err)
+}
+
+// reset releases the decompressor. It must be called with mu held.
+func (a *archiveData) reset() {
+	if a.rc != nil {
+		_ = a.rc.Close()
+		a.rc = nil
+	}
+}
+
+// release releases the decompressor once the file has no open
+// handles.
+func (a *archiveData) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reset()
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF for io.EOF, since the
+// data is always expected to have the size recorded in the archive.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// materialize copies the data of a file from an archive into memory,
+// before modifying it. It must be called with the lock of f held.
+func (f *File) materialize() error {
+	if f.source == nil {
+		return nil
+	}
+	data := make([]byte, f.source.size)
+	if _, err := f.source.readAt(data, 0); err != nil {
+		return err
+	}
+	f.source.release()
+	f.Data, f.source = data, nil
+	return nil
+}
+
+// archiveTree builds the in-memory file system with the entries of an
+// archive, as extracting it would. Directories might be listed before
+// or after their entries, or not at all, in which case they're created
+// with mode 0755.
+type archiveTree struct {
+	fs *memoryFileSystem
+}
+
+func newArchiveTree() *archiveTree {
+	return &archiveTree{fs: newMemory()}
+}
+
+// dir returns the directory at name, creating it and its parents if
+// they don't exist.
+func (t *archiveTree) dir(name string) (*Dir, error) {
+	if err := MkdirAll(t.fs, name, 0755); err != nil {
+		return nil, err
+	}
+	return t.fs.dirEntry(name)
+}
+
+// mkdir adds the directory at name with the attributes of attrs, or
+// updates them if it was already created for its entries.
+func (t *archiveTree) mkdir(name string, attrs *Dir) error {
+	d, err := t.dir(path.Clean("/" + name))
+	if err != nil {
+		return err
+	}
+	d.Mode = os.ModeDir | attrs.Mode
+	d.ModTime, d.Uid, d.Gid, d.Xattrs = attrs.ModTime, attrs.Uid, attrs.Gid, attrs.Xattrs
+	d.Uname, d.Gname, d.PAXRecords = attrs.Uname, attrs.Gname, attrs.PAXRecords
+	return nil
+}
+
+// add adds f at name, replacing any previous entry with the same name.
+func (t *archiveTree) add(name string, f *File) error {
+	dir, base := path.Split(path.Clean("/" + name))
+	if base == "" {
+		return fmt.Errorf("invalid file name %q in archive", name)
+	}
+	d, err := t.dir(dir)
+	if err != nil {
+		return err
+	}
+	if f.Mode == 0 {
+		f.Mode = 0644
+	}
+	if prev, pos, _ := d.Find(base); pos >= 0 {
+		if prev == f {
+			return nil
+		}
+		d.remove(pos)
+	}
+	return d.Add(base, f)
+}
+
+// link adds a hard link at name to the file at target, which must have
+// been added before.
+func (t *archiveTree) link(name string, target string) error {
+	entry, _, _, err := t.fs.lentry(path.Clean("/" + target))
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: target, New: name, Err: err}
+	}
+	f, ok := entry.(*File)
+	if !ok {
+		// Hard links to directories are not allowed
+		return &os.LinkError{Op: "link", Old: target, New: name, Err: syscall.EPERM}
+	}
+	return t.add(name, f)
+}
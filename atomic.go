@@ -0,0 +1,208 @@
+package vfs
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	pathpkg "path"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// atomicTempName returns a name for the temporary file used for
+// atomically replacing the file named base.
+func atomicTempName(base string) string {
+	return fmt.Sprintf(".tmp-%s-%d", base, rand.Uint32())
+}
+
+// renameAtomicFile is the AtomicFile used for file systems which don't
+// implement AtomicCreator. It writes to a temporary file, which is
+// renamed on Commit.
+type renameAtomicFile struct {
+	WFile
+	fs   VFS
+	tmp  string
+	path string
+	done bool
+}
+
+func newRenameAtomicFile(fs VFS, path string, perm os.FileMode) (AtomicFile, error) {
+	dir, base := pathpkg.Split(path)
+	for ii := 0; ; ii++ {
+		tmp := pathpkg.Join(dir, atomicTempName(base))
+		f, err := fs.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+		if err != nil {
+			if IsExist(err) && ii < 100 {
+				continue
+			}
+			return nil, err
+		}
+		return &renameAtomicFile{WFile: f, fs: fs, tmp: tmp, path: path}, nil
+	}
+}
+
+func (f *renameAtomicFile) Commit() error {
+	if f.done {
+		return errFileClosed
+	}
+	f.done = true
+	var err error
+	if s, ok := f.WFile.(FileSyncer); ok {
+		err = s.Sync()
+	}
+	if errClose := f.WFile.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = Rename(f.fs, f.tmp, f.path)
+	}
+	if err != nil {
+		_ = f.fs.Remove(f.tmp)
+		return err
+	}
+	return syncParent(f.fs, f.path)
+}
+
+// syncParent syncs the directory containing path in fs, so the entries
+// renamed into it survive a crash. It does nothing if the directory
+// can't be opened as a file which can be synced, like in the in-memory
+// file systems, which don't need it, or on Windows, which doesn't
+// support syncing directories.
+func syncParent(fs VFS, path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := fs.Open(pathpkg.Dir(path))
+	if err != nil {
+		return nil
+	}
+	if s, ok := d.(FileSyncer); ok {
+		err = s.Sync()
+	}
+	if errClose := d.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+func (f *renameAtomicFile) Abort() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	err := f.WFile.Close()
+	if errRemove := f.fs.Remove(f.tmp); err == nil {
+		err = errRemove
+	}
+	return err
+}
+
+func (f *renameAtomicFile) Close() error {
+	return f.Abort()
+}
+
+// CreateAtomic implements AtomicCreator. The data is written to a
+// *File which is not in the file system until Commit is called, when
+// it replaces the entry at path under the file system lock. Like with
+// a rename, the handles opened before keep reading the old contents,
+// so they never see a mix of both.
+func (fs *memoryFileSystem) CreateAtomic(path string, perm os.FileMode) (AtomicFile, error) {
+	if perm&os.ModeType != 0 {
+		return nil, fmt.Errorf("%T does not support special files", fs)
+	}
+	fs.mu.RLock()
+	umask := fs.umask
+	q := fs.parentQuota(path)
+	fs.mu.RUnlock()
+	// The file is charged to the quota of its directory until
+	// it's committed or aborted.
+	if err := q.charge(0, 1); err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	f := &File{
+		Mode:    perm & chmodBits &^ umask,
+		ModTime: time.Now(),
+		store:   fs.store,
+		quota:   q,
+	}
+	h, err := fs.newFile(f, path, true, true, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		_ = q.charge(0, -1)
+		return nil, err
+	}
+	return &memoryAtomicFile{WFile: h, fs: fs, f: f, path: path}, nil
+}
+
+// memoryAtomicFile is the AtomicFile returned by memoryFileSystem.
+type memoryAtomicFile struct {
+	WFile
+	fs   *memoryFileSystem
+	f    *File
+	path string
+	done bool
+}
+
+func (f *memoryAtomicFile) Commit() error {
+	if f.done {
+		return errFileClosed
+	}
+	f.done = true
+	// Replace before closing, since the data of unreachable
+	// files from Hybrid file systems is discarded on close.
+	err := f.fs.replace(f.path, f.f)
+	if cerr := f.WFile.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (f *memoryAtomicFile) Abort() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	return f.WFile.Close()
+}
+
+func (f *memoryAtomicFile) Close() error {
+	return f.Abort()
+}
+
+// parentQuota returns the quota of the directory containing path, if
+// it exists. It must always be called with the lock held.
+func (fs *memoryFileSystem) parentQuota(path string) *quota {
+	dir, _ := pathpkg.Split(cleanPath(path))
+	d, err := fs.dirEntry(dir)
+	if err != nil {
+		return nil
+	}
+	return d.quota
+}
+
+// replace stores f at path, replacing the file already there. Like
+// rename(2), a symlink at path is replaced rather than followed.
+func (fs *memoryFileSystem) replace(path string, f *File) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	dir, base := pathpkg.Split(cleanPath(path))
+	if base == "" {
+		return errNoEmptyNameFile
+	}
+	d, err := fs.dirEntry(dir)
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	if entryQuota(f) != d.quota {
+		return &os.PathError{Op: "rename", Path: path, Err: syscall.EXDEV}
+	}
+	if entry, pos, _ := d.Find(base); entry != nil {
+		if entry.Type() == EntryTypeDir {
+			return &os.PathError{Op: "rename", Path: path, Err: syscall.EISDIR}
+		}
+		d.remove(pos)
+	}
+	return d.Add(base, f)
+}
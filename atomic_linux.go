@@ -0,0 +1,171 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// oTmpfile is O_TMPFILE, defined as __O_TMPFILE|O_DIRECTORY, with
+	// __O_TMPFILE being 020000000 on all the architectures supported
+	// by Go. It's not defined by package syscall.
+	oTmpfile        = 020000000 | syscall.O_DIRECTORY
+	atFdcwd         = -0x64
+	atSymlinkFollow = 0x400
+)
+
+// procSelfFD is the directory used for linking the files created with
+// O_TMPFILE by their descriptors. It's a variable so tests can simulate
+// systems without /proc.
+var procSelfFD = "/proc/self/fd"
+
+// CreateAtomic implements AtomicCreator. The data is written to an
+// unnamed file created with O_TMPFILE, which is linked into the
+// directory with linkat(2) and renamed on Commit. Both the file and
+// its directory are synced, so the new contents survive a crash. If
+// O_TMPFILE is not supported by the kernel or the file system, a named
+// temporary file is used, and if /proc is not mounted, the data is
+// copied to one on Commit.
+func (fs *fileSystem) CreateAtomic(path string, perm os.FileMode) (AtomicFile, error) {
+	p := fs.path(path)
+	f, err := os.OpenFile(filepath.Dir(p), os.O_RDWR|oTmpfile, perm)
+	if err != nil {
+		// Kernels without O_TMPFILE see O_RDWR|O_DIRECTORY, which
+		// fails with EISDIR, while file systems without it return
+		// EOPNOTSUPP, or EINVAL in some cases
+		if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EISDIR) || errors.Is(err, syscall.EINVAL) {
+			return newRenameAtomicFile(fs, path, perm)
+		}
+		return nil, err
+	}
+	return &tmpfileAtomicFile{
+		osFile: newOSFile(fs, f, path, os.O_RDWR|oTmpfile),
+		fs:     fs,
+		name:   path,
+		path:   p,
+		perm:   perm,
+	}, nil
+}
+
+// tmpfileAtomicFile is the AtomicFile returned by fileSystem on Linux.
+// name is its path in fs, while path is the one on disk.
+type tmpfileAtomicFile struct {
+	*osFile
+	fs   *fileSystem
+	name string
+	path string
+	perm os.FileMode
+	done bool
+}
+
+func (f *tmpfileAtomicFile) Commit() error {
+	if f.done {
+		return errFileClosed
+	}
+	f.done = true
+	err := f.link()
+	if errClose := f.osFile.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// link syncs the file and links it at f.path.
+func (f *tmpfileAtomicFile) link() error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	dir, base := filepath.Split(f.path)
+	var tmp string
+	var lerr error
+	err = conn.Control(func(fd uintptr) {
+		for ii := 0; ii < 100; ii++ {
+			tmp = filepath.Join(dir, atomicTempName(base))
+			lerr = linkat(fmt.Sprintf("%s/%d", procSelfFD, fd), tmp)
+			if lerr != syscall.EEXIST {
+				break
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if lerr == syscall.ENOENT {
+		// /proc is not mounted, as in some containers and chroots
+		return f.copyRenamed()
+	}
+	if lerr != nil {
+		return &os.LinkError{Op: "linkat", Old: f.Name(), New: tmp, Err: lerr}
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// copyRenamed copies the data to a named temporary file, which is
+// renamed to f.path, for when the unnamed file can't be linked.
+func (f *tmpfileAtomicFile) copyRenamed() error {
+	a, err := newRenameAtomicFile(f.fs, f.name, f.perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(a, io.NewSectionReader(f.File, 0, 1<<63-1)); err != nil {
+		_ = a.Abort()
+		return err
+	}
+	return a.Commit()
+}
+
+func (f *tmpfileAtomicFile) Abort() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	return f.osFile.Close()
+}
+
+func (f *tmpfileAtomicFile) Close() error {
+	return f.Abort()
+}
+
+// linkat links the file at oldpath, following symlinks, to newpath.
+func linkat(oldpath string, newpath string) error {
+	oldp, err := syscall.BytePtrFromString(oldpath)
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(newpath)
+	if err != nil {
+		return err
+	}
+	fdcwd := atFdcwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(fdcwd), uintptr(unsafe.Pointer(oldp)),
+		uintptr(fdcwd), uintptr(unsafe.Pointer(newp)), atSymlinkFollow, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if errClose := d.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+package vfs
+
+import "testing"
+
+func TestTmpFSAtomicWithoutProc(t *testing.T) {
+	old := procSelfFD
+	procSelfFD = "/nonexistent/fd"
+	defer func() { procSelfFD = old }()
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testAtomic(t, fs)
+}
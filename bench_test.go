@@ -3,8 +3,10 @@ package vfs
 import (
 	"bytes"
 	"compress/gzip"
+	"fmt"
 	"io"
 	"os"
+	"slices"
 	"testing"
 )
 
@@ -41,3 +43,158 @@ func BenchmarkWalkGoSrc(b *testing.B) {
 		_ = Walk(fs, "/", func(_ VFS, _ string, _ os.FileInfo, _ error) error { return nil })
 	}
 }
+
+// largeDirSizes are the number of entries used by the benchmarks
+// for large flat directories.
+var largeDirSizes = []int{1000, 10000, 100000}
+
+// largeDirNames returns n file names in pseudo-random order.
+func largeDirNames(n int) []string {
+	names := make([]string, n)
+	for ii := range names {
+		// Multiplying by a prime coprime with n shuffles the names
+		names[ii] = fmt.Sprintf("file%08d", (ii*7919)%n)
+	}
+	return names
+}
+
+func populateLargeDir(b *testing.B, names []string) *Dir {
+	dir := &Dir{}
+	for _, name := range names {
+		if err := dir.Add(name, &File{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func BenchmarkLargeDirAdd(b *testing.B) {
+	for _, n := range largeDirSizes {
+		names := largeDirNames(n)
+		b.Run(fmt.Sprintf("random/%d", n), func(b *testing.B) {
+			for ii := 0; ii < b.N; ii++ {
+				populateLargeDir(b, names)
+			}
+		})
+		// Archives and Map add their entries in order
+		sorted := slices.Sorted(slices.Values(names))
+		b.Run(fmt.Sprintf("sorted/%d", n), func(b *testing.B) {
+			for ii := 0; ii < b.N; ii++ {
+				populateLargeDir(b, sorted)
+			}
+		})
+	}
+}
+
+func BenchmarkLargeDirFind(b *testing.B) {
+	for _, n := range largeDirSizes {
+		names := largeDirNames(n)
+		dir := populateLargeDir(b, names)
+		// Directories built directly have no index until an
+		// entry is added, so they use binary search
+		sorted := &Dir{
+			EntryNames: slices.Clone(dir.EntryNames),
+			Entries:    slices.Clone(dir.Entries),
+		}
+		for _, v := range []struct {
+			name string
+			dir  *Dir
+		}{
+			{"hashed", dir},
+			{"sorted", sorted},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", v.name, n), func(b *testing.B) {
+				for ii := 0; ii < b.N; ii++ {
+					if _, _, err := v.dir.Find(names[ii%n]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkLargeDirStat(b *testing.B) {
+	for _, n := range largeDirSizes {
+		names := largeDirNames(n)
+		files := make(map[string]*File, n)
+		for _, name := range names {
+			files["d/"+name] = &File{}
+		}
+		fs, err := Map(files)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for ii := 0; ii < b.N; ii++ {
+				if _, err := fs.Stat("d/" + names[ii%n]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLargeDirReadDir(b *testing.B) {
+	for _, n := range largeDirSizes {
+		names := largeDirNames(n)
+		fs := Memory()
+		if err := MkdirAll(fs, "d", 0755); err != nil {
+			b.Fatal(err)
+		}
+		for _, name := range names {
+			if err := WriteFile(fs, "d/"+name, nil, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for ii := 0; ii < b.N; ii++ {
+				if _, err := fs.ReadDir("d"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+const largeFileSize = 64 << 20
+
+func BenchmarkLargeFileAppend(b *testing.B) {
+	chunk := make([]byte, 32<<10)
+	b.SetBytes(largeFileSize)
+	for ii := 0; ii < b.N; ii++ {
+		fs := Memory()
+		f, err := fs.OpenFile("f", os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for jj := 0; jj < largeFileSize/len(chunk); jj++ {
+			if _, err := f.Write(chunk); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLargeFileWriteAt(b *testing.B) {
+	fs := Memory()
+	if err := WriteFile(fs, "f", make([]byte, largeFileSize), 0644); err != nil {
+		b.Fatal(err)
+	}
+	f, err := fs.OpenFile("f", os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	chunk := make([]byte, 4<<10)
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		off := int64(ii*len(chunk)) % (largeFileSize - int64(len(chunk)))
+		if _, err := f.(io.WriterAt).WriteAt(chunk, off); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package vfs
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
+	"strings"
+	"time"
 )
 
 type chrootFileSystem struct {
@@ -42,6 +45,10 @@ func (fs *chrootFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
 	return fs.fs.ReadDir(fs.path(path))
 }
 
+func (fs *chrootFileSystem) OpenDir(path string) (DirFile, error) {
+	return OpenDir(fs.fs, fs.path(path))
+}
+
 func (fs *chrootFileSystem) Mkdir(path string, perm os.FileMode) error {
 	return fs.fs.Mkdir(fs.path(path), perm)
 }
@@ -50,6 +57,122 @@ func (fs *chrootFileSystem) Remove(path string) error {
 	return fs.fs.Remove(fs.path(path))
 }
 
+func (fs *chrootFileSystem) OpenContext(ctx context.Context, path string) (RFile, error) {
+	return AsContextVFS(fs.fs).OpenContext(ctx, fs.path(path))
+}
+
+func (fs *chrootFileSystem) OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (WFile, error) {
+	return AsContextVFS(fs.fs).OpenFileContext(ctx, fs.path(path), flag, perm)
+}
+
+func (fs *chrootFileSystem) LstatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	return AsContextVFS(fs.fs).LstatContext(ctx, fs.path(path))
+}
+
+func (fs *chrootFileSystem) StatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	return AsContextVFS(fs.fs).StatContext(ctx, fs.path(path))
+}
+
+func (fs *chrootFileSystem) ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error) {
+	return AsContextVFS(fs.fs).ReadDirContext(ctx, fs.path(path))
+}
+
+func (fs *chrootFileSystem) MkdirContext(ctx context.Context, path string, perm os.FileMode) error {
+	return AsContextVFS(fs.fs).MkdirContext(ctx, fs.path(path), perm)
+}
+
+func (fs *chrootFileSystem) RemoveContext(ctx context.Context, path string) error {
+	return AsContextVFS(fs.fs).RemoveContext(ctx, fs.path(path))
+}
+
+func (fs *chrootFileSystem) CreateAtomic(path string, perm os.FileMode) (AtomicFile, error) {
+	return CreateAtomic(fs.fs, fs.path(path), perm)
+}
+
+func (fs *chrootFileSystem) Rename(oldpath, newpath string) error {
+	return Rename(fs.fs, fs.path(oldpath), fs.path(newpath))
+}
+
+func (fs *chrootFileSystem) Link(oldname, newname string) error {
+	return Link(fs.fs, fs.path(oldname), fs.path(newname))
+}
+
+// Symlink creates newname as a symbolic link to oldname. Absolute
+// targets are interpreted relative to the chroot root.
+func (fs *chrootFileSystem) Symlink(oldname, newname string) error {
+	if path.IsAbs(oldname) {
+		oldname = fs.path(oldname[1:])
+	}
+	return Symlink(fs.fs, oldname, fs.path(newname))
+}
+
+func (fs *chrootFileSystem) Readlink(name string) (string, error) {
+	target, err := Readlink(fs.fs, fs.path(name))
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(target, fs.root) {
+		target = target[len(fs.root)-1:]
+	}
+	return target, nil
+}
+
+func (fs *chrootFileSystem) Truncate(name string, size int64) error {
+	return Truncate(fs.fs, fs.path(name), size)
+}
+
+func (fs *chrootFileSystem) Chmod(name string, mode os.FileMode) error {
+	return Chmod(fs.fs, fs.path(name), mode)
+}
+
+func (fs *chrootFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return Chtimes(fs.fs, fs.path(name), atime, mtime)
+}
+
+func (fs *chrootFileSystem) Chown(name string, uid, gid int) error {
+	return Chown(fs.fs, fs.path(name), uid, gid)
+}
+
+func (fs *chrootFileSystem) Getxattr(path string, name string) ([]byte, error) {
+	return Getxattr(fs.fs, fs.path(path), name)
+}
+
+func (fs *chrootFileSystem) Setxattr(path string, name string, value []byte) error {
+	return Setxattr(fs.fs, fs.path(path), name, value)
+}
+
+func (fs *chrootFileSystem) Listxattr(path string) ([]string, error) {
+	return Listxattr(fs.fs, fs.path(path))
+}
+
+func (fs *chrootFileSystem) Removexattr(path string, name string) error {
+	return Removexattr(fs.fs, fs.path(path), name)
+}
+
+func (fs *chrootFileSystem) SetQuota(path string, limits QuotaLimits) error {
+	return SetQuota(fs.fs, fs.path(path), limits)
+}
+
+func (fs *chrootFileSystem) QuotaUsage(path string) (*QuotaInfo, error) {
+	return QuotaUsage(fs.fs, fs.path(path))
+}
+
+func (fs *chrootFileSystem) Snapshot() (VFS, error) {
+	snap, err := Snapshot(fs.fs)
+	if err != nil {
+		return nil, err
+	}
+	return &chrootFileSystem{root: fs.root, fs: snap}, nil
+}
+
+func (fs *chrootFileSystem) Fork() (VFS, error) {
+	fork, err := Fork(fs.fs)
+	if err != nil {
+		return nil, err
+	}
+	return &chrootFileSystem{root: fs.root, fs: fork}, nil
+}
+
 func (fs *chrootFileSystem) String() string {
 	return fmt.Sprintf("Chroot %s %s", fs.root, fs.fs.String())
 }
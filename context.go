@@ -0,0 +1,88 @@
+package vfs
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// AsContextVFS returns a ContextVFS for the given VFS. If fs already
+// implements ContextVFS, it's returned as is. Otherwise, the returned
+// ContextVFS checks for the context cancellation before calling the
+// corresponding VFS method, so operations involving several calls (like
+// WalkContext) can be aborted, but a single call can't be interrupted.
+func AsContextVFS(fs VFS) ContextVFS {
+	if c, ok := fs.(ContextVFS); ok {
+		return c
+	}
+	return &contextFileSystem{fs}
+}
+
+// contextFileSystem lifts a VFS into a ContextVFS. It embeds the
+// VFS, so it can be used with both interfaces.
+type contextFileSystem struct {
+	VFS
+}
+
+func (fs *contextFileSystem) OpenContext(ctx context.Context, path string) (RFile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return fs.Open(path)
+}
+
+func (fs *contextFileSystem) OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (WFile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return fs.OpenFile(path, flag, perm)
+}
+
+func (fs *contextFileSystem) LstatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return fs.Lstat(path)
+}
+
+func (fs *contextFileSystem) StatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return fs.Stat(path)
+}
+
+func (fs *contextFileSystem) ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return fs.ReadDir(path)
+}
+
+func (fs *contextFileSystem) MkdirContext(ctx context.Context, path string, perm os.FileMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fs.Mkdir(path, perm)
+}
+
+func (fs *contextFileSystem) RemoveContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fs.Remove(path)
+}
+
+// contextReader wraps an io.Reader, checking for the context
+// cancellation before every Read.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
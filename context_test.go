@@ -0,0 +1,182 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+type ctxKey struct{}
+
+// recordingContextVFS is a ContextVFS backend which records the
+// contexts passed to it.
+type recordingContextVFS struct {
+	VFS
+	values []interface{}
+}
+
+func (fs *recordingContextVFS) record(ctx context.Context) {
+	fs.values = append(fs.values, ctx.Value(ctxKey{}))
+}
+
+func (fs *recordingContextVFS) OpenContext(ctx context.Context, path string) (RFile, error) {
+	fs.record(ctx)
+	return fs.Open(path)
+}
+
+func (fs *recordingContextVFS) OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (WFile, error) {
+	fs.record(ctx)
+	return fs.OpenFile(path, flag, perm)
+}
+
+func (fs *recordingContextVFS) LstatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	fs.record(ctx)
+	return fs.Lstat(path)
+}
+
+func (fs *recordingContextVFS) StatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	fs.record(ctx)
+	return fs.Stat(path)
+}
+
+func (fs *recordingContextVFS) ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error) {
+	fs.record(ctx)
+	return fs.ReadDir(path)
+}
+
+func (fs *recordingContextVFS) MkdirContext(ctx context.Context, path string, perm os.FileMode) error {
+	fs.record(ctx)
+	return fs.Mkdir(path, perm)
+}
+
+func (fs *recordingContextVFS) RemoveContext(ctx context.Context, path string) error {
+	fs.record(ctx)
+	return fs.Remove(path)
+}
+
+func newContextTestVFS(t *testing.T) VFS {
+	mem := Memory()
+	if err := MkdirAll(mem, "a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a/f", "a/b/g", "h"} {
+		if err := WriteFile(mem, p, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mem
+}
+
+func TestAsContextVFS(t *testing.T) {
+	backend := &recordingContextVFS{VFS: Memory()}
+	if AsContextVFS(backend) != ContextVFS(backend) {
+		t.Error("AsContextVFS should return a ContextVFS as is")
+	}
+	cfs := AsContextVFS(newContextTestVFS(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := cfs.StatContext(ctx, "a/f"); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := cfs.StatContext(ctx, "a/f"); err != context.Canceled {
+		t.Errorf("StatContext with cancelled context = %v, want context.Canceled", err)
+	}
+	if err := cfs.MkdirContext(ctx, "c", 0755); err != context.Canceled {
+		t.Errorf("MkdirContext with cancelled context = %v, want context.Canceled", err)
+	}
+}
+
+func TestContextHelpersCancelled(t *testing.T) {
+	fs := newContextTestVFS(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := WalkContext(ctx, fs, "/", func(_ VFS, _ string, _ os.FileInfo, err error) error { return err }); err != context.Canceled {
+		t.Errorf("WalkContext = %v, want context.Canceled", err)
+	}
+	if _, err := ReadFileContext(ctx, fs, "h"); err != context.Canceled {
+		t.Errorf("ReadFileContext = %v, want context.Canceled", err)
+	}
+	if err := CloneContext(ctx, Memory(), fs); err != context.Canceled {
+		t.Errorf("CloneContext = %v, want context.Canceled", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteTarContext(ctx, &buf, fs); err != context.Canceled {
+		t.Errorf("WriteTarContext = %v, want context.Canceled", err)
+	}
+	if err := WriteZipContext(ctx, &buf, fs); err != context.Canceled {
+		t.Errorf("WriteZipContext = %v, want context.Canceled", err)
+	}
+	if err := RemoveAllContext(ctx, fs, "a"); err != context.Canceled {
+		t.Errorf("RemoveAllContext = %v, want context.Canceled", err)
+	}
+	if _, err := fs.Stat("a/b/g"); err != nil {
+		t.Errorf("RemoveAllContext with cancelled context removed files: %v", err)
+	}
+}
+
+func TestWalkContextCancelMidway(t *testing.T) {
+	fs := newContextTestVFS(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var visited []string
+	err := WalkContext(ctx, fs, "/", func(fs VFS, p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		visited = append(visited, p)
+		if p == "/a/b" {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("WalkContext = %v, want context.Canceled", err)
+	}
+	for _, p := range visited {
+		if p == "/h" {
+			t.Errorf("WalkContext visited %s after cancelling: %v", p, visited)
+		}
+	}
+}
+
+func TestContextWrappersPropagate(t *testing.T) {
+	backend := &recordingContextVFS{VFS: newContextTestVFS(t)}
+	ch, err := Chroot("a", backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(backend, "/"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+	wrappers := []VFS{
+		ch,
+		Rewriter(backend, func(p string) string { return p }),
+		ReadOnly(backend),
+		m,
+	}
+	for _, fs := range wrappers {
+		backend.values = nil
+		if _, err := ReadFileContext(ctx, fs, "/b/g"); err != nil && !IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if err := WalkContext(ctx, fs, "/", func(VFS, string, os.FileInfo, error) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if len(backend.values) == 0 {
+			t.Errorf("%s did not propagate the context to its backend", fs)
+		}
+		for _, v := range backend.values {
+			if v != "value" {
+				t.Errorf("%s propagated context value %v, want \"value\"", fs, v)
+				break
+			}
+		}
+	}
+	if _, err := AsContextVFS(ReadOnly(backend)).OpenFileContext(ctx, "h", os.O_WRONLY, 0); err != ErrReadOnlyFileSystem {
+		t.Errorf("OpenFileContext(O_WRONLY) on RO fs = %v, want ErrReadOnlyFileSystem", err)
+	}
+}
@@ -12,15 +12,50 @@
 //
 //	io/ioutil.ReadFile => ReadFile
 //	io/ioutil.WriteFile => WriteFile
+//	os.Chmod => Chmod
+//	os.Chown => Chown
+//	os.Chtimes => Chtimes
 //	os.IsExist => IsExist
 //	os.IsNotExist => IsNotExist
+//	os.Link => Link
 //	os.MkdirAll => MkdirAll
 //	os.RemoveAll => RemoveAll
+//	os.Readlink => Readlink
+//	os.Rename => Rename
+//	os.Symlink => Symlink
+//	os.Truncate => Truncate
 //	path/filepath.Walk => Walk
+//	syscall.Getxattr => Getxattr
+//	syscall.Listxattr => Listxattr
+//	syscall.Removexattr => Removexattr
+//	syscall.Setxattr => Setxattr
+//	syscall.Statfs => StatFS
+//
+// Several of these functions also have a variant taking a context.Context, like
+// WalkContext or ReadFileContext, which work with any VFS by lifting it into
+// a ContextVFS with AsContextVFS.
+//
+// Usage reports the space used by a tree, like du, counting both the logical
+// size of the files and the space used to store them.
+//
+// The in-memory file systems can take point in time copies of their
+// contents with Snapshot, which returns a read-only view, and Fork, which
+// returns a writable copy. Both are copy-on-write, so they're cheap to
+// create and the data is only copied when it's modified.
+//
+// OpenPersistentMemory returns an in-memory file system which survives
+// restarts: its changes are appended to a log in a directory, which is
+// periodically compacted into a snapshot and replayed on startup.
 //
 // All VFS implementations are thread safe, so multiple readers and writers might
 // operate on them at any time.
 //
+// To debug leaked file handles, TrackHandles makes the file systems in this
+// package record every handle they open, which can be listed with OpenHandles
+// (an lsof equivalent) or checked at the end of a test with CheckHandles.
+// Handles garbage collected without being closed are reported to
+// LogLeakedHandle.
+//
 // For read-only code paths, AsReadOnlyFS returns an io/fs.FS view of any VFS.
 // Use it with fs.ReadFile, fs.WalkDir, fs.Glob, etc., without changing the VFS
 // interface. The on-disk fileSystem's ReadDir uses io/fs.ReadDir internally
@@ -3,7 +3,9 @@ package vfs
 import (
 	"os"
 	"path"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +17,10 @@ const (
 	EntryTypeFile EntryType = iota + 1
 	// EntryTypeDir indicates the entry is a directory.
 	EntryTypeDir
+	// EntryTypeSymlink indicates the entry is a symbolic link.
+	// Symlinks are represented by a *File with os.ModeSymlink
+	// set in its Mode, with the link target as its Data.
+	EntryTypeSymlink
 )
 
 const (
@@ -24,8 +30,8 @@ const (
 // Entry is the interface implemented by the in-memory representations
 // of files and directories.
 type Entry interface {
-	// Type returns the entry type, either EntryTypeFile or
-	// EntryTypeDir.
+	// Type returns the entry type, either EntryTypeFile,
+	// EntryTypeDir or EntryTypeSymlink.
 	Type() EntryType
 	// Size returns the file size. For directories, it's always zero.
 	Size() int64
@@ -38,28 +44,89 @@ type Entry interface {
 
 // Type File represents an in-memory file. Most in-memory VFS implementations
 // should use this structure to represent their files, in order to save work.
+// A File with os.ModeSymlink set in its Mode represents a symbolic link,
+// whose target is stored in Data.
 type File struct {
 	sync.RWMutex
-	// Data contains the file data.
+	// Data contains the file data. For files with ModeCompress, it
+	// contains the compressed data, which is only updated when the
+	// file handles are synced or the last one is closed. Other files
+	// keep their data in pages once written through a handle, and
+	// Data is nil until it's built by Flatten or a handle is synced.
+	// It's kept for building files and for compatibility, use Bytes
+	// to get the contents, which also works for the files spilled to
+	// disk by Hybrid.
 	Data []byte
 	// Mode is the file or directory mode. Note that some filesystems
 	// might ignore the permission bits.
 	Mode os.FileMode
 	// ModTime represents the last modification time to the file.
 	ModTime time.Time
+	// Uid and Gid are the numeric ids of the file owner and group.
+	Uid int
+	Gid int
+	// Xattrs contains the extended attributes of the file.
+	Xattrs map[string][]byte
+	// Uname and Gname are the names of the owner and group. They
+	// are only set for the entries loaded from archives, and are
+	// cleared when Chown changes the matching id.
+	Uname string
+	Gname string
+	// PAXRecords contains the PAX records of the tar header the
+	// file was loaded from, other than the extended attributes and
+	// the ones stored in the fields above, so WriteTar keeps them.
+	PAXRecords map[string]string
+	// links is the number of directory entries pointing to
+	// the file.
+	links int
+	// handles is the number of open handles to the file.
+	handles int
+	// pages holds the data once written through a handle, and
+	// the uncompressed data for ModeCompress files while they
+	// have open handles.
+	pages *pages
+	// spill holds the data of files spilled to disk by a Hybrid
+	// file system, which is set in store. accounted is the size
+	// of the data counted in the memory usage of the store.
+	spill     *spillFile
+	store     *hybridStore
+	accounted int64
+	// source holds the data of files loaded lazily from an
+	// archive, until they're modified.
+	source *archiveData
+	// quota is the quota of the subtree containing the file, if
+	// any, and charged the size of the data charged to it.
+	quota   *quota
+	charged int64
+	// hist keeps the previous states of the file seen by the
+	// snapshots of its file system.
+	hist history
+	// shared is the number of handles holding a shared lock and
+	// exclusive whether one of them holds an exclusive lock.
+	shared    int
+	exclusive bool
+	// unlocked is broadcast when a lock is released.
+	unlocked *sync.Cond
 }
 
 func (f *File) Type() EntryType {
+	f.RLock()
+	defer f.RUnlock()
+	if f.Mode&os.ModeSymlink != 0 {
+		return EntryTypeSymlink
+	}
 	return EntryTypeFile
 }
 
 func (f *File) Size() int64 {
 	f.RLock()
 	defer f.RUnlock()
-	return int64(len(f.Data))
+	return f.size()
 }
 
 func (f *File) FileMode() os.FileMode {
+	f.RLock()
+	defer f.RUnlock()
 	return f.Mode
 }
 
@@ -69,6 +136,335 @@ func (f *File) ModificationTime() time.Time {
 	return f.ModTime
 }
 
+// Links returns the number of directory entries pointing to the
+// file, which is greater than 1 for files with hard links.
+func (f *File) Links() int {
+	f.RLock()
+	defer f.RUnlock()
+	return f.links
+}
+
+// Bytes returns a copy of the file contents, decompressing them if
+// needed. Unlike Data, they're always up to date.
+func (f *File) Bytes() ([]byte, error) {
+	f.RLock()
+	defer f.RUnlock()
+	return f.contents()
+}
+
+// contents implements Bytes, and it must be called with the lock of
+// f held.
+func (f *File) contents() ([]byte, error) {
+	switch {
+	case f.spill != nil:
+		data := make([]byte, f.spill.size)
+		if _, err := f.spill.readAt(data, 0); err != nil {
+			return nil, err
+		}
+		return data, nil
+	case f.source != nil:
+		data := make([]byte, f.source.size)
+		if _, err := f.source.readAt(data, 0); err != nil {
+			return nil, err
+		}
+		return data, nil
+	case f.pages != nil:
+		return f.pages.bytes(), nil
+	case f.Mode&ModeCompress != 0:
+		return fileData(f)
+	}
+	return slices.Clone(f.Data), nil
+}
+
+// Flatten stores the contents of the file in Data and returns them,
+// like the Sync method of its handles. Uncompressed files written
+// through handles keep their data in pages, which are dropped, so
+// Data is only built for the users reading it. Files spilled to disk
+// by Hybrid or loaded lazily from archives have no Data, use Bytes
+// for them.
+func (f *File) Flatten() ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.sync(); err != nil {
+		return nil, err
+	}
+	f.flatten()
+	return f.Data, nil
+}
+
+// The following methods implement the storage shared by all the
+// handles to a File, and they must be called with its lock held.
+
+// open registers a new handle to the file. For compressed files, the
+// data is decompressed once when the first handle is opened, and
+// shared by all the handles until the last one is closed. Frozen
+// copies of compressed files might already have it in pages.
+func (f *File) open() error {
+	if f.Mode&ModeCompress != 0 && f.handles == 0 && f.pages == nil {
+		data, err := fileData(f)
+		if err != nil {
+			return err
+		}
+		f.pages = newPages(data)
+		f.store.account(f)
+	}
+	f.handles++
+	return nil
+}
+
+// release unregisters a handle opened with open, compressing the
+// data if it was the last one.
+func (f *File) release() error {
+	if f.handles == 0 {
+		return nil
+	}
+	if f.handles == 1 {
+		if err := f.sync(); err != nil {
+			return err
+		}
+		if f.Mode&ModeCompress != 0 {
+			f.pages = nil
+			f.store.account(f)
+		}
+		if f.source != nil {
+			f.source.release()
+		}
+	}
+	f.handles--
+	return f.discard()
+}
+
+// sync stores the data shared by the handles of a compressed
+// file in Data.
+func (f *File) sync() error {
+	if f.Mode&ModeCompress == 0 || f.handles == 0 {
+		return nil
+	}
+	if err := setFileData(f, f.pages.bytes()); err != nil {
+		return err
+	}
+	if f.Mode&ModeCompress == 0 {
+		// Compression was not worth it
+		f.pages = nil
+	}
+	f.store.account(f)
+	return nil
+}
+
+// flatten stores the contents of an uncompressed file in Data,
+// for the users reading it directly.
+func (f *File) flatten() {
+	if f.Mode&ModeCompress == 0 && f.pages != nil {
+		f.Data = f.pages.bytes()
+		f.pages = nil
+	}
+}
+
+// storage returns the pages with the file contents, moving them
+// from Data without copying if needed. Compressed files must have
+// open handles, and spilled files don't use pages.
+func (f *File) storage() *pages {
+	if f.pages == nil {
+		f.pages = newPages(f.Data)
+		f.Data = nil
+	}
+	return f.pages
+}
+
+// size returns the size of the file data. For compressed files
+// without open handles, it's the size of the compressed Data.
+func (f *File) size() int64 {
+	switch {
+	case f.spill != nil:
+		return f.spill.size
+	case f.source != nil:
+		return f.source.size
+	case f.pages != nil:
+		return f.pages.size
+	}
+	return int64(len(f.Data))
+}
+
+// readAt reads the file data into p from the given offset, returning
+// the number of bytes read.
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	switch {
+	case f.spill != nil:
+		return f.spill.readAt(p, off)
+	case f.source != nil:
+		return f.source.readAt(p, off)
+	case f.pages != nil:
+		return f.pages.readAt(p, off), nil
+	}
+	if off >= int64(len(f.Data)) {
+		return 0, nil
+	}
+	return copy(p, f.Data[off:]), nil
+}
+
+// writeAt writes p at the given offset, growing the file as needed.
+// Files from a Hybrid file system are spilled to disk when they
+// grow too much.
+func (f *File) writeAt(p []byte, off int64) error {
+	if err := f.hist.preserve(f.freeze); err != nil {
+		return err
+	}
+	if err := f.materialize(); err != nil {
+		return err
+	}
+	if err := f.unshare(); err != nil {
+		return err
+	}
+	if err := f.chargeSize(max(f.size(), off+int64(len(p)))); err != nil {
+		return err
+	}
+	if f.spill == nil && f.store.spills(f, off+int64(len(p))) {
+		if err := f.spillData(); err != nil {
+			_ = f.chargeSize(f.size())
+			return err
+		}
+	}
+	if f.spill != nil {
+		if err := f.spill.writeAt(p, off); err != nil {
+			_ = f.chargeSize(f.size())
+			return err
+		}
+	} else {
+		f.storage().writeAt(p, off)
+		f.store.account(f)
+	}
+	f.ModTime = time.Now()
+	return nil
+}
+
+// truncate changes the size of the file data.
+func (f *File) truncate(size int64) error {
+	if err := f.hist.preserve(f.freeze); err != nil {
+		return err
+	}
+	if err := f.materialize(); err != nil {
+		return err
+	}
+	if err := f.unshare(); err != nil {
+		return err
+	}
+	if err := f.chargeSize(size); err != nil {
+		return err
+	}
+	if f.spill != nil {
+		if err := f.spill.truncate(size); err != nil {
+			_ = f.chargeSize(f.size())
+			return err
+		}
+	} else {
+		f.storage().truncate(size)
+		f.store.account(f)
+	}
+	f.ModTime = time.Now()
+	return nil
+}
+
+// discard releases the space charged to the quota of a file and
+// the storage used by a file from a Hybrid file system once it's
+// no longer reachable, because it was removed and all its handles
+// were closed.
+func (f *File) discard() error {
+	if f.links > 0 || f.handles > 0 {
+		return nil
+	}
+	if f.quota != nil {
+		_ = f.quota.charge(-f.charged, -1)
+		f.quota, f.charged = nil, 0
+	}
+	if f.store == nil {
+		return nil
+	}
+	// Removed files might still be seen by snapshots
+	if err := f.hist.preserve(f.freeze); err != nil {
+		return err
+	}
+	var err error
+	if f.spill != nil {
+		err = f.spill.drop()
+		f.spill = nil
+	}
+	f.pages, f.Data = nil, nil
+	f.store.account(f)
+	return err
+}
+
+// setCompressed enables or disables compression for a file with
+// open handles. Spilled files and files from archives can't be
+// compressed.
+func (f *File) setCompressed(c bool) {
+	if f.handles == 0 || f.spill != nil || f.source != nil {
+		return
+	}
+	compressed := f.Mode&ModeCompress != 0
+	switch {
+	case c && !compressed:
+		f.storage()
+		f.Mode |= ModeCompress
+	case !c && compressed:
+		f.Data = nil
+		f.Mode &= ^ModeCompress
+	}
+}
+
+// lockType is the type of the advisory lock held by a handle.
+type lockType uint8
+
+const (
+	lockNone lockType = iota
+	lockShared
+	lockExclusive
+)
+
+// canLock returns whether a handle holding a lock of type held
+// can acquire a lock of type want without waiting.
+func (f *File) canLock(held lockType, want lockType) bool {
+	shared, exclusive := f.shared, f.exclusive
+	switch held {
+	case lockShared:
+		shared--
+	case lockExclusive:
+		exclusive = false
+	}
+	if want == lockExclusive {
+		return !exclusive && shared == 0
+	}
+	return !exclusive
+}
+
+// changeLock replaces a lock of type held with one of type want,
+// waking up the handles waiting for a lock if needed.
+func (f *File) changeLock(held lockType, want lockType) {
+	switch held {
+	case lockShared:
+		f.shared--
+	case lockExclusive:
+		f.exclusive = false
+	}
+	switch want {
+	case lockShared:
+		f.shared++
+	case lockExclusive:
+		f.exclusive = true
+	}
+	if held != lockNone && f.unlocked != nil {
+		f.unlocked.Broadcast()
+	}
+}
+
+// waitUnlock waits until a lock is released. Like sync.Cond.Wait,
+// it releases the file lock while waiting.
+func (f *File) waitUnlock() {
+	if f.unlocked == nil {
+		f.unlocked = sync.NewCond(&f.RWMutex)
+	}
+	f.unlocked.Wait()
+}
+
 // Type Dir represents an in-memory directory. Most in-memory VFS
 // implementations should use this structure to represent their
 // directories, in order to save work.
@@ -79,10 +475,40 @@ type Dir struct {
 	Mode os.FileMode
 	// ModTime represents the last modification time to directory.
 	ModTime time.Time
-	// Entry names in this directory, in order.
+	// Uid and Gid are the numeric ids of the directory owner and group.
+	Uid int
+	Gid int
+	// Xattrs contains the extended attributes of the directory.
+	Xattrs map[string][]byte
+	// Uname and Gname are the names of the owner and group. They
+	// are only set for the entries loaded from archives, and are
+	// cleared when Chown changes the matching id.
+	Uname string
+	Gname string
+	// PAXRecords contains the PAX records of the tar header the
+	// directory was loaded from, other than the extended attributes
+	// and the ones stored in the fields above, so WriteTar keeps them.
+	PAXRecords map[string]string
+	// Entry names in this directory, sorted alphabetically. They
+	// might be set directly when building a Dir, but once it's in
+	// use they must only be modified using Add.
 	EntryNames []string
 	// Entries in the same order as EntryNames.
 	Entries []Entry
+	// index maps the entry names to their positions. Inserting or
+	// removing an entry moves the following ones, so positions might
+	// be stale, and Find updates them after falling back to binary
+	// search. It's rebuilt by Add if EntryNames were modified
+	// directly.
+	index map[string]*atomic.Int64
+	// quota is the quota of the subtree containing the directory,
+	// which might be rooted at it.
+	quota *quota
+	// hist keeps the previous states of the directory seen by the
+	// snapshots of its file system, and lazy is set for the
+	// directories of a Fork until their entries are copied.
+	hist history
+	lazy *lazyDir
 }
 
 func (d *Dir) Type() EntryType {
@@ -94,6 +520,8 @@ func (d *Dir) Size() int64 {
 }
 
 func (d *Dir) FileMode() os.FileMode {
+	d.RLock()
+	defer d.RUnlock()
 	return d.Mode
 }
 
@@ -104,32 +532,38 @@ func (d *Dir) ModificationTime() time.Time {
 }
 
 // Add ads a new entry to the directory. If there's already an
-// entry ith the same name, an error is returned.
-// Binary search could be used here for large directories (future optimization).
+// entry ith the same name, an error is returned. Adding a *File
+// increments its link count, so the same *File might be added
+// with several names to represent hard links.
 func (d *Dir) Add(name string, entry Entry) error {
-	for ii, v := range d.EntryNames {
-		if v > name {
-			names := make([]string, len(d.EntryNames)+1)
-			copy(names, d.EntryNames[:ii])
-			names[ii] = name
-			copy(names[ii+1:], d.EntryNames[ii:])
-			d.EntryNames = names
-
-			entries := make([]Entry, len(d.Entries)+1)
-			copy(entries, d.Entries[:ii])
-			entries[ii] = entry
-			copy(entries[ii+1:], d.Entries[ii:])
-
-			d.Entries = entries
-			return nil
-		}
-		if v == name {
-			return os.ErrExist
+	if err := d.load(); err != nil {
+		return err
+	}
+	if !d.indexed() {
+		d.index = make(map[string]*atomic.Int64, len(d.EntryNames)+1)
+		for ii, v := range d.EntryNames {
+			d.index[v] = indexPos(ii)
 		}
 	}
-	// Not added yet, put at the end
-	d.EntryNames = append(d.EntryNames, name)
-	d.Entries = append(d.Entries, entry)
+	if _, ok := d.index[name]; ok {
+		return os.ErrExist
+	}
+	if err := d.hist.preserve(d.freeze); err != nil {
+		return err
+	}
+	switch e := entry.(type) {
+	case *File:
+		e.hist.adopt(d.hist.versions)
+	case *Dir:
+		e.hist.adopt(d.hist.versions)
+	}
+	// Entries are usually added in order, so inserting
+	// is amortized O(1) in the common case.
+	pos, _ := slices.BinarySearch(d.EntryNames, name)
+	d.EntryNames = slices.Insert(d.EntryNames, pos, name)
+	d.Entries = slices.Insert(d.Entries, pos, entry)
+	d.index[name] = indexPos(pos)
+	link(entry, 1)
 	return nil
 }
 
@@ -137,12 +571,68 @@ func (d *Dir) Add(name string, entry Entry) error {
 // or an error if an entry with that name does not exist in
 // the directory.
 func (d *Dir) Find(name string) (Entry, int, error) {
-	for ii, v := range d.EntryNames {
-		if v == name {
-			return d.Entries[ii], ii, nil
+	if err := d.load(); err != nil {
+		return nil, -1, err
+	}
+	var hint *atomic.Int64
+	if d.indexed() {
+		var ok bool
+		if hint, ok = d.index[name]; !ok {
+			return nil, -1, os.ErrNotExist
+		}
+		// The position is stale if the entry was moved
+		if pos := int(hint.Load()); pos < len(d.EntryNames) && d.EntryNames[pos] == name {
+			return d.Entries[pos], pos, nil
 		}
 	}
-	return nil, -1, os.ErrNotExist
+	pos, found := slices.BinarySearch(d.EntryNames, name)
+	if !found {
+		return nil, -1, os.ErrNotExist
+	}
+	if hint != nil {
+		hint.Store(int64(pos))
+	}
+	return d.Entries[pos], pos, nil
+}
+
+// indexed returns whether the index is in sync with EntryNames.
+// Since the index is only built by Add, which requires the write
+// lock, Find falls back to binary search when it's not.
+func (d *Dir) indexed() bool {
+	return d.index != nil && len(d.index) == len(d.EntryNames)
+}
+
+// indexPos returns the position stored in the index for
+// an entry at pos.
+func indexPos(pos int) *atomic.Int64 {
+	p := new(atomic.Int64)
+	p.Store(int64(pos))
+	return p
+}
+
+// link updates the link count of entry, if it's a *File.
+func link(entry Entry, delta int) {
+	if f, ok := entry.(*File); ok {
+		f.Lock()
+		f.links += delta
+		if err := f.discard(); err != nil {
+			LogCloseError(err)
+		}
+		f.Unlock()
+	}
+}
+
+// remove deletes the entry at the given index, as returned by Find.
+func (d *Dir) remove(pos int) {
+	// Copying a directory only fails when loading it, and it
+	// was loaded by Find.
+	_ = d.hist.preserve(d.freeze)
+	link(d.Entries[pos], -1)
+	if d.indexed() {
+		delete(d.index, d.EntryNames[pos])
+	}
+	d.EntryNames = slices.Delete(d.EntryNames, pos, pos+1)
+	d.Entries = slices.Delete(d.Entries, pos, pos+1)
 }
 
 // EntryInfo implements the os.FileInfo interface wrapping
@@ -1,6 +1,7 @@
 package vfs
 
 import (
+	"fmt"
 	"os"
 	"testing"
 )
@@ -70,3 +71,65 @@ func TestMemOpenFileOnDir(t *testing.T) {
 		t.Error("OpenFile on directory should fail")
 	}
 }
+
+func TestDirEntriesSetDirectly(t *testing.T) {
+	a, c := &File{}, &File{}
+	dir := &Dir{
+		EntryNames: []string{"a", "c"},
+		Entries:    []Entry{a, c},
+	}
+	if e, pos, err := dir.Find("c"); err != nil || e != c || pos != 1 {
+		t.Errorf("Find(c) = %v, %d, %v, want c at 1", e, pos, err)
+	}
+	if err := dir.Add("a", &File{}); err != os.ErrExist {
+		t.Errorf("Add duplicate = %v, want ErrExist", err)
+	}
+	if err := dir.Add("b", &File{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, pos, err := dir.Find("c"); err != nil || pos != 2 {
+		t.Errorf("Find(c) after Add(b) = %d, %v, want 2", pos, err)
+	}
+	// Removing entries keeps the index in sync
+	_, pos, _ := dir.Find("a")
+	dir.remove(pos)
+	if _, _, err := dir.Find("a"); err != os.ErrNotExist {
+		t.Errorf("Find(a) after remove = %v, want ErrNotExist", err)
+	}
+	if err := dir.Add("a", a); err != nil {
+		t.Fatal(err)
+	}
+	if got := dir.EntryNames; len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("EntryNames = %v, want [a b c]", got)
+	}
+}
+
+func TestDirIndexPositions(t *testing.T) {
+	dir := &Dir{}
+	check := func() {
+		t.Helper()
+		for ii, name := range dir.EntryNames {
+			if e, pos, err := dir.Find(name); err != nil || pos != ii || e != dir.Entries[ii] {
+				t.Fatalf("Find(%s) = %v, %d, %v, want the entry at %d", name, e, pos, err, ii)
+			}
+		}
+	}
+	// Adding in reverse order moves all the entries every time
+	for ii := 200; ii > 0; ii-- {
+		if err := dir.Add(fmt.Sprintf("f%03d", ii), &File{}); err != nil {
+			t.Fatal(err)
+		}
+		check()
+	}
+	for ii := 1; ii <= 200; ii += 3 {
+		_, pos, err := dir.Find(fmt.Sprintf("f%03d", ii))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir.remove(pos)
+		check()
+	}
+	if _, _, err := dir.Find("f001"); err != os.ErrNotExist {
+		t.Errorf("Find(f001) after remove = %v, want ErrNotExist", err)
+	}
+}
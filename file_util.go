@@ -6,35 +6,57 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"runtime"
-	"time"
+	"syscall"
 )
 
 var (
-	errFileClosed = errors.New("file is closed")
+	errFileClosed          = errors.New("file is closed")
+	errWriteAtInAppendMode = errors.New("invalid use of WriteAt on file opened with O_APPEND")
 )
 
 // NewRFile returns a RFile from a *File.
 func NewRFile(f *File) (RFile, error) {
-	data, err := fileData(f)
-	if err != nil {
-		return nil, err
-	}
-	return &file{f: f, data: data, readable: true}, nil
+	return newRFile(f, "")
 }
 
 // NewWFile returns a WFile from a *File.
 func NewWFile(f *File, read bool, write bool) (WFile, error) {
-	data, err := fileData(f)
+	return newWFile(f, "", read, write)
+}
+
+func newRFile(f *File, name string) (RFile, error) {
+	return newFile(f, name, true, false, os.O_RDONLY)
+}
+
+func newWFile(f *File, name string, read bool, write bool) (WFile, error) {
+	return newFile(f, name, read, write, 0)
+}
+
+// newFile returns a new handle to f. The only flags used from flag
+// are os.O_APPEND and os.O_SYNC.
+func newFile(f *File, name string, read bool, write bool, flag int) (WFile, error) {
+	f.Lock()
+	err := f.open()
+	f.Unlock()
 	if err != nil {
 		return nil, err
 	}
-	w := &file{f: f, data: data, readable: read, writable: write}
-	runtime.SetFinalizer(w, closeFile)
-	return w, nil
+	h := &file{
+		f:        f,
+		name:     name,
+		readable: read,
+		writable: write,
+		append:   flag&os.O_APPEND != 0,
+		sync:     flag&os.O_SYNC != 0,
+	}
+	runtime.SetFinalizer(h, closeFile)
+	return h, nil
 }
 
 func closeFile(f *file) {
+	leakedHandle(f.handle)
 	err := f.Close()
 	if err != nil {
 		LogCloseError(err)
@@ -63,13 +85,24 @@ func fileData(f *File) ([]byte, error) {
 	return out.Bytes(), nil
 }
 
+// file is the handle returned by NewRFile and NewWFile. All the handles
+// to the same *File share its contents, so writes are immediately visible
+// to any other handle, like in a POSIX file system.
 type file struct {
 	f        *File
-	data     []byte
+	name     string
 	offset   int
 	readable bool
 	writable bool
-	closed   bool
+	// append makes every write happen at the end of the file
+	append bool
+	// sync makes every write sync the file
+	sync bool
+	// lock is the advisory lock held by the handle
+	lock lockType
+	// handle is set if the handle is tracked
+	handle *OpenHandle
+	closed bool
 }
 
 func (f *file) Read(p []byte) (int, error) {
@@ -81,11 +114,37 @@ func (f *file) Read(p []byte) (int, error) {
 	if f.closed {
 		return 0, errFileClosed
 	}
-	if f.offset > len(f.data) {
+	n, err := f.f.readAt(p, int64(f.offset))
+	f.offset += n
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// ReadAt implements io.ReaderAt. It does not modify the file offset.
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if !f.readable {
+		return 0, ErrWriteOnly
+	}
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	f.f.RLock()
+	defer f.f.RUnlock()
+	if f.closed {
+		return 0, errFileClosed
+	}
+	if off >= f.f.size() {
 		return 0, io.EOF
 	}
-	n := copy(p, f.data[f.offset:])
-	f.offset += n
+	n, err := f.f.readAt(p, off)
+	if err != nil {
+		return n, err
+	}
 	if n < len(p) {
 		return n, io.EOF
 	}
@@ -98,18 +157,19 @@ func (f *file) Seek(offset int64, whence int) (int64, error) {
 	if f.closed {
 		return 0, errFileClosed
 	}
+	size := int(f.f.size())
 	switch whence {
 	case io.SeekStart:
 		f.offset = int(offset)
 	case io.SeekCurrent:
 		f.offset += int(offset)
 	case io.SeekEnd:
-		f.offset = len(f.data) + int(offset)
+		f.offset = size + int(offset)
 	default:
 		panic(fmt.Errorf("Seek: invalid whence %d", whence))
 	}
-	if f.offset > len(f.data) {
-		f.offset = len(f.data)
+	if f.offset > size {
+		f.offset = size
 	} else if f.offset < 0 {
 		f.offset = 0
 	}
@@ -125,14 +185,192 @@ func (f *file) Write(p []byte) (int, error) {
 	if f.closed {
 		return 0, errFileClosed
 	}
-	count := len(p)
-	n := copy(f.data[f.offset:], p)
-	if n < count {
-		f.data = append(f.data, p[n:]...)
+	if f.append {
+		f.offset = int(f.f.size())
+	}
+	if err := f.f.writeAt(p, int64(f.offset)); err != nil {
+		return 0, err
+	}
+	f.offset += len(p)
+	if f.sync {
+		if err := f.f.sync(); err != nil {
+			return len(p), err
+		}
 	}
-	f.offset += count
-	f.f.ModTime = time.Now()
-	return count, nil
+	return len(p), nil
+}
+
+// WriteAt implements io.WriterAt. It does not modify the file offset.
+// If off is past the end of the file, the gap is filled with zeroes.
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	if !f.writable {
+		return 0, ErrReadOnly
+	}
+	if f.append {
+		return 0, errWriteAtInAppendMode
+	}
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	f.f.Lock()
+	defer f.f.Unlock()
+	if f.closed {
+		return 0, errFileClosed
+	}
+	if err := f.f.writeAt(p, off); err != nil {
+		return 0, err
+	}
+	if f.sync {
+		if err := f.f.sync(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Name returns the name of the file as passed to Open or OpenFile.
+func (f *file) Name() string {
+	return f.name
+}
+
+// Stat returns the os.FileInfo for the file.
+func (f *file) Stat() (os.FileInfo, error) {
+	f.f.RLock()
+	defer f.f.RUnlock()
+	if f.closed {
+		return nil, errFileClosed
+	}
+	return &EntryInfo{Path: f.name, Entry: f.f}, nil
+}
+
+// setFileData stores data into f, compressing it if required. It must
+// be called with the f lock held.
+func setFileData(f *File, data []byte) error {
+	if f.Mode&ModeCompress == 0 {
+		f.Data = data
+		return nil
+	}
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if buf.Len() < len(data) {
+		f.Data = buf.Bytes()
+	} else {
+		f.Mode &= ^ModeCompress
+		f.Data = data
+	}
+	return nil
+}
+
+func (f *file) Truncate(size int64) error {
+	if !f.writable {
+		return ErrReadOnly
+	}
+	if size < 0 {
+		return syscall.EINVAL
+	}
+	f.f.Lock()
+	defer f.f.Unlock()
+	if f.closed {
+		return errFileClosed
+	}
+	if err := f.f.truncate(size); err != nil {
+		return err
+	}
+	if f.offset > int(size) {
+		f.offset = int(size)
+	}
+	return nil
+}
+
+// Sync stores the contents of the file in its Data field. For files
+// with ModeCompress, this compresses the data written so far, which
+// otherwise happens when the last handle to the file is closed.
+func (f *file) Sync() error {
+	f.f.Lock()
+	defer f.f.Unlock()
+	if f.closed {
+		return errFileClosed
+	}
+	if err := f.f.sync(); err != nil {
+		return err
+	}
+	f.f.flatten()
+	return nil
+}
+
+// Lock implements Locker. Locks are kept in the *File, so they're
+// shared by all the handles to it, even if they were opened from
+// different file systems or using different hard links.
+func (f *file) Lock(exclusive bool) error {
+	want := lockShared
+	if exclusive {
+		want = lockExclusive
+	}
+	f.f.Lock()
+	defer f.f.Unlock()
+	if f.closed {
+		return errFileClosed
+	}
+	if f.lock == want {
+		return nil
+	}
+	if f.lock != lockNone {
+		f.f.changeLock(f.lock, lockNone)
+		f.lock = lockNone
+	}
+	for !f.f.canLock(lockNone, want) {
+		f.f.waitUnlock()
+		if f.closed {
+			// Closed by another goroutine while waiting
+			return errFileClosed
+		}
+	}
+	f.f.changeLock(lockNone, want)
+	f.lock = want
+	return nil
+}
+
+// TryLock implements Locker.
+func (f *file) TryLock(exclusive bool) (bool, error) {
+	want := lockShared
+	if exclusive {
+		want = lockExclusive
+	}
+	f.f.Lock()
+	defer f.f.Unlock()
+	if f.closed {
+		return false, errFileClosed
+	}
+	if f.lock == want {
+		return true, nil
+	}
+	// Converting a lock is not atomic, like with flock(2)
+	f.f.changeLock(f.lock, lockNone)
+	f.lock = lockNone
+	if !f.f.canLock(lockNone, want) {
+		return false, nil
+	}
+	f.f.changeLock(lockNone, want)
+	f.lock = want
+	return true, nil
+}
+
+// Unlock implements Locker.
+func (f *file) Unlock() error {
+	f.f.Lock()
+	defer f.f.Unlock()
+	if f.closed {
+		return errFileClosed
+	}
+	f.f.changeLock(f.lock, lockNone)
+	f.lock = lockNone
+	return nil
 }
 
 func (f *file) Close() error {
@@ -140,40 +378,29 @@ func (f *file) Close() error {
 		f.f.Lock()
 		defer f.f.Unlock()
 		if !f.closed {
-			if f.f.Mode&ModeCompress != 0 {
-				var buf bytes.Buffer
-				zw := zlib.NewWriter(&buf)
-				if _, err := zw.Write(f.data); err != nil {
-					return err
-				}
-				if err := zw.Close(); err != nil {
-					return err
-				}
-				if buf.Len() < len(f.data) {
-					f.f.Data = buf.Bytes()
-				} else {
-					f.f.Mode &= ^ModeCompress
-					f.f.Data = f.data
-				}
-			} else {
-				f.f.Data = f.data
+			if err := f.f.release(); err != nil {
+				return err
 			}
+			f.f.changeLock(f.lock, lockNone)
+			f.lock = lockNone
 			f.closed = true
+			untrackHandle(f.handle)
+			runtime.SetFinalizer(f, nil)
 		}
 	}
 	return nil
 }
 
 func (f *file) IsCompressed() bool {
+	f.f.RLock()
+	defer f.f.RUnlock()
 	return f.f.Mode&ModeCompress != 0
 }
 
 func (f *file) SetCompressed(c bool) {
 	f.f.Lock()
 	defer f.f.Unlock()
-	if c {
-		f.f.Mode |= ModeCompress
-	} else {
-		f.f.Mode &= ^ModeCompress
+	if !f.closed {
+		f.f.setCompressed(c)
 	}
 }
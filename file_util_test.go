@@ -365,3 +365,329 @@ func TestWFileCloseCompressedZlibError(t *testing.T) {
 		t.Fatalf("after Close compressed: %q, %v", data, err)
 	}
 }
+
+func TestWFileTruncate(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := mem.OpenFile("f", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	tr, ok := w.(FileTruncater)
+	if !ok {
+		t.Fatal("memory WFile should implement FileTruncater")
+	}
+	if err := tr.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+	// Offset was past the new end, writing must not fail
+	if _, err := w.Write([]byte("X")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Truncate(8); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Truncate(-1); err == nil {
+		t.Error("Truncate(-1) should fail")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ReadFile(mem, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("0123X\x00\x00\x00"); !bytes.Equal(data, want) {
+		t.Errorf("after Truncate data = %q, want %q", data, want)
+	}
+	if err := tr.Truncate(0); err != errFileClosed {
+		t.Errorf("Truncate after Close = %v, want errFileClosed", err)
+	}
+	r, err := mem.OpenFile("f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	if err := r.(FileTruncater).Truncate(0); err != ErrReadOnly {
+		t.Errorf("Truncate on read only file = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestFileReadAtWriteAt(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := mem.OpenFile("f", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra, ok := w.(io.ReaderAt)
+	if !ok {
+		t.Fatal("memory WFile should implement io.ReaderAt")
+	}
+	wa, ok := w.(io.WriterAt)
+	if !ok {
+		t.Fatal("memory WFile should implement io.WriterAt")
+	}
+	buf := make([]byte, 4)
+	if n, err := ra.ReadAt(buf, 8); err != io.EOF || string(buf[:n]) != "89" {
+		t.Errorf("ReadAt(8) = %q, %v, want \"89\", EOF", buf[:n], err)
+	}
+	if _, err := ra.ReadAt(buf, 10); err != io.EOF {
+		t.Errorf("ReadAt(10) = %v, want EOF", err)
+	}
+	if _, err := ra.ReadAt(buf, -1); err == nil {
+		t.Error("ReadAt(-1) should fail")
+	}
+	if _, err := wa.WriteAt([]byte("AB"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wa.WriteAt([]byte("Z"), 12); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wa.WriteAt([]byte("Z"), -1); err == nil {
+		t.Error("WriteAt(-1) should fail")
+	}
+	// The offset is not modified by ReadAt and WriteAt
+	if off, err := w.Seek(0, io.SeekCurrent); err != nil || off != 0 {
+		t.Errorf("offset = %d, %v, want 0", off, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ReadFile(mem, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("01AB456789\x00\x00Z"); !bytes.Equal(data, want) {
+		t.Errorf("data = %q, want %q", data, want)
+	}
+	if _, err := ra.ReadAt(buf, 0); err != errFileClosed {
+		t.Errorf("ReadAt after Close = %v, want errFileClosed", err)
+	}
+	if _, err := wa.WriteAt(buf, 0); err != errFileClosed {
+		t.Errorf("WriteAt after Close = %v, want errFileClosed", err)
+	}
+	r, err := mem.OpenFile("f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	if _, err := r.(io.WriterAt).WriteAt(buf, 0); err != ErrReadOnly {
+		t.Errorf("WriteAt on read only file = %v, want ErrReadOnly", err)
+	}
+	wo, err := mem.OpenFile("f", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = wo.Close() }()
+	if _, err := wo.(io.ReaderAt).ReadAt(buf, 0); err != ErrWriteOnly {
+		t.Errorf("ReadAt on write only file = %v, want ErrWriteOnly", err)
+	}
+}
+
+func TestFileStatName(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := mem.OpenFile("d/f", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if name := w.(FileNamer).Name(); name != "d/f" {
+		t.Errorf("Name() = %q, want \"d/f\"", name)
+	}
+	info, err := w.(FileStater).Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "f" || info.Size() != 5 || info.IsDir() {
+		t.Errorf("Stat() = %s %d %v, want f 5 false", info.Name(), info.Size(), info.IsDir())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.(FileStater).Stat(); err != errFileClosed {
+		t.Errorf("Stat after Close = %v, want errFileClosed", err)
+	}
+	// *os.File implements the same interfaces
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	if err := WriteFile(fs, "f", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	if _, ok := f.(FileStater); !ok {
+		t.Error("*os.File should implement FileStater")
+	}
+	if _, ok := f.(FileNamer); !ok {
+		t.Error("*os.File should implement FileNamer")
+	}
+	if _, ok := f.(io.ReaderAt); !ok {
+		t.Error("*os.File should implement io.ReaderAt")
+	}
+}
+
+func TestFileSharedWrites(t *testing.T) {
+	mem := Memory()
+	w, err := mem.OpenFile("log", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = w.Close() }()
+	r, err := mem.Open("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	// Tail the file while it grows
+	buf := make([]byte, 16)
+	for _, line := range []string{"first\n", "second\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := r.Read(buf)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != line {
+			t.Errorf("tailing read = %q, want %q", buf[:n], line)
+		}
+	}
+	info, err := mem.Stat("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 13 {
+		t.Errorf("Stat while open size = %d, want 13", info.Size())
+	}
+}
+
+func TestFileConcurrentWritersMerge(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", []byte("aaaabbbb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w1, err := mem.OpenFile("f", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := mem.OpenFile("f", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w1.Write([]byte("AAAA")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w2.Seek(4, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w2.Write([]byte("BBBB")); err != nil {
+		t.Fatal(err)
+	}
+	// Closing in any order must not discard the other writes
+	if err := w2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(mem, "f"); err != nil || string(data) != "AAAABBBB" {
+		t.Errorf("ReadFile = %q, %v, want \"AAAABBBB\"", data, err)
+	}
+}
+
+func TestFileCompressedShared(t *testing.T) {
+	mem := Memory()
+	plain := bytes.Repeat([]byte("x"), 2000)
+	if err := WriteFile(mem, "f", plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Compress(mem); err != nil {
+		t.Fatal(err)
+	}
+	w, err := mem.OpenFile("f", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := mem.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if _, err := r.Read(buf); err != nil || buf[0] != 'y' {
+		t.Errorf("Read = %q, %v, want \"y\"", buf, err)
+	}
+	info, err := mem.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := info.Sys().(*File)
+	stored := len(f.Data)
+	if err := w.(FileSyncer).Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&ModeCompress == 0 || len(f.Data) >= len(plain) {
+		t.Errorf("after Sync mode = %v, stored %d bytes, want compressed", info.Mode(), len(f.Data))
+	}
+	if stored >= len(plain) {
+		t.Errorf("compressed data should not be replaced while handles are open")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ReadFile(mem, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != len(plain) || data[0] != 'y' || !bytes.Equal(data[1:], plain[1:]) {
+		t.Errorf("ReadFile after closing compressed file: len=%d", len(data))
+	}
+}
+
+func TestFileTruncateVisibleToReaders(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := mem.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	if _, err := r.Seek(8, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := Truncate(mem, "f", 4); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(make([]byte, 4)); n != 0 || err != io.EOF {
+		t.Errorf("Read past the truncated end = %d, %v, want 0, EOF", n, err)
+	}
+	if off, err := r.Seek(0, io.SeekCurrent); err != nil || off != 4 {
+		t.Errorf("offset after truncation = %d, %v, want 4", off, err)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // IMPORTANT: Note about wrapping os. functions: os.Open, os.OpenFile etc... will return a non-nil
@@ -15,6 +17,19 @@ import (
 // can't rely on checking f != nil to know if a correct handle was returned. That's why the
 // methods in fileSystem do the error checking themselves and return a true nil in case of error.
 
+// osFile wraps the *os.File handles returned by fileSystem, adding
+// the capabilities not provided by os, like Locker. The *os.File is
+// available through OSFiler.
+type osFile struct {
+	*os.File
+	// handle is set if the handle is tracked
+	handle *OpenHandle
+}
+
+func (f *osFile) OSFile() *os.File {
+	return f.File
+}
+
 type fileSystem struct {
 	root      string
 	temporary bool
@@ -41,7 +56,7 @@ func (fs *fileSystem) Open(path string) (RFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	return f, nil
+	return newOSFile(fs, f, path, os.O_RDONLY), nil
 }
 
 var ErrInvalidPath = errors.New("invalid path: attempt to access parent directory")
@@ -83,7 +98,7 @@ func (fs *fileSystem) OpenFile(path string, flag int, mode os.FileMode) (WFile,
 		return nil, err
 	}
 
-	return f, nil
+	return newOSFile(fs, f, path, flag), nil
 }
 
 func (fs *fileSystem) Lstat(path string) (os.FileInfo, error) {
@@ -125,6 +140,24 @@ func (fs *fileSystem) ReadDir(path string) ([]os.FileInfo, error) {
 	return files, nil
 }
 
+// OpenDir implements DirOpener using os.File.ReadDir, so the entries
+// are not sorted.
+func (fs *fileSystem) OpenDir(path string) (DirFile, error) {
+	f, err := os.Open(fs.path(path))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && !info.IsDir() {
+		err = &os.PathError{Op: "opendir", Path: path, Err: syscall.ENOTDIR}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return newOSFile(fs, f, path, os.O_RDONLY), nil
+}
+
 func (fs *fileSystem) Mkdir(path string, perm os.FileMode) error {
 	return os.Mkdir(fs.path(path), perm)
 }
@@ -133,6 +166,46 @@ func (fs *fileSystem) Remove(path string) error {
 	return os.Remove(fs.path(path))
 }
 
+func (fs *fileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(fs.path(oldpath), fs.path(newpath))
+}
+
+func (fs *fileSystem) Link(oldname, newname string) error {
+	return os.Link(fs.path(oldname), fs.path(newname))
+}
+
+// Symlink creates newname as a symbolic link to oldname. Note that
+// oldname is stored verbatim, so absolute targets are interpreted
+// by the operating system relative to its own root rather than fs
+// root.
+func (fs *fileSystem) Symlink(oldname, newname string) error {
+	return os.Symlink(filepath.FromSlash(oldname), fs.path(newname))
+}
+
+func (fs *fileSystem) Readlink(name string) (string, error) {
+	target, err := os.Readlink(fs.path(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(target), nil
+}
+
+func (fs *fileSystem) Truncate(name string, size int64) error {
+	return os.Truncate(fs.path(name), size)
+}
+
+func (fs *fileSystem) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(fs.path(name), mode)
+}
+
+func (fs *fileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(fs.path(name), atime, mtime)
+}
+
+func (fs *fileSystem) Chown(name string, uid, gid int) error {
+	return os.Chown(fs.path(name), uid, gid)
+}
+
 func (fs *fileSystem) String() string {
 	return fmt.Sprintf("fileSystem: %s", fs.root)
 }
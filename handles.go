@@ -0,0 +1,194 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OpenHandle describes a file handle opened while handle tracking
+// is enabled with TrackHandles.
+type OpenHandle struct {
+	// FS is the file system which opened the handle. For wrappers,
+	// it's the underlying file system.
+	FS VFS
+	// Path is the path of the handle in FS, as passed to it.
+	Path string
+	// Flag contains the flags used to open the handle.
+	Flag int
+	// Time is the time when the handle was opened.
+	Time time.Time
+	// Stack is the stack trace of the goroutine which opened
+	// the handle.
+	Stack string
+	// seq orders the handles by opening time.
+	seq uint64
+}
+
+func (h *OpenHandle) String() string {
+	return fmt.Sprintf("%s in %s (flags %#x) opened at %s\n%s", h.Path, h.FS, h.Flag, h.Time.Format(time.RFC3339Nano), h.Stack)
+}
+
+var (
+	trackingHandles atomic.Bool
+	handlesMu       sync.Mutex
+	handles         = make(map[*OpenHandle]struct{})
+	handlesSeq      uint64
+)
+
+// TrackHandles enables or disables tracking the file handles opened by
+// the file systems in this package, so they can be listed by
+// OpenHandles and the leaked ones are reported by LogLeakedHandle.
+// Tracking is intended for debugging and tests, since it records the
+// stack trace of every handle. Handles opened while it was disabled
+// are never tracked.
+func TrackHandles(enable bool) {
+	trackingHandles.Store(enable)
+}
+
+// trackHandle registers a handle opened by fs, returning nil
+// if tracking is disabled.
+func trackHandle(fs VFS, path string, flag int) *OpenHandle {
+	if !trackingHandles.Load() {
+		return nil
+	}
+	h := &OpenHandle{
+		FS:    fs,
+		Path:  path,
+		Flag:  flag,
+		Time:  time.Now(),
+		Stack: string(debug.Stack()),
+	}
+	handlesMu.Lock()
+	handlesSeq++
+	h.seq = handlesSeq
+	handles[h] = struct{}{}
+	handlesMu.Unlock()
+	return h
+}
+
+// untrackHandle unregisters a handle returned by trackHandle,
+// which might be nil.
+func untrackHandle(h *OpenHandle) {
+	if h == nil {
+		return
+	}
+	handlesMu.Lock()
+	delete(handles, h)
+	handlesMu.Unlock()
+}
+
+// leakedHandle reports a handle returned by trackHandle, which might be
+// nil, whose finalizer ran before it was closed.
+func leakedHandle(h *OpenHandle) {
+	if h != nil {
+		untrackHandle(h)
+		LogLeakedHandle(h)
+	}
+}
+
+// trackedHandles returns the tracked handles opened by fs.
+func trackedHandles(fs VFS) []OpenHandle {
+	handlesMu.Lock()
+	defer handlesMu.Unlock()
+	var list []OpenHandle
+	for h := range handles {
+		if h.FS == fs {
+			list = append(list, *h)
+		}
+	}
+	sortHandles(list)
+	return list
+}
+
+func sortHandles(list []OpenHandle) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].seq < list[j].seq
+	})
+}
+
+// OpenHandles returns the tracked handles which are still open in fs,
+// sorted by opening time. Wrappers return the handles opened through
+// any of them, with the paths relative to the wrapper when possible.
+// If fs does not implement HandleLister nor Container, it returns nil.
+func OpenHandles(fs VFS) []OpenHandle {
+	if l, ok := fs.(HandleLister); ok {
+		return l.OpenHandles()
+	}
+	if c, ok := fs.(Container); ok {
+		return OpenHandles(c.VFS())
+	}
+	return nil
+}
+
+// CheckHandles returns an error listing the tracked handles still open
+// in fs, or nil if there are none. It's intended to be called at the
+// end of tests, to detect leaked handles.
+func CheckHandles(fs VFS) error {
+	list := OpenHandles(fs)
+	if len(list) == 0 {
+		return nil
+	}
+	s := make([]string, len(list))
+	for ii := range list {
+		s[ii] = list[ii].String()
+	}
+	return fmt.Errorf("%d handles open in %s:\n%s", len(list), fs, strings.Join(s, "\n"))
+}
+
+// newOSFile returns the handle for f, opened by fs at path.
+func newOSFile(fs VFS, f *os.File, path string, flag int) *osFile {
+	h := &osFile{File: f, handle: trackHandle(fs, path, flag)}
+	if h.handle != nil {
+		runtime.SetFinalizer(h, func(h *osFile) {
+			leakedHandle(h.handle)
+		})
+	}
+	return h
+}
+
+func (f *osFile) Close() error {
+	if f.handle != nil {
+		untrackHandle(f.handle)
+		runtime.SetFinalizer(f, nil)
+	}
+	return f.File.Close()
+}
+
+func (fs *fileSystem) OpenHandles() []OpenHandle {
+	return trackedHandles(fs)
+}
+
+func (fs *memoryFileSystem) OpenHandles() []OpenHandle {
+	return trackedHandles(fs)
+}
+
+func (fs *chrootFileSystem) OpenHandles() []OpenHandle {
+	var list []OpenHandle
+	for _, h := range OpenHandles(fs.fs) {
+		if rel, ok := hasSubdir(fs.root, h.Path); ok {
+			h.Path = "/" + rel
+			list = append(list, h)
+		}
+	}
+	return list
+}
+
+func (m *Mounter) OpenHandles() []OpenHandle {
+	var list []OpenHandle
+	for _, mp := range m.points {
+		for _, h := range OpenHandles(mp.fs) {
+			h.Path = path.Join(mp.point, h.Path)
+			list = append(list, h)
+		}
+	}
+	sortHandles(list)
+	return list
+}
@@ -0,0 +1,161 @@
+package vfs
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func trackHandles(t *testing.T) {
+	TrackHandles(true)
+	t.Cleanup(func() { TrackHandles(false) })
+}
+
+func testTrackHandles(t *testing.T, fs VFS) {
+	trackHandles(t)
+	if err := WriteFile(fs, "f", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckHandles(fs); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handles := OpenHandles(fs)
+	if len(handles) != 1 {
+		t.Fatalf("%d open handles, want 1", len(handles))
+	}
+	if h := handles[0]; h.Path != "f" || h.Flag != os.O_RDWR || !strings.Contains(h.Stack, "testTrackHandles") {
+		t.Errorf("handle = %s, want f opened with O_RDWR by testTrackHandles", &h)
+	}
+	if err := CheckHandles(fs); err == nil || !strings.Contains(err.Error(), "1 handles open") {
+		t.Errorf("CheckHandles = %v, want 1 handle open", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckHandles(fs); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryTrackHandles(t *testing.T) {
+	testTrackHandles(t, Memory())
+}
+
+func TestTmpFSTrackHandles(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testTrackHandles(t, fs)
+}
+
+func TestTrackHandlesDisabled(t *testing.T) {
+	fs := Memory()
+	if err := WriteFile(fs, "f", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	if handles := OpenHandles(fs); len(handles) != 0 {
+		t.Errorf("%d handles tracked while disabled, want 0", len(handles))
+	}
+}
+
+func TestTrackHandlesWrappers(t *testing.T) {
+	trackHandles(t)
+	mem := Memory()
+	if err := MkdirAll(mem, "sub/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "sub/dir/f", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "g", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := Chroot("sub", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(Memory(), "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := MkdirAll(m, "/mnt", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(ch, "/mnt"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ReadOnly(m).Open("/mnt/dir/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	g, err := mem.Open("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = g.Close() }()
+	for _, v := range []struct {
+		fs    VFS
+		paths []string
+	}{
+		{mem, []string{"/sub/dir/f", "g"}},
+		{ch, []string{"/dir/f"}},
+		{m, []string{"/mnt/dir/f"}},
+		{ReadOnly(m), []string{"/mnt/dir/f"}},
+	} {
+		var paths []string
+		for _, h := range OpenHandles(v.fs) {
+			paths = append(paths, h.Path)
+		}
+		if strings.Join(paths, ",") != strings.Join(v.paths, ",") {
+			t.Errorf("OpenHandles(%s) = %v, want %v", v.fs, paths, v.paths)
+		}
+	}
+}
+
+func TestLeakedHandle(t *testing.T) {
+	trackHandles(t)
+	leaked := make(chan *OpenHandle, 1)
+	prev := LogLeakedHandle
+	LogLeakedHandle = func(h *OpenHandle) { leaked <- h }
+	defer func() { LogLeakedHandle = prev }()
+	fs := Memory()
+	if err := WriteFile(fs, "f", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		if _, err := fs.Open("f"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	timeout := time.After(5 * time.Second)
+	for {
+		runtime.GC()
+		select {
+		case h := <-leaked:
+			if h.Path != "f" {
+				t.Errorf("leaked handle path = %q, want \"f\"", h.Path)
+			}
+			if err := CheckHandles(fs); err != nil {
+				t.Errorf("leaked handle still listed: %v", err)
+			}
+			return
+		case <-timeout:
+			t.Fatal("leaked handle was not reported")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package vfs
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// hybridStore decides when the files of a Hybrid file system are spilled
+// to disk, and keeps track of the memory used by the rest of them. Its
+// methods might be called on a nil *hybridStore, for files from other
+// in-memory file systems, which are never spilled.
+type hybridStore struct {
+	spill     TemporaryVFS
+	threshold int64
+	budget    atomic.Int64
+	usage     atomic.Int64
+	seq       atomic.Uint64
+	// mu protects the cache of handles to the spilled files, most
+	// recently used first. Only the ones not in use are closed
+	// when it holds more than maxOpen.
+	mu      sync.Mutex
+	open    list.List
+	maxOpen int
+}
+
+// spillOpenFiles is the number of handles to spilled files kept open
+// by each Hybrid file system.
+const spillOpenFiles = 64
+
+// spills returns whether f, which is locked, must be spilled before
+// growing up to end bytes.
+func (s *hybridStore) spills(f *File, end int64) bool {
+	if s == nil || f.Mode&ModeCompress != 0 {
+		return false
+	}
+	size := max(end, f.size())
+	if s.threshold > 0 && size > s.threshold {
+		return true
+	}
+	budget := s.budget.Load()
+	return budget > 0 && s.usage.Load()-f.accounted+size > budget
+}
+
+// account updates the memory usage with the size of f, which is locked.
+func (s *hybridStore) account(f *File) {
+	if s == nil {
+		return
+	}
+	var size int64
+	if f.spill == nil && f.source == nil {
+		size = f.size()
+	}
+	s.usage.Add(size - f.accounted)
+	f.accounted = size
+}
+
+// spillHandle is the interface required from the files
+// opened in the spill VFS.
+type spillHandle interface {
+	WFile
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// spillFile stores the data of a File in the spill VFS. Like the
+// rest of the storage, it's protected by the lock of its File. Once
+// frozen copies of the File share the data, it's never written again,
+// and the File copies it first.
+type spillFile struct {
+	*spillBacking
+	size   int64
+	shared bool
+	// cleanup drops the reference of frozen copies when they're
+	// garbage collected
+	cleanup runtime.Cleanup
+}
+
+// spillBacking is the file in the spill VFS with the data of a
+// spillFile and its copies, which is only opened while it's in the
+// cache of its store. It's removed once none of them uses it.
+type spillBacking struct {
+	store *hybridStore
+	name  string
+	refs  atomic.Int32
+	// h is the open handle, users the number of operations using
+	// it and elem its element in the cache. They're protected by
+	// the lock of the store.
+	h     spillHandle
+	users int
+	elem  *list.Element
+}
+
+func (s *hybridStore) create() (*spillFile, error) {
+	name := fmt.Sprintf("spill-%d", s.seq.Add(1))
+	f, err := s.spill.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	h, ok := f.(spillHandle)
+	if !ok {
+		_ = f.Close()
+		_ = s.spill.Remove(name)
+		return nil, fmt.Errorf("%s does not support random access: %w", s.spill, errors.ErrUnsupported)
+	}
+	b := &spillBacking{store: s, name: name}
+	b.refs.Store(1)
+	s.mu.Lock()
+	s.cache(b, h)
+	s.mu.Unlock()
+	return &spillFile{spillBacking: b}, nil
+}
+
+// acquire returns the handle to b, opening it if it's not cached. It
+// can't be closed until release is called.
+func (s *hybridStore) acquire(b *spillBacking) (spillHandle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b.h == nil {
+		h, err := s.spill.OpenFile(b.name, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		// The handle was checked when the file was created
+		s.cache(b, h.(spillHandle))
+	} else {
+		s.open.MoveToFront(b.elem)
+	}
+	b.users++
+	return b.h, nil
+}
+
+func (s *hybridStore) release(b *spillBacking) {
+	s.mu.Lock()
+	b.users--
+	s.mu.Unlock()
+}
+
+// cache adds the handle h to b to the cache, closing the least recently
+// used ones which aren't in use if it's full. It must be called with
+// the lock held.
+func (s *hybridStore) cache(b *spillBacking, h spillHandle) {
+	for e := s.open.Back(); e != nil && s.open.Len() >= s.maxOpen; {
+		prev := e.Prev()
+		if o := e.Value.(*spillBacking); o.users == 0 {
+			s.uncache(o)
+		}
+		e = prev
+	}
+	b.h, b.elem = h, s.open.PushFront(b)
+}
+
+// uncache closes the handle to b, if it's cached. It must be called
+// with the lock held.
+func (s *hybridStore) uncache(b *spillBacking) {
+	if b.h == nil {
+		return
+	}
+	if err := b.h.Close(); err != nil {
+		LogCloseError(err)
+	}
+	s.open.Remove(b.elem)
+	b.h, b.elem = nil, nil
+}
+
+// unref drops a reference to b, removing it from the spill VFS if it
+// was the last one.
+func (b *spillBacking) unref() error {
+	if b.refs.Add(-1) > 0 {
+		return nil
+	}
+	b.store.mu.Lock()
+	b.store.uncache(b)
+	b.store.mu.Unlock()
+	// Frozen copies might outlive the spill VFS
+	if err := b.store.spill.Remove(b.name); err != nil && !IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *spillFile) readAt(p []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, nil
+	}
+	p = p[:min(int64(len(p)), s.size-off)]
+	h, err := s.store.acquire(s.spillBacking)
+	if err != nil {
+		return 0, err
+	}
+	defer s.store.release(s.spillBacking)
+	n, err := h.ReadAt(p, off)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *spillFile) writeAt(p []byte, off int64) error {
+	h, err := s.store.acquire(s.spillBacking)
+	if err != nil {
+		return err
+	}
+	defer s.store.release(s.spillBacking)
+	if _, err := h.WriteAt(p, off); err != nil {
+		return err
+	}
+	s.size = max(s.size, off+int64(len(p)))
+	return nil
+}
+
+func (s *spillFile) truncate(size int64) error {
+	h, err := s.store.acquire(s.spillBacking)
+	if err != nil {
+		return err
+	}
+	defer s.store.release(s.spillBacking)
+	if err := h.Truncate(size); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+// share returns the spillFile of a frozen copy of the File of s, reading
+// the same data. It must be called with the lock of the File held.
+func (s *spillFile) share() *spillFile {
+	s.shared = true
+	s.refs.Add(1)
+	c := &spillFile{spillBacking: s.spillBacking, size: s.size, shared: true}
+	c.cleanup = runtime.AddCleanup(c, func(b *spillBacking) {
+		if err := b.unref(); err != nil {
+			LogCloseError(err)
+		}
+	}, s.spillBacking)
+	return c
+}
+
+// drop releases the data of s, which is removed from the spill VFS
+// once no other File reads it.
+func (s *spillFile) drop() error {
+	s.cleanup.Stop()
+	return s.unref()
+}
+
+// unshare gives f, which is locked, its own copy of its spilled data
+// before modifying it, if frozen copies read it too. Files from Hybrid
+// file systems copy it in the spill VFS, while the rest, which come
+// from a Fork, read it into memory.
+func (f *File) unshare() error {
+	s := f.spill
+	if s == nil || !s.shared {
+		return nil
+	}
+	if f.store == nil {
+		data := make([]byte, s.size)
+		if _, err := s.readAt(data, 0); err != nil {
+			return err
+		}
+		f.spill, f.Data = nil, data
+	} else {
+		c, err := f.store.create()
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, pageSize)
+		for off := int64(0); off < s.size; off += pageSize {
+			n, err := s.readAt(buf, off)
+			if err == nil {
+				err = c.writeAt(buf[:n], off)
+			}
+			if err != nil {
+				_ = c.drop()
+				return err
+			}
+		}
+		f.spill = c
+	}
+	if err := s.drop(); err != nil {
+		LogCloseError(err)
+	}
+	return nil
+}
+
+// spillData moves the data of f, which is locked, to the spill VFS.
+// Holes are not written, so they're kept if the spill VFS supports
+// sparse files.
+func (f *File) spillData() error {
+	s, err := f.store.create()
+	if err != nil {
+		return err
+	}
+	p := f.storage()
+	for ii, pg := range p.pages {
+		if pg == nil {
+			continue
+		}
+		if err := s.writeAt(pg.buf, int64(ii)*pageSize); err != nil {
+			_ = s.drop()
+			return err
+		}
+	}
+	if err := s.truncate(p.size); err != nil {
+		_ = s.drop()
+		return err
+	}
+	f.spill = s
+	f.pages = nil
+	f.store.account(f)
+	return nil
+}
+
+type hybridFileSystem struct {
+	*memoryFileSystem
+}
+
+func (fs *hybridFileSystem) SetBudget(budget int64) {
+	fs.store.budget.Store(budget)
+}
+
+func (fs *hybridFileSystem) InMemory() int64 {
+	return fs.store.usage.Load()
+}
+
+func (fs *hybridFileSystem) Close() error {
+	s := fs.store
+	s.mu.Lock()
+	for s.open.Len() > 0 {
+		s.uncache(s.open.Front().Value.(*spillBacking))
+	}
+	s.mu.Unlock()
+	return s.spill.Close()
+}
+
+func (fs *hybridFileSystem) String() string {
+	return fmt.Sprintf("HybridFileSystem spilling to %s", fs.store.spill)
+}
+
+// Hybrid returns an empty in memory VFS which moves the data of the files
+// larger than threshold bytes to the given spill VFS, usually created with
+// TmpFS. A threshold <= 0 disables it, leaving only the budget set with
+// SetBudget. Spilled files are still part of the in-memory tree, so
+// Stat, ReadDir, Walk and the rest of the operations see no difference,
+// but they can't be compressed. Their data is removed from the spill VFS
+// once they're removed, their handles are closed and no snapshot reads
+// it, while Close removes the spill VFS.
+func Hybrid(threshold int64, spill TemporaryVFS) HybridVFS {
+	fs := newMemory()
+	fs.store = &hybridStore{spill: spill, threshold: threshold, maxOpen: spillOpenFiles}
+	return &hybridFileSystem{memoryFileSystem: fs}
+}
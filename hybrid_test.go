@@ -0,0 +1,157 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func newTestHybrid(t *testing.T, threshold int64) (HybridVFS, TemporaryVFS) {
+	spill, err := TmpFS("vfs-test-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := Hybrid(threshold, spill)
+	t.Cleanup(func() { _ = fs.Close() })
+	return fs, spill
+}
+
+func spilledFiles(t *testing.T, spill VFS) int {
+	infos, err := spill.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(infos)
+}
+
+func TestHybrid(t *testing.T) {
+	fs, _ := newTestHybrid(t, 1)
+	testVFS(t, fs)
+}
+
+func TestHybridSpills(t *testing.T) {
+	fs, spill := newTestHybrid(t, 1024)
+	small := []byte("small")
+	large := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := WriteFile(fs, "small", small, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "large", large, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := spilledFiles(t, spill); n != 1 {
+		t.Errorf("%d files were spilled, want 1", n)
+	}
+	if n := fs.InMemory(); n != int64(len(small)) {
+		t.Errorf("InMemory = %d, want %d", n, len(small))
+	}
+	if info, err := fs.Stat("large"); err != nil || info.Size() != int64(len(large)) {
+		t.Errorf("Stat(large) = %v, %v, want size %d", info, err, len(large))
+	}
+	f, err := fs.OpenFile("large", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.(io.WriterAt).WriteAt([]byte("xyz"), 5000); err != nil {
+		t.Fatal(err)
+	}
+	copy(large[5000:], "xyz")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "large"); err != nil || !bytes.Equal(data, large) {
+		t.Errorf("ReadFile(large) returned different data, %v", err)
+	}
+	if err := Rename(fs, "large", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := fs.Open("moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("moved"); err != nil {
+		t.Fatal(err)
+	}
+	// The data must be kept until the last handle is closed
+	if n := spilledFiles(t, spill); n != 1 {
+		t.Errorf("%d files spilled after removing with open handles, want 1", n)
+	}
+	if data, err := io.ReadAll(r); err != nil || !bytes.Equal(data, large) {
+		t.Errorf("reading removed file returned different data, %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := spilledFiles(t, spill); n != 0 {
+		t.Errorf("%d files spilled after closing removed file, want 0", n)
+	}
+}
+
+func TestHybridBudget(t *testing.T) {
+	fs, spill := newTestHybrid(t, 0)
+	fs.SetBudget(100)
+	data := bytes.Repeat([]byte("a"), 40)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := WriteFile(fs, name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fs.InMemory(); n != 80 {
+		t.Errorf("InMemory = %d, want 80", n)
+	}
+	if n := spilledFiles(t, spill); n != 2 {
+		t.Errorf("%d files were spilled, want 2", n)
+	}
+	if err := fs.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.InMemory(); n != 40 {
+		t.Errorf("InMemory after removing = %d, want 40", n)
+	}
+	if err := WriteFileAtomic(fs, "c", []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := spilledFiles(t, spill); n != 1 {
+		t.Errorf("%d files spilled after replacing one, want 1", n)
+	}
+	if got, err := ReadFile(fs, "c"); err != nil || string(got) != "c" {
+		t.Errorf("ReadFile(c) = %q, %v, want \"c\"", got, err)
+	}
+}
+
+func TestHybridOpenSpillFiles(t *testing.T) {
+	fs, spill := newTestHybrid(t, 1)
+	store := fs.(*hybridFileSystem).store
+	store.maxOpen = 2
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range names {
+		if err := WriteFile(fs, name, []byte(name+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := spilledFiles(t, spill); n != len(names) {
+		t.Errorf("%d files were spilled, want %d", n, len(names))
+	}
+	for range 2 {
+		for _, name := range names {
+			checkContents(t, fs, name, name+name)
+		}
+	}
+	if n := store.open.Len(); n > store.maxOpen {
+		t.Errorf("%d spilled files are open, want at most %d", n, store.maxOpen)
+	}
+}
+
+func TestHybridClose(t *testing.T) {
+	fs, spill := newTestHybrid(t, 1)
+	if err := WriteFile(fs, "f", []byte("spilled"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(spill.Root()); !os.IsNotExist(err) {
+		t.Errorf("spill directory still exists after Close, %v", err)
+	}
+}
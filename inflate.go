@@ -0,0 +1,659 @@
+package vfs
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+)
+
+// inflater decompresses gzip streams, like compress/gzip, but it can
+// also start decompressing at the beginning of any deflate block, given
+// the data before it, which compress/flate does not support. This is
+// what allows TarGzipReaderAt to read its files without decompressing
+// all the data before them.
+type inflater struct {
+	r *bufio.Reader
+	// start is the offset of r in the compressed data, and in the
+	// number of bytes read from it.
+	start int64
+	in    int64
+	bits  uint64
+	nbits uint
+	// win holds the last 32 KiB of data, used by back references,
+	// and the data decoded but not read yet. wpos and rpos are the
+	// offsets of the data written to it and read from it, and hist
+	// the offset of the oldest data back references can use.
+	win  [inflateRing]byte
+	wpos int64
+	rpos int64
+	hist int64
+	// state is the next part of the stream to read
+	state inflateState
+	final bool
+	// stored is the number of bytes left in a stored block
+	stored int
+	// lit and dist are the codes of the current block, and dyn
+	// the storage for dynamic ones
+	lit  *huffman
+	dist *huffman
+	dyn  [2]huffman
+	// crc and size are the checksum and the size of the data of
+	// the current member, which can only be checked if it was
+	// decompressed from its start.
+	crc      uint32
+	size     uint32
+	checksum bool
+	// point, if set, is called at the start of every member and
+	// deflate block, with its offset in bits.
+	point func(in int64, out int64, header bool)
+	err   error
+}
+
+type inflateState uint8
+
+const (
+	inflateMember inflateState = iota
+	inflateBlock
+	inflateStored
+	inflateHuffman
+	inflateTrailer
+)
+
+const (
+	// inflateRing is the size of the ring buffer of inflater
+	inflateRing = 1 << 16
+	// inflateLimit is the maximum amount of data decoded but not
+	// read, so the ring buffer always keeps the last 32 KiB too.
+	inflateLimit = 1<<15 - maxMatch - 1
+	maxMatch     = 258
+	maxCodeBits  = 15
+	fastBits     = 9
+)
+
+// gzipPoint is a position in a gzip stream where decompression can
+// start: the beginning of a member or a deflate block, whose offset in
+// the compressed data is in, in bits.
+type gzipPoint struct {
+	in     int64
+	out    int64
+	header bool
+	// window contains the data before out in the same member, up
+	// to 32 KiB, which is used by back references.
+	window []byte
+}
+
+// newInflater returns an inflater for the gzip stream in r, starting at
+// the given point.
+func newInflater(r io.ReaderAt, p *gzipPoint) (*inflater, error) {
+	start := p.in / 8
+	z := &inflater{
+		r:     bufio.NewReader(io.NewSectionReader(r, start, 1<<63-1-start)),
+		start: start,
+		wpos:  p.out,
+		rpos:  p.out,
+		hist:  p.out - int64(len(p.window)),
+	}
+	for ii, c := range p.window {
+		z.win[(z.hist+int64(ii))&(inflateRing-1)] = c
+	}
+	if !p.header {
+		z.state = inflateBlock
+		if skip := uint(p.in % 8); skip > 0 {
+			if _, err := z.getBits(skip); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return z, nil
+}
+
+func (z *inflater) Read(p []byte) (int, error) {
+	for z.wpos == z.rpos {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.step()
+	}
+	n := 0
+	for n < len(p) && z.rpos < z.wpos {
+		pos := int(z.rpos & (inflateRing - 1))
+		end := min(len(z.win), pos+int(z.wpos-z.rpos))
+		c := copy(p[n:], z.win[pos:end])
+		n += c
+		z.rpos += int64(c)
+	}
+	return n, nil
+}
+
+// offset returns the offset of the next bit to read, in bits.
+func (z *inflater) offset() int64 {
+	return (z.start+z.in)*8 - int64(z.nbits)
+}
+
+// window returns a copy of the data back references can use.
+func (z *inflater) window() []byte {
+	from := max(z.hist, z.wpos-1<<15)
+	data := make([]byte, z.wpos-from)
+	for ii := range data {
+		data[ii] = z.win[(from+int64(ii))&(inflateRing-1)]
+	}
+	return data
+}
+
+func (z *inflater) corrupt() error {
+	return flate.CorruptInputError(z.offset() / 8)
+}
+
+func (z *inflater) fill(n uint) error {
+	for z.nbits < n {
+		c, err := z.r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		z.in++
+		z.bits |= uint64(c) << z.nbits
+		z.nbits += 8
+	}
+	return nil
+}
+
+func (z *inflater) getBits(n uint) (uint32, error) {
+	if err := z.fill(n); err != nil {
+		return 0, err
+	}
+	v := uint32(z.bits & (1<<n - 1))
+	z.bits >>= n
+	z.nbits -= n
+	return v, nil
+}
+
+// readByte reads a byte, which requires the stream to be byte aligned.
+func (z *inflater) readByte() (byte, error) {
+	b, err := z.getBits(8)
+	return byte(b), err
+}
+
+func (z *inflater) step() error {
+	switch z.state {
+	case inflateMember:
+		return z.member()
+	case inflateBlock:
+		return z.block()
+	case inflateStored:
+		return z.storedData()
+	case inflateHuffman:
+		return z.huffmanData()
+	}
+	return z.trailer()
+}
+
+// member reads the header of a gzip member.
+func (z *inflater) member() error {
+	if z.point != nil {
+		z.point(z.offset(), z.wpos, true)
+	}
+	if _, err := z.r.Peek(1); err == io.EOF && z.offset() > 0 {
+		// No more members
+		return io.EOF
+	}
+	var hdr [10]byte
+	for ii := range hdr {
+		c, err := z.readByte()
+		if err != nil {
+			return err
+		}
+		hdr[ii] = c
+	}
+	if hdr[0] != 0x1f || hdr[1] != 0x8b || hdr[2] != 8 || hdr[3]&0xe0 != 0 {
+		return gzip.ErrHeader
+	}
+	flags := hdr[3]
+	if flags&0x04 != 0 {
+		// Extra field
+		n, err := z.getBits(16)
+		if err != nil {
+			return err
+		}
+		for ; n > 0; n-- {
+			if _, err := z.readByte(); err != nil {
+				return err
+			}
+		}
+	}
+	// Name and comment
+	for _, flag := range []byte{0x08, 0x10} {
+		for flags&flag != 0 {
+			c, err := z.readByte()
+			if err != nil {
+				return err
+			}
+			if c == 0 {
+				break
+			}
+		}
+	}
+	if flags&0x02 != 0 {
+		// Header CRC
+		if _, err := z.getBits(16); err != nil {
+			return err
+		}
+	}
+	z.hist = z.wpos
+	z.crc, z.size, z.checksum = 0, 0, true
+	z.state = inflateBlock
+	return nil
+}
+
+// trailer checks the trailer of a gzip member.
+func (z *inflater) trailer() error {
+	z.bits >>= z.nbits % 8
+	z.nbits -= z.nbits % 8
+	var trailer [8]byte
+	for ii := range trailer {
+		c, err := z.readByte()
+		if err != nil {
+			return err
+		}
+		trailer[ii] = c
+	}
+	if z.checksum && (binary.LittleEndian.Uint32(trailer[:4]) != z.crc || binary.LittleEndian.Uint32(trailer[4:]) != z.size) {
+		return gzip.ErrChecksum
+	}
+	z.state = inflateMember
+	return nil
+}
+
+// block reads the header of a deflate block.
+func (z *inflater) block() error {
+	if z.point != nil {
+		z.point(z.offset(), z.wpos, false)
+	}
+	hdr, err := z.getBits(3)
+	if err != nil {
+		return err
+	}
+	z.final = hdr&1 != 0
+	switch hdr >> 1 {
+	case 0:
+		z.bits >>= z.nbits % 8
+		z.nbits -= z.nbits % 8
+		n, err := z.getBits(16)
+		if err != nil {
+			return err
+		}
+		nn, err := z.getBits(16)
+		if err != nil {
+			return err
+		}
+		if n != ^nn&0xffff {
+			return z.corrupt()
+		}
+		z.stored = int(n)
+		z.state = inflateStored
+	case 1:
+		z.lit, z.dist = fixedCodes()
+		z.state = inflateHuffman
+	case 2:
+		if err := z.dynamicCodes(); err != nil {
+			return err
+		}
+		z.state = inflateHuffman
+	default:
+		return z.corrupt()
+	}
+	return nil
+}
+
+// endBlock updates the state after the end of a block.
+func (z *inflater) endBlock() {
+	if z.final {
+		z.state = inflateTrailer
+	} else {
+		z.state = inflateBlock
+	}
+}
+
+// produced updates the checksum with the data written from offset from.
+func (z *inflater) produced(from int64) {
+	z.size += uint32(z.wpos - from)
+	for from < z.wpos {
+		pos := int(from & (inflateRing - 1))
+		end := min(len(z.win), pos+int(z.wpos-from))
+		z.crc = crc32.Update(z.crc, crc32.IEEETable, z.win[pos:end])
+		from += int64(end - pos)
+	}
+}
+
+func (z *inflater) storedData() error {
+	from := z.wpos
+	defer z.produced(from)
+	for z.stored > 0 && z.wpos-z.rpos < inflateLimit {
+		if z.nbits > 0 {
+			// Bytes already in the bit buffer
+			c, err := z.readByte()
+			if err != nil {
+				return err
+			}
+			z.win[z.wpos&(inflateRing-1)] = c
+			z.wpos++
+			z.stored--
+			continue
+		}
+		pos := int(z.wpos & (inflateRing - 1))
+		n := min(z.stored, inflateLimit-int(z.wpos-z.rpos), len(z.win)-pos)
+		n, err := io.ReadFull(z.r, z.win[pos:pos+n])
+		z.in += int64(n)
+		z.wpos += int64(n)
+		z.stored -= n
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	if z.stored == 0 {
+		z.endBlock()
+	}
+	return nil
+}
+
+var (
+	lengthBase  = [...]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [...]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [...]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [...]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	// codeLengthOrder is the order of the lengths of the code
+	// used for the lengths of dynamic codes.
+	codeLengthOrder = [...]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+func (z *inflater) huffmanData() error {
+	from := z.wpos
+	defer z.produced(from)
+	mask := int64(inflateRing - 1)
+	for z.wpos-z.rpos < inflateLimit {
+		sym, err := z.decode(z.lit)
+		if err != nil {
+			return err
+		}
+		if sym < 256 {
+			z.win[z.wpos&mask] = byte(sym)
+			z.wpos++
+			continue
+		}
+		if sym == 256 {
+			z.endBlock()
+			return nil
+		}
+		sym -= 257
+		if sym >= len(lengthBase) {
+			return z.corrupt()
+		}
+		extra, err := z.getBits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(lengthBase[sym]) + int(extra)
+		if sym, err = z.decode(z.dist); err != nil {
+			return err
+		}
+		if sym >= len(distBase) {
+			return z.corrupt()
+		}
+		if extra, err = z.getBits(uint(distExtra[sym])); err != nil {
+			return err
+		}
+		dist := int64(distBase[sym]) + int64(extra)
+		if dist > z.wpos-z.hist {
+			return z.corrupt()
+		}
+		for ; length > 0; length-- {
+			z.win[z.wpos&mask] = z.win[(z.wpos-dist)&mask]
+			z.wpos++
+		}
+	}
+	return nil
+}
+
+func (z *inflater) dynamicCodes() error {
+	var counts [3]uint32
+	for ii, n := range []uint{5, 5, 4} {
+		v, err := z.getBits(n)
+		if err != nil {
+			return err
+		}
+		counts[ii] = v
+	}
+	nlit, ndist, nlen := int(counts[0])+257, int(counts[1])+1, int(counts[2])+4
+	if nlit > 286 || ndist > 30 {
+		return z.corrupt()
+	}
+	var lengths [286 + 30]uint8
+	for ii := 0; ii < nlen; ii++ {
+		v, err := z.getBits(3)
+		if err != nil {
+			return err
+		}
+		lengths[codeLengthOrder[ii]] = uint8(v)
+	}
+	var lenCode huffman
+	if !lenCode.init(lengths[:19]) {
+		return z.corrupt()
+	}
+	clear(lengths[:19])
+	for ii := 0; ii < nlit+ndist; {
+		sym, err := z.decode(&lenCode)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[ii] = uint8(sym)
+			ii++
+			continue
+		}
+		var value uint8
+		var rep uint32
+		switch sym {
+		case 16:
+			if ii == 0 {
+				return z.corrupt()
+			}
+			value = lengths[ii-1]
+			rep, err = z.getBits(2)
+			rep += 3
+		case 17:
+			rep, err = z.getBits(3)
+			rep += 3
+		default:
+			rep, err = z.getBits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if ii+int(rep) > nlit+ndist {
+			return z.corrupt()
+		}
+		for ; rep > 0; rep-- {
+			lengths[ii] = value
+			ii++
+		}
+	}
+	if lengths[256] == 0 {
+		return z.corrupt()
+	}
+	z.lit, z.dist = &z.dyn[0], &z.dyn[1]
+	if !z.lit.init(lengths[:nlit]) || !z.dist.init(lengths[nlit:nlit+ndist]) {
+		return z.corrupt()
+	}
+	return nil
+}
+
+// huffman is a canonical Huffman code. Codes up to fastBits long are
+// decoded with a lookup table, and the rest bit by bit.
+type huffman struct {
+	counts  [maxCodeBits + 1]uint16
+	symbols [288]uint16
+	// fast maps the next fastBits bits to a symbol and the length
+	// of its code, in the low 4 bits, or 0 for longer codes.
+	fast [1 << fastBits]uint16
+}
+
+// init initializes the code from the code lengths of each symbol,
+// returning false if they're invalid.
+func (h *huffman) init(lengths []uint8) bool {
+	clear(h.counts[:])
+	clear(h.fast[:])
+	for _, l := range lengths {
+		h.counts[l]++
+	}
+	h.counts[0] = 0
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left = left<<1 - int(h.counts[l])
+		if left < 0 {
+			return false
+		}
+	}
+	var offsets, next [maxCodeBits + 2]int
+	code := 0
+	for l := 1; l <= maxCodeBits; l++ {
+		offsets[l+1] = offsets[l] + int(h.counts[l])
+		code = (code + int(h.counts[l-1])) << 1
+		next[l] = code
+	}
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		h.symbols[offsets[l]] = uint16(sym)
+		offsets[l]++
+		c := next[l]
+		next[l]++
+		if l > fastBits {
+			continue
+		}
+		rev := 0
+		for ii := uint8(0); ii < l; ii++ {
+			rev |= (c >> ii & 1) << (l - 1 - ii)
+		}
+		for ; rev < len(h.fast); rev += 1 << l {
+			h.fast[rev] = uint16(sym)<<4 | uint16(l)
+		}
+	}
+	return true
+}
+
+func (z *inflater) decode(h *huffman) (int, error) {
+	if z.nbits < fastBits {
+		// Read ahead while possible, since near the end of the
+		// stream there might be less than fastBits left.
+		for z.nbits <= 56 {
+			c, err := z.r.ReadByte()
+			if err != nil {
+				break
+			}
+			z.in++
+			z.bits |= uint64(c) << z.nbits
+			z.nbits += 8
+		}
+	}
+	if z.nbits >= fastBits {
+		if e := h.fast[z.bits&(1<<fastBits-1)]; e != 0 {
+			n := uint(e & 15)
+			z.bits >>= n
+			z.nbits -= n
+			return int(e >> 4), nil
+		}
+	}
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxCodeBits; l++ {
+		b, err := z.getBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(b)
+		count := int(h.counts[l])
+		if code-first < count {
+			return int(h.symbols[index+code-first]), nil
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0, z.corrupt()
+}
+
+// fixedCodes returns the codes used by blocks with fixed codes.
+var fixedCodes = sync.OnceValues(func() (*huffman, *huffman) {
+	var lengths [288]uint8
+	for ii := range lengths {
+		switch {
+		case ii < 144:
+			lengths[ii] = 8
+		case ii < 256:
+			lengths[ii] = 9
+		case ii < 280:
+			lengths[ii] = 7
+		default:
+			lengths[ii] = 8
+		}
+	}
+	lit, dist := &huffman{}, &huffman{}
+	lit.init(lengths[:])
+	for ii := range 30 {
+		lengths[ii] = 5
+	}
+	dist.init(lengths[:30])
+	return lit, dist
+})
+
+// gzipIndex contains the points of a gzip stream where decompression
+// can start, at least every interval bytes of decompressed data.
+type gzipIndex struct {
+	r        io.ReaderAt
+	interval int64
+	points   []gzipPoint
+}
+
+// scan returns an inflater for the whole stream, which adds the points
+// to the index as the data is read.
+func (x *gzipIndex) scan() (*inflater, error) {
+	x.points = []gzipPoint{{header: true}}
+	z, err := newInflater(x.r, &x.points[0])
+	if err != nil {
+		return nil, err
+	}
+	if x.interval > 0 {
+		z.point = func(in int64, out int64, header bool) {
+			if out-x.points[len(x.points)-1].out < x.interval {
+				return
+			}
+			p := gzipPoint{in: in, out: out, header: header}
+			if !header {
+				p.window = z.window()
+			}
+			x.points = append(x.points, p)
+		}
+	}
+	return z, nil
+}
+
+// open returns a reader of the decompressed data from offset off.
+func (x *gzipIndex) open(off int64) (io.ReadCloser, error) {
+	ii := sort.Search(len(x.points), func(ii int) bool {
+		return x.points[ii].out > off
+	}) - 1
+	p := &x.points[ii]
+	z, err := newInflater(x.r, p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, z, off-p.out); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return io.NopCloser(z), nil
+}
@@ -0,0 +1,112 @@
+package vfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func inflateTestData() []byte {
+	rnd := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	words := []string{"alpha ", "beta ", "gamma ", "delta\n"}
+	for buf.Len() < 1<<20 {
+		// Mix compressible and random data
+		if rnd.Intn(4) == 0 {
+			chunk := make([]byte, rnd.Intn(4096))
+			rnd.Read(chunk)
+			buf.Write(chunk)
+		} else {
+			buf.WriteString(words[rnd.Intn(len(words))])
+		}
+	}
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, level int, members ...[]byte) []byte {
+	var buf bytes.Buffer
+	for ii, data := range members {
+		zw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ii == 0 {
+			zw.Name = "name"
+			zw.Comment = "comment"
+			zw.Extra = []byte("extra")
+		}
+		if _, err := zw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestInflater(t *testing.T) {
+	data := inflateTestData()
+	for _, level := range []int{gzip.NoCompression, gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression, gzip.HuffmanOnly} {
+		compressed := gzipData(t, level, data, data[:1000], nil)
+		want := append(bytes.Clone(data), data[:1000]...)
+		index := &gzipIndex{r: bytes.NewReader(compressed), interval: 64 << 10}
+		z, err := index.scan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(z)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("level %d: decompressed data differs", level)
+		}
+		if len(index.points) < len(want)/(64<<10)/2 {
+			t.Errorf("level %d: %d seek points for %d bytes, want one every 64 KiB", level, len(index.points), len(want))
+		}
+		for _, off := range []int64{0, 1, 100000, int64(len(data)) - 10, int64(len(data)) + 500} {
+			rc, err := index.open(off)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := make([]byte, 100)
+			n, err := io.ReadFull(rc, p)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(p[:n], want[off:min(off+100, int64(len(want)))]) {
+				t.Errorf("level %d: data at %d differs", level, off)
+			}
+		}
+	}
+}
+
+func TestInflaterCorrupt(t *testing.T) {
+	compressed := gzipData(t, gzip.DefaultCompression, []byte("some data for checking the trailer"))
+	compressed[len(compressed)-8] ^= 0xff
+	z, err := newInflater(bytes.NewReader(compressed), &gzipPoint{header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(z); !errors.Is(err, gzip.ErrChecksum) {
+		t.Errorf("reading with a wrong checksum returned %v, want ErrChecksum", err)
+	}
+	z, err = newInflater(bytes.NewReader(compressed[:len(compressed)/2]), &gzipPoint{header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(z); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("reading truncated data returned %v, want ErrUnexpectedEOF", err)
+	}
+	z, err = newInflater(bytes.NewReader([]byte("not gzip data")), &gzipPoint{header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(z); !errors.Is(err, gzip.ErrHeader) {
+		t.Errorf("reading invalid data returned %v, want ErrHeader", err)
+	}
+}
@@ -1,6 +1,7 @@
 package vfs
 
 import (
+	"errors"
 	"io"
 	"io/fs"
 	"path"
@@ -57,6 +58,8 @@ func (a *readOnlyFSAdapter) Open(name string) (fs.File, error) {
 }
 
 // adapterFileFile implements fs.File for a regular file (read from VFS).
+// It also implements io.Seeker and io.ReaderAt, so it can be used with
+// http.ServeContent.
 type adapterFileFile struct {
 	r    RFile
 	info fs.FileInfo
@@ -66,45 +69,48 @@ func (f *adapterFileFile) Stat() (fs.FileInfo, error) { return f.info, nil }
 func (f *adapterFileFile) Read(p []byte) (int, error) { return f.r.Read(p) }
 func (f *adapterFileFile) Close() error               { return f.r.Close() }
 
+func (f *adapterFileFile) Seek(offset int64, whence int) (int64, error) {
+	return f.r.Seek(offset, whence)
+}
+
+// ReadAt implements io.ReaderAt when the underlying RFile supports it.
+func (f *adapterFileFile) ReadAt(p []byte, off int64) (int, error) {
+	if ra, ok := f.r.(io.ReaderAt); ok {
+		return ra.ReadAt(p, off)
+	}
+	return 0, &fs.PathError{Op: "readat", Path: f.info.Name(), Err: errors.ErrUnsupported}
+}
+
 // adapterDirFile implements fs.File and fs.ReadDirFile for a directory.
-// When n > 0, ReadDir returns at most n entries per call and uses cached
-// results so that repeated calls return the next batch (io/fs contract).
+// The directory is opened with OpenDir on the first ReadDir, so entries
+// are streamed from VFS implementing DirOpener. When n > 0, ReadDir
+// returns at most n entries per call (io/fs contract).
 type adapterDirFile struct {
-	v       VFS
-	path    string
-	info    fs.FileInfo
-	cached  []fs.DirEntry // populated on first ReadDir
-	nextIdx int           // next index to return when n > 0
+	v    VFS
+	path string
+	info fs.FileInfo
+	dir  DirFile // opened on first ReadDir
 }
 
 func (f *adapterDirFile) Stat() (fs.FileInfo, error) { return f.info, nil }
 func (f *adapterDirFile) Read([]byte) (int, error)   { return 0, nil } // dirs are not readable
-func (f *adapterDirFile) Close() error               { return nil }
+
+func (f *adapterDirFile) Close() error {
+	if f.dir == nil {
+		return nil
+	}
+	return f.dir.Close()
+}
 
 func (f *adapterDirFile) ReadDir(n int) ([]fs.DirEntry, error) {
-	if f.cached == nil {
-		infos, err := f.v.ReadDir(f.path)
+	if f.dir == nil {
+		dir, err := OpenDir(f.v, f.path)
 		if err != nil {
 			return nil, err
 		}
-		f.cached = make([]fs.DirEntry, 0, len(infos))
-		for _, i := range infos {
-			f.cached = append(f.cached, fs.FileInfoToDirEntry(i))
-		}
-	}
-	if n <= 0 {
-		return f.cached[f.nextIdx:], nil
-	}
-	if f.nextIdx >= len(f.cached) {
-		return nil, io.EOF // at end of directory, per io/fs contract
-	}
-	end := f.nextIdx + n
-	if end > len(f.cached) {
-		end = len(f.cached)
+		f.dir = dir
 	}
-	out := f.cached[f.nextIdx:end]
-	f.nextIdx = end
-	return out, nil
+	return f.dir.ReadDir(n)
 }
 
 // VFSPathFromFSName converts an io/fs name (forward slashes, "." = root) to
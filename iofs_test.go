@@ -4,8 +4,11 @@ import (
 	"errors"
 	"io"
 	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"path"
 	"testing"
+	"time"
 )
 
 // TestAsReadOnlyFS verifies that a VFS can be used as io/fs.FS for read-only
@@ -251,3 +254,79 @@ func TestAsReadOnlyFSOpenWhenStatFails(t *testing.T) {
 		t.Errorf("Open when Stat fails = %v, want %v", err, statErr)
 	}
 }
+
+func TestAsReadOnlyFSServeContent(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f.txt", []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ro := AsReadOnlyFS(mem)
+	f, err := ro.Open("f.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		t.Fatal("file should implement io.ReadSeeker")
+	}
+	req := httptest.NewRequest("GET", "/f.txt", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	rec := httptest.NewRecorder()
+	http.ServeContent(rec, req, "f.txt", time.Time{}, rs)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" {
+		t.Errorf("ServeContent = %d %q, want 206 \"234\"", rec.Code, rec.Body.String())
+	}
+	buf := make([]byte, 3)
+	if n, err := f.(io.ReaderAt).ReadAt(buf, 7); err != nil || string(buf[:n]) != "789" {
+		t.Errorf("ReadAt = %q, %v, want \"789\"", buf[:n], err)
+	}
+}
+
+func TestAsReadOnlyFSReadAtUnsupported(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wrapped := &noReaderAtVFS{VFS: mem}
+	f, err := AsReadOnlyFS(wrapped).Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := f.(io.ReaderAt).ReadAt(make([]byte, 1), 0); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("ReadAt = %v, want ErrUnsupported", err)
+	}
+}
+
+// noReaderAtVFS wraps a VFS hiding the io.ReaderAt implementation of its files (for testing).
+type noReaderAtVFS struct {
+	VFS
+}
+
+func (v *noReaderAtVFS) Open(path string) (RFile, error) {
+	f, err := v.VFS.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ RFile }{f}, nil
+}
+
+func TestAsReadOnlyFSUsesOpenDir(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a/y", "a/x"} {
+		if err := WriteFile(mem, p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := fs.ReadDir(AsReadOnlyFS(&noReadDirVFS{mem}), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "x" || entries[1].Name() != "y" {
+		t.Errorf("fs.ReadDir = %v, want [x y]", entries)
+	}
+}
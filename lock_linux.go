@@ -0,0 +1,56 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// Lock implements Locker using flock(2).
+func (f *osFile) Lock(exclusive bool) error {
+	if exclusive {
+		return f.flock(syscall.LOCK_EX)
+	}
+	return f.flock(syscall.LOCK_SH)
+}
+
+func (f *osFile) TryLock(exclusive bool) (bool, error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := f.flock(how | syscall.LOCK_NB)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (f *osFile) Unlock() error {
+	return f.flock(syscall.LOCK_UN)
+}
+
+func (f *osFile) flock(how int) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lerr error
+	err = conn.Control(func(fd uintptr) {
+		for {
+			lerr = syscall.Flock(int(fd), how)
+			if lerr != syscall.EINTR {
+				break
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if lerr != nil {
+		return &os.PathError{Op: "flock", Path: f.Name(), Err: lerr}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package vfs
+
+import (
+	"errors"
+	"os"
+)
+
+// Advisory locking for on-disk files is only supported on Linux.
+
+func (f *osFile) Lock(exclusive bool) error {
+	return &os.PathError{Op: "flock", Path: f.Name(), Err: errors.ErrUnsupported}
+}
+
+func (f *osFile) TryLock(exclusive bool) (bool, error) {
+	return false, &os.PathError{Op: "flock", Path: f.Name(), Err: errors.ErrUnsupported}
+}
+
+func (f *osFile) Unlock() error {
+	return &os.PathError{Op: "flock", Path: f.Name(), Err: errors.ErrUnsupported}
+}
@@ -1,5 +1,15 @@
 package vfs
 
+import "fmt"
+
 // LogCloseError is called when closing a file fails (e.g. in finalizer).
 // Default is a no-op; callers may set it to log or report errors.
 var LogCloseError = func(error) {}
+
+// LogLeakedHandle is called when a handle tracked after calling
+// TrackHandles is garbage collected without being closed, before
+// closing it. Default reports it to LogCloseError; callers may set
+// it to fail tests, for example.
+var LogLeakedHandle = func(h *OpenHandle) {
+	LogCloseError(fmt.Errorf("leaked handle: %s", h))
+}
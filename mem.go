@@ -3,10 +3,14 @@ package vfs
 import (
 	"errors"
 	"fmt"
+	"io"
+	iofs "io/fs"
 	"os"
 	pathpkg "path"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -15,45 +19,130 @@ var (
 	errNoEmptyNameDir  = errors.New("can't create directory with empty name")
 )
 
+// memoryFileSystem is the VFS returned by Memory. Operations which change
+// the namespace (creating, removing, renaming or linking entries) hold
+// mu for writing from the path lookup until the change is done, while
+// the rest hold it for reading, so every operation sees and leaves the
+// tree in a consistent state. The Dir and File locks are still taken
+// when their fields are read or modified, since handles returned by
+// Open and OpenDir use them without holding mu. Locks are always
+// acquired in the order mu, Dir, File.
 type memoryFileSystem struct {
-	mu   sync.RWMutex
-	root *Dir
+	mu    sync.RWMutex
+	root  *Dir
+	umask os.FileMode
+	// store is set for Hybrid file systems
+	store *hybridStore
+	// versions tracks the generations of the tree, and snap
+	// is set for the file systems returned by Snapshot.
+	versions *versions
+	snap     *snapshot
+	// closer is the archive read in place by the file systems
+	// returned by Open, closed by Close.
+	closer io.Closer
 }
 
-// entry must always be called with the lock held
+// maxSymlinkHops is the maximum number of symlinks followed while
+// resolving a path, matching MAXSYMLINKS on Linux.
+const maxSymlinkHops = 40
+
+// entry must always be called with the lock held. Symlinks are followed,
+// including the last path component.
 func (fs *memoryFileSystem) entry(path string) (Entry, *Dir, int, error) {
+	e, dir, pos, _, err := fs.lookup(path, true)
+	return e, dir, pos, err
+}
+
+// lentry works like entry, but if the last path component is a symlink
+// it's returned rather than followed.
+func (fs *memoryFileSystem) lentry(path string) (Entry, *Dir, int, error) {
+	e, dir, pos, _, err := fs.lookup(path, false)
+	return e, dir, pos, err
+}
+
+// lookup returns the entry at the given path, its parent directory, its
+// position in the parent and the path of the entry with all the symlinks
+// resolved. If follow is false, a symlink in the last component is not
+// followed. It must always be called with the lock held.
+func (fs *memoryFileSystem) lookup(path string, follow bool) (Entry, *Dir, int, string, error) {
+	hops := 0
 	path = cleanPath(path)
-	if path == "" || path == "/" || path == "." {
-		return fs.root, nil, 0, nil
-	}
-	if path[0] == '/' {
-		path = path[1:]
+	root, err := fs.top()
+	if err != nil {
+		return nil, nil, 0, "", err
 	}
-	dir := fs.root
 	for {
-		p := strings.IndexByte(path, '/')
-		name := path
-		if p > 0 {
-			name = path[:p]
-			path = path[p+1:]
-		} else {
-			path = ""
-		}
-		dir.RLock()
-		entry, pos, err := dir.Find(name)
-		dir.RUnlock()
-		if err != nil {
-			return nil, nil, 0, err
+		if path == "" {
+			return root, nil, 0, "", nil
 		}
-		if len(path) == 0 {
-			return entry, dir, pos, nil
+		dir := root
+		dirPath := ""
+		restarted := false
+		for !restarted {
+			name, rest, _ := strings.Cut(path, "/")
+			dir.RLock()
+			entry, pos, err := dir.Find(name)
+			dir.RUnlock()
+			if err == nil {
+				entry, err = fs.view(entry)
+			}
+			if err != nil {
+				return nil, nil, 0, "", err
+			}
+			if entry.Type() == EntryTypeSymlink && (rest != "" || follow) {
+				hops++
+				if hops > maxSymlinkHops {
+					return nil, nil, 0, "", syscall.ELOOP
+				}
+				path = cleanPath(pathpkg.Join(linkTarget(dirPath, entry.(*File)), rest))
+				restarted = true
+				continue
+			}
+			if rest == "" {
+				return entry, dir, pos, pathpkg.Join(dirPath, name), nil
+			}
+			if entry.Type() != EntryTypeDir {
+				return nil, nil, 0, "", os.ErrNotExist
+			}
+			dir = entry.(*Dir)
+			dirPath = pathpkg.Join(dirPath, name)
+			path = rest
 		}
-		if entry.Type() != EntryTypeDir {
-			break
+	}
+}
+
+// resolve returns the path pointed by the given one after following
+// all the symlinks, including the last component. If the path (or
+// the final target) does not exist, the last path which could be
+// resolved is returned, so it can be created. It must always be called
+// with the lock held.
+func (fs *memoryFileSystem) resolve(path string) (string, error) {
+	for hops := 0; hops <= maxSymlinkHops; hops++ {
+		e, _, _, real, err := fs.lookup(path, false)
+		if err != nil {
+			if IsNotExist(err) {
+				return path, nil
+			}
+			return "", err
+		}
+		if e.Type() != EntryTypeSymlink {
+			return real, nil
 		}
-		dir = entry.(*Dir)
+		path = linkTarget(pathpkg.Dir(real), e.(*File))
+	}
+	return "", syscall.ELOOP
+}
+
+// linkTarget returns the path pointed by the given symlink, which
+// lives in the directory dir.
+func linkTarget(dir string, link *File) string {
+	link.RLock()
+	target := string(link.Data)
+	link.RUnlock()
+	if pathpkg.IsAbs(target) {
+		return target
 	}
-	return nil, nil, 0, os.ErrNotExist
+	return pathpkg.Join("/", dir, target)
 }
 
 func (fs *memoryFileSystem) dirEntry(path string) (*Dir, error) {
@@ -68,77 +157,137 @@ func (fs *memoryFileSystem) dirEntry(path string) (*Dir, error) {
 }
 
 func (fs *memoryFileSystem) Open(path string) (RFile, error) {
+	fs.mu.RLock()
 	entry, _, _, err := fs.entry(path)
+	fs.mu.RUnlock()
 	if err != nil {
 		return nil, err
 	}
 	if entry.Type() != EntryTypeFile {
 		return nil, fmt.Errorf("%s is not a file", path)
 	}
-	return NewRFile(entry.(*File))
+	return fs.newFile(entry.(*File), path, true, false, os.O_RDONLY)
 }
 
 func (fs *memoryFileSystem) OpenFile(path string, flag int, mode os.FileMode) (WFile, error) {
 	if mode&os.ModeType != 0 {
 		return nil, fmt.Errorf("%T does not support special files", fs)
 	}
-	path = cleanPath(path)
-	dir, base := pathpkg.Split(path)
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if !write && flag&os.O_TRUNC != 0 {
+		// POSIX leaves the result of O_RDONLY|O_TRUNC unspecified,
+		// reject it rather than truncating a read only file.
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EINVAL}
+	}
+	if flag&os.O_CREATE != 0 {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+	} else {
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+	}
+	realPath, err := fs.resolve(cleanPath(path))
+	if err != nil {
+		return nil, err
+	}
+	dir, base := pathpkg.Split(cleanPath(realPath))
 	if base == "" {
 		return nil, errNoEmptyNameFile
 	}
-	fs.mu.RLock()
 	d, err := fs.dirEntry(dir)
-	fs.mu.RUnlock()
 	if err != nil {
 		return nil, err
 	}
-
 	d.Lock()
 	defer d.Unlock()
 	f, _, _ := d.Find(base)
-	if f == nil && flag&os.O_CREATE == 0 {
-		return nil, os.ErrNotExist
-	}
-	// Read only file?
-	if flag&os.O_WRONLY == 0 && flag&os.O_RDWR == 0 {
-		if f == nil {
-			return nil, os.ErrNotExist
+	if f == nil {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
 		}
-		return NewWFile(f.(*File), true, false)
-	}
-	// Write file, either f != nil or flag&os.O_CREATE
-	if f != nil {
-		if f.Type() != EntryTypeFile {
-			return nil, fmt.Errorf("%s is not a file", path)
+		if err := d.quota.charge(0, 1); err != nil {
+			return nil, &os.PathError{Op: "open", Path: path, Err: err}
 		}
-		if flag&os.O_EXCL != 0 {
-			return nil, os.ErrExist
+		f = &File{
+			Mode:    mode & chmodBits &^ fs.umask,
+			ModTime: time.Now(),
+			store:   fs.store,
+			quota:   d.quota,
 		}
-		// Check if we should truncate
-		if flag&os.O_TRUNC != 0 {
-			file := f.(*File)
-			file.Lock()
-			file.ModTime = time.Now()
-			file.Data = nil
-			file.Unlock()
+		if err := d.Add(base, f); err != nil {
+			_ = d.quota.charge(0, -1)
+			return nil, &os.PathError{Op: "open", Path: path, Err: err}
 		}
-	} else {
-		f = &File{ModTime: time.Now()}
-		err = d.Add(base, f)
+		return fs.newFile(f.(*File), path, !write || flag&os.O_RDWR != 0, write, flag)
+	}
+	if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrExist}
+	}
+	switch f.Type() {
+	case EntryTypeFile:
+	case EntryTypeDir:
+		if write {
+			return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EISDIR}
+		}
+		fallthrough
+	default:
+		return nil, fmt.Errorf("%s is not a file", path)
+	}
+	file := f.(*File)
+	h, err := fs.newFile(file, path, !write || flag&os.O_RDWR != 0, write, flag)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_TRUNC != 0 {
+		// Compressed files only have their data in pages
+		// while they have open handles.
+		file.Lock()
+		err = file.truncate(0)
+		file.Unlock()
 		if err != nil {
-			return nil, os.ErrExist
+			_ = h.Close()
+			return nil, &os.PathError{Op: "open", Path: path, Err: err}
 		}
 	}
-	return NewWFile(f.(*File), flag&os.O_RDWR != 0, true)
+	return h, nil
+}
+
+// newFile returns a new handle to f, opened at path, tracking it if
+// enabled with TrackHandles.
+func (fs *memoryFileSystem) newFile(f *File, path string, read bool, write bool, flag int) (WFile, error) {
+	h, err := newFile(f, path, read, write, flag)
+	if err != nil {
+		return nil, err
+	}
+	h.(*file).handle = trackHandle(fs, path, flag)
+	return h, nil
+}
+
+// Umask sets the mask applied to the permissions of the files and
+// directories created afterwards, returning the previous one. The
+// default umask for in-memory file systems is 0.
+func (fs *memoryFileSystem) Umask(mask os.FileMode) os.FileMode {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	old := fs.umask
+	fs.umask = mask & os.ModePerm
+	return old
 }
 
 func (fs *memoryFileSystem) Lstat(path string) (os.FileInfo, error) {
-	return fs.Stat(path)
+	fs.mu.RLock()
+	entry, _, _, err := fs.lentry(path)
+	fs.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return &EntryInfo{Path: path, Entry: entry}, nil
 }
 
 func (fs *memoryFileSystem) Stat(path string) (os.FileInfo, error) {
+	fs.mu.RLock()
 	entry, _, _, err := fs.entry(path)
+	fs.mu.RUnlock()
 	if err != nil {
 		return nil, err
 	}
@@ -161,17 +310,94 @@ func (fs *memoryFileSystem) readDir(path string) ([]os.FileInfo, error) {
 	}
 	dir := entry.(*Dir)
 	dir.RLock()
+	defer dir.RUnlock()
+	if err := dir.load(); err != nil {
+		return nil, err
+	}
 	infos := make([]os.FileInfo, len(dir.Entries))
 	for ii, v := range dir.EntryNames {
+		e, err := fs.view(dir.Entries[ii])
+		if err != nil {
+			return nil, err
+		}
 		infos[ii] = &EntryInfo{
 			Path:  pathpkg.Join(path, v),
-			Entry: dir.Entries[ii],
+			Entry: e,
 		}
 	}
-	dir.RUnlock()
 	return infos, nil
 }
 
+// OpenDir implements DirOpener. Entries are returned in alphabetical
+// order, and the handle keeps track of the last returned name, so
+// it's not confused by entries added or removed between calls.
+func (fs *memoryFileSystem) OpenDir(path string) (DirFile, error) {
+	fs.mu.RLock()
+	entry, _, _, err := fs.entry(path)
+	fs.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	dir, ok := entry.(*Dir)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a directory", path)
+	}
+	return &memoryDir{fs: fs, dir: dir, path: path}, nil
+}
+
+// memoryDir is the DirFile returned by memoryFileSystem.OpenDir.
+type memoryDir struct {
+	fs   *memoryFileSystem
+	dir  *Dir
+	path string
+	// last is the name of the last entry returned, if started
+	last    string
+	started bool
+}
+
+func (d *memoryDir) ReadDir(n int) ([]os.DirEntry, error) {
+	d.dir.RLock()
+	defer d.dir.RUnlock()
+	if err := d.dir.load(); err != nil {
+		return nil, err
+	}
+	names := d.dir.EntryNames
+	start := 0
+	if d.started {
+		start = sort.SearchStrings(names, d.last)
+		if start < len(names) && names[start] == d.last {
+			start++
+		}
+	}
+	end := len(names)
+	if n > 0 && start+n < end {
+		end = start + n
+	}
+	entries := make([]os.DirEntry, 0, end-start)
+	for ii := start; ii < end; ii++ {
+		e, err := d.fs.view(d.dir.Entries[ii])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, iofs.FileInfoToDirEntry(&EntryInfo{
+			Path:  pathpkg.Join(d.path, names[ii]),
+			Entry: e,
+		}))
+	}
+	if end > start {
+		d.last = names[end-1]
+		d.started = true
+	}
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
+
+func (d *memoryDir) Close() error {
+	return nil
+}
+
 func (fs *memoryFileSystem) Mkdir(path string, perm os.FileMode) error {
 	path = cleanPath(path)
 	dir, base := pathpkg.Split(path)
@@ -181,9 +407,9 @@ func (fs *memoryFileSystem) Mkdir(path string, perm os.FileMode) error {
 		}
 		return errNoEmptyNameDir
 	}
-	fs.mu.RLock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 	d, err := fs.dirEntry(dir)
-	fs.mu.RUnlock()
 	if err != nil {
 		return err
 	}
@@ -192,45 +418,401 @@ func (fs *memoryFileSystem) Mkdir(path string, perm os.FileMode) error {
 	if _, p, _ := d.Find(base); p >= 0 {
 		return os.ErrExist
 	}
+	if err := d.quota.charge(0, 1); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
 	err = d.Add(base, &Dir{
-		Mode:    os.ModeDir | perm,
+		Mode:    os.ModeDir | perm&chmodBits&^fs.umask,
 		ModTime: time.Now(),
+		quota:   d.quota,
 	})
 	if err != nil {
+		_ = d.quota.charge(0, -1)
 		return os.ErrExist
 	}
 	return nil
 }
 
 func (fs *memoryFileSystem) Remove(path string) error {
-	entry, dir, _, err := fs.entry(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	entry, dir, _, err := fs.lentry(path)
 	if err != nil {
 		return err
 	}
-	if entry.Type() == EntryTypeDir && len(entry.(*Dir).Entries) > 0 {
-		return fmt.Errorf("directory %s not empty", path)
+	if dir == nil {
+		return fmt.Errorf("can't remove root directory")
+	}
+	if d, ok := entry.(*Dir); ok {
+		d.RLock()
+		err := d.load()
+		empty := len(d.Entries) == 0
+		d.RUnlock()
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("directory %s not empty", path)
+		}
 	}
-	// Lock again, the position might have changed
 	dir.Lock()
-	_, pos, err := dir.Find(pathpkg.Base(path))
-	if err == nil {
-		dir.EntryNames = append(dir.EntryNames[:pos], dir.EntryNames[pos+1:]...)
-		dir.Entries = append(dir.Entries[:pos], dir.Entries[pos+1:]...)
+	defer dir.Unlock()
+	_, pos, err := dir.Find(pathpkg.Base(cleanPath(path)))
+	if err != nil {
+		return err
+	}
+	dir.remove(pos)
+	if d, ok := entry.(*Dir); ok {
+		// Files are released once unreachable
+		_ = d.quota.charge(0, -1)
+	}
+	return nil
+}
+
+func (fs *memoryFileSystem) Rename(oldpath, newpath string) error {
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	oldpath = cleanPath(oldpath)
+	newpath = cleanPath(newpath)
+	if oldpath == "" || newpath == "" {
+		return linkErr(syscall.EBUSY)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	src, srcDir, _, srcPath, err := fs.lookup(oldpath, false)
+	if err != nil {
+		return linkErr(err)
+	}
+	if oldpath == newpath {
+		return nil
+	}
+	dstDirPath, newBase := pathpkg.Split(newpath)
+	dst, _, _, dstPath, err := fs.lookup(dstDirPath, true)
+	if err != nil {
+		return linkErr(err)
+	}
+	dstDir, ok := dst.(*Dir)
+	if !ok {
+		return linkErr(syscall.ENOTDIR)
+	}
+	// The paths might name the same entry through symlinks
+	if dstDir == srcDir && newBase == pathpkg.Base(oldpath) {
+		return nil
+	}
+	// Both paths might go through symlinks, so the resolved
+	// ones are compared
+	if src.Type() == EntryTypeDir && (dstPath == srcPath || strings.HasPrefix(dstPath, srcPath+"/")) {
+		return linkErr(syscall.EINVAL)
+	}
+	if entryQuota(src) != dstDir.quota {
+		return linkErr(syscall.EXDEV)
+	}
+	srcDir.Lock()
+	defer srcDir.Unlock()
+	if dstDir != srcDir {
+		dstDir.Lock()
+		defer dstDir.Unlock()
+	}
+	if dst, pos, err := dstDir.Find(newBase); err == nil {
+		// As in rename(2), renaming a hard link to another
+		// one of the same file does nothing
+		if dst == src {
+			return nil
+		}
+		if d, ok := dst.(*Dir); ok {
+			if err := d.load(); err != nil {
+				return linkErr(err)
+			}
+		}
+		switch {
+		case src.Type() == EntryTypeDir && dst.Type() != EntryTypeDir:
+			return linkErr(syscall.ENOTDIR)
+		case src.Type() != EntryTypeDir && dst.Type() == EntryTypeDir:
+			return linkErr(syscall.EISDIR)
+		case dst.Type() == EntryTypeDir && len(dst.(*Dir).Entries) > 0:
+			return linkErr(syscall.ENOTEMPTY)
+		}
+		dstDir.remove(pos)
+		if d, ok := dst.(*Dir); ok {
+			_ = d.quota.charge(0, -1)
+		}
+	}
+	// Add the new entry before removing the old one, so the
+	// link count of files never drops to zero. dstDir might be
+	// the same as srcDir, so the position must be looked up
+	// again after the changes above.
+	if err := dstDir.Add(newBase, src); err != nil {
+		return linkErr(err)
+	}
+	_, pos, err := srcDir.Find(pathpkg.Base(oldpath))
+	if err != nil {
+		return linkErr(err)
+	}
+	srcDir.remove(pos)
+	return nil
+}
+
+func (fs *memoryFileSystem) Truncate(name string, size int64) error {
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: name, Err: syscall.EINVAL}
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	entry, _, _, err := fs.entry(name)
+	if err != nil {
+		return &os.PathError{Op: "truncate", Path: name, Err: err}
+	}
+	if entry.Type() != EntryTypeFile {
+		return &os.PathError{Op: "truncate", Path: name, Err: syscall.EISDIR}
+	}
+	f := entry.(*File)
+	f.Lock()
+	defer f.Unlock()
+	// Register as a handle, so compressed files are
+	// decompressed and compressed again if needed.
+	if err := f.open(); err != nil {
+		return err
+	}
+	err = f.truncate(size)
+	if rerr := f.release(); err == nil {
+		err = rerr
 	}
-	dir.Unlock()
 	return err
 }
 
+// Link creates newname as a hard link to oldname. As in Linux, if
+// oldname is a symlink the link is created to the symlink itself.
+func (fs *memoryFileSystem) Link(oldname, newname string) error {
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	dir, base := pathpkg.Split(cleanPath(newname))
+	if base == "" {
+		return linkErr(os.ErrExist)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	entry, _, _, err := fs.lentry(oldname)
+	if err != nil {
+		return linkErr(err)
+	}
+	d, err := fs.dirEntry(dir)
+	if err != nil {
+		return linkErr(err)
+	}
+	if _, ok := entry.(*File); !ok {
+		// Hard links to directories are not allowed
+		return linkErr(syscall.EPERM)
+	}
+	if entryQuota(entry) != d.quota {
+		return linkErr(syscall.EXDEV)
+	}
+	d.Lock()
+	defer d.Unlock()
+	if err := d.Add(base, entry); err != nil {
+		return linkErr(err)
+	}
+	return nil
+}
+
+func (fs *memoryFileSystem) Symlink(oldname, newname string) error {
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	if oldname == "" {
+		return linkErr(os.ErrNotExist)
+	}
+	newname = cleanPath(newname)
+	dir, base := pathpkg.Split(newname)
+	if base == "" {
+		return linkErr(os.ErrExist)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, err := fs.dirEntry(dir)
+	if err != nil {
+		return linkErr(err)
+	}
+	d.Lock()
+	defer d.Unlock()
+	if _, pos, _ := d.Find(base); pos >= 0 {
+		return linkErr(os.ErrExist)
+	}
+	if err := d.quota.charge(int64(len(oldname)), 1); err != nil {
+		return linkErr(err)
+	}
+	err = d.Add(base, &File{
+		Data:    []byte(oldname),
+		Mode:    os.ModeSymlink | 0777,
+		ModTime: time.Now(),
+		quota:   d.quota,
+		charged: int64(len(oldname)),
+	})
+	if err != nil {
+		_ = d.quota.charge(-int64(len(oldname)), -1)
+		return linkErr(err)
+	}
+	return nil
+}
+
+func (fs *memoryFileSystem) Readlink(name string) (string, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	entry, _, _, err := fs.lentry(name)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if entry.Type() != EntryTypeSymlink {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	f := entry.(*File)
+	f.RLock()
+	defer f.RUnlock()
+	return string(f.Data), nil
+}
+
+// chmodBits are the mode bits which can be changed by Chmod.
+const chmodBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// attrEntry returns the entry at name for changing its attributes,
+// following symlinks. It must always be called with the lock held.
+func (fs *memoryFileSystem) attrEntry(op string, name string) (Entry, error) {
+	entry, _, _, err := fs.entry(name)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	switch entry.(type) {
+	case *File, *Dir:
+		return entry, nil
+	}
+	return nil, &os.PathError{Op: op, Path: name, Err: errors.ErrUnsupported}
+}
+
+func (fs *memoryFileSystem) Chmod(name string, mode os.FileMode) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	entry, err := fs.attrEntry("chmod", name)
+	if err != nil {
+		return err
+	}
+	mode &= chmodBits
+	switch e := entry.(type) {
+	case *File:
+		e.Lock()
+		defer e.Unlock()
+		if err := e.hist.preserve(e.freeze); err != nil {
+			return &os.PathError{Op: "chmod", Path: name, Err: err}
+		}
+		e.Mode = e.Mode&^chmodBits | mode
+	case *Dir:
+		e.Lock()
+		defer e.Unlock()
+		if err := e.hist.preserve(e.freeze); err != nil {
+			return &os.PathError{Op: "chmod", Path: name, Err: err}
+		}
+		e.Mode = e.Mode&^chmodBits | mode
+	}
+	return nil
+}
+
+// Chtimes changes the modification time of the entry at name. Since
+// the in-memory file system does not keep track of access times,
+// atime is ignored.
+func (fs *memoryFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	entry, err := fs.attrEntry("chtimes", name)
+	if err != nil {
+		return err
+	}
+	switch e := entry.(type) {
+	case *File:
+		e.Lock()
+		defer e.Unlock()
+		if err := e.hist.preserve(e.freeze); err != nil {
+			return &os.PathError{Op: "chtimes", Path: name, Err: err}
+		}
+		e.ModTime = mtime
+	case *Dir:
+		e.Lock()
+		defer e.Unlock()
+		if err := e.hist.preserve(e.freeze); err != nil {
+			return &os.PathError{Op: "chtimes", Path: name, Err: err}
+		}
+		e.ModTime = mtime
+	}
+	return nil
+}
+
+// Chown changes the owner ids of the entry at name. As in os.Chown,
+// an id of -1 leaves the current value unchanged.
+func (fs *memoryFileSystem) Chown(name string, uid, gid int) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	entry, err := fs.attrEntry("chown", name)
+	if err != nil {
+		return err
+	}
+	switch e := entry.(type) {
+	case *File:
+		e.Lock()
+		defer e.Unlock()
+		if err := e.hist.preserve(e.freeze); err != nil {
+			return &os.PathError{Op: "chown", Path: name, Err: err}
+		}
+		e.Uid, e.Gid, e.Uname, e.Gname = chown(e.Uid, e.Gid, e.Uname, e.Gname, uid, gid)
+	case *Dir:
+		e.Lock()
+		defer e.Unlock()
+		if err := e.hist.preserve(e.freeze); err != nil {
+			return &os.PathError{Op: "chown", Path: name, Err: err}
+		}
+		e.Uid, e.Gid, e.Uname, e.Gname = chown(e.Uid, e.Gid, e.Uname, e.Gname, uid, gid)
+	}
+	return nil
+}
+
+// chown returns the owner ids and names after changing the ids to
+// uid and gid. The names of the changed ids are cleared, since they
+// would take precedence over the ids when extracting archives.
+func chown(curUid, curGid int, uname, gname string, uid, gid int) (int, int, string, string) {
+	if uid != -1 && uid != curUid {
+		curUid, uname = uid, ""
+	}
+	if gid != -1 && gid != curGid {
+		curGid, gname = gid, ""
+	}
+	return curUid, curGid, uname, gname
+}
+
+// Close closes the archive the file system was loaded from by Open, if
+// it's read in place, after which its files can't be read anymore. It
+// does nothing for the other in-memory file systems.
+func (fs *memoryFileSystem) Close() error {
+	fs.mu.Lock()
+	c := fs.closer
+	fs.closer = nil
+	fs.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	return c.Close()
+}
+
 func (fs *memoryFileSystem) String() string {
 	return "MemoryFileSystem"
 }
 
 func newMemory() *memoryFileSystem {
+	v := &versions{}
 	fs := &memoryFileSystem{
 		root: &Dir{
 			Mode:    os.ModeDir | 0755,
 			ModTime: time.Now(),
+			hist:    history{versions: v},
 		},
+		versions: v,
 	}
 	return fs
 }
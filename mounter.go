@@ -1,10 +1,13 @@
 package vfs
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const (
@@ -17,6 +20,10 @@ func hasSubdir(root, dir string) (string, bool) {
 		root += separator
 	}
 	dir = path.Clean(dir)
+	if dir+separator == root {
+		// The mount point itself is the root of the mounted VFS
+		return "", true
+	}
 	if !strings.HasPrefix(dir, root) {
 		return "", false
 	}
@@ -40,9 +47,17 @@ type Mounter struct {
 }
 
 func (m *Mounter) fs(p string) (VFS, string, error) {
+	mp, rel, err := m.mountPoint(p)
+	if err != nil {
+		return nil, "", err
+	}
+	return mp.fs, rel, nil
+}
+
+func (m *Mounter) mountPoint(p string) (*mountPoint, string, error) {
 	for ii := len(m.points) - 1; ii >= 0; ii-- {
 		if rel, ok := hasSubdir(m.points[ii].point, p); ok {
-			return m.points[ii].fs, rel, nil
+			return m.points[ii], rel, nil
 		}
 	}
 	return nil, "", os.ErrNotExist
@@ -133,6 +148,14 @@ func (m *Mounter) ReadDir(path string) ([]os.FileInfo, error) {
 	return fs.ReadDir(p)
 }
 
+func (m *Mounter) OpenDir(path string) (DirFile, error) {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return nil, err
+	}
+	return OpenDir(fs, p)
+}
+
 func (m *Mounter) Mkdir(path string, perm os.FileMode) error {
 	fs, p, err := m.fs(path)
 	if err != nil {
@@ -151,6 +174,212 @@ func (m *Mounter) Remove(path string) error {
 	return fs.Remove(p)
 }
 
+func (m *Mounter) OpenContext(ctx context.Context, path string) (RFile, error) {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return nil, err
+	}
+	return AsContextVFS(fs).OpenContext(ctx, p)
+}
+
+func (m *Mounter) OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (WFile, error) {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return nil, err
+	}
+	return AsContextVFS(fs).OpenFileContext(ctx, p, flag, perm)
+}
+
+func (m *Mounter) LstatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return nil, err
+	}
+	return AsContextVFS(fs).LstatContext(ctx, p)
+}
+
+func (m *Mounter) StatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return nil, err
+	}
+	return AsContextVFS(fs).StatContext(ctx, p)
+}
+
+func (m *Mounter) ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error) {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return nil, err
+	}
+	return AsContextVFS(fs).ReadDirContext(ctx, p)
+}
+
+func (m *Mounter) MkdirContext(ctx context.Context, path string, perm os.FileMode) error {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return err
+	}
+	return AsContextVFS(fs).MkdirContext(ctx, p, perm)
+}
+
+func (m *Mounter) RemoveContext(ctx context.Context, path string) error {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return err
+	}
+	return AsContextVFS(fs).RemoveContext(ctx, p)
+}
+
+func (m *Mounter) CreateAtomic(path string, perm os.FileMode) (AtomicFile, error) {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return nil, err
+	}
+	return CreateAtomic(fs, p, perm)
+}
+
+// sameFs returns the file system containing both oldpath and newpath and
+// their paths relative to it. If they're in different mounted file systems,
+// an *os.LinkError wrapping syscall.EXDEV is returned.
+func (m *Mounter) sameFs(op string, oldpath, newpath string) (VFS, string, string, error) {
+	src, oldRel, err := m.mountPoint(oldpath)
+	if err != nil {
+		return nil, "", "", err
+	}
+	dst, newRel, err := m.mountPoint(newpath)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if src != dst {
+		return nil, "", "", &os.LinkError{Op: op, Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	return src.fs, oldRel, newRel, nil
+}
+
+// Rename moves the entry at oldpath to newpath. Entries can't be moved
+// between different mounted file systems, in that case an *os.LinkError
+// wrapping syscall.EXDEV is returned.
+func (m *Mounter) Rename(oldpath, newpath string) error {
+	fs, oldRel, newRel, err := m.sameFs("rename", oldpath, newpath)
+	if err != nil {
+		return err
+	}
+	return Rename(fs, oldRel, newRel)
+}
+
+// Link creates newname as a hard link to oldname. As with Rename, both
+// must be in the same mounted file system.
+func (m *Mounter) Link(oldname, newname string) error {
+	fs, oldRel, newRel, err := m.sameFs("link", oldname, newname)
+	if err != nil {
+		return err
+	}
+	return Link(fs, oldRel, newRel)
+}
+
+// Symlink creates newname as a symbolic link to oldname in the file
+// system mounted at newname. Note that symlinks are resolved by the
+// underlying file system, so they can't point to other mounts. Absolute
+// targets are translated to the root of the file system, and they must
+// be in the same one as newname, otherwise an *os.LinkError wrapping
+// syscall.EXDEV is returned. Relative targets are kept unchanged.
+func (m *Mounter) Symlink(oldname, newname string) error {
+	if path.IsAbs(oldname) {
+		fs, oldRel, newRel, err := m.sameFs("symlink", oldname, newname)
+		if err != nil {
+			return err
+		}
+		return Symlink(fs, "/"+oldRel, newRel)
+	}
+	fs, p, err := m.fs(newname)
+	if err != nil {
+		return err
+	}
+	return Symlink(fs, oldname, p)
+}
+
+// Readlink returns the target of the symlink at name. Like with
+// Symlink, absolute targets are translated from the root of the
+// file system mounted at name.
+func (m *Mounter) Readlink(name string) (string, error) {
+	mp, p, err := m.mountPoint(name)
+	if err != nil {
+		return "", err
+	}
+	target, err := Readlink(mp.fs, p)
+	if err != nil {
+		return "", err
+	}
+	if path.IsAbs(target) {
+		target = path.Join(mp.point, target)
+	}
+	return target, nil
+}
+
+func (m *Mounter) Truncate(name string, size int64) error {
+	fs, p, err := m.fs(name)
+	if err != nil {
+		return err
+	}
+	return Truncate(fs, p, size)
+}
+
+func (m *Mounter) Chmod(name string, mode os.FileMode) error {
+	fs, p, err := m.fs(name)
+	if err != nil {
+		return err
+	}
+	return Chmod(fs, p, mode)
+}
+
+func (m *Mounter) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	fs, p, err := m.fs(name)
+	if err != nil {
+		return err
+	}
+	return Chtimes(fs, p, atime, mtime)
+}
+
+func (m *Mounter) Chown(name string, uid, gid int) error {
+	fs, p, err := m.fs(name)
+	if err != nil {
+		return err
+	}
+	return Chown(fs, p, uid, gid)
+}
+
+func (m *Mounter) Getxattr(path string, name string) ([]byte, error) {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return nil, err
+	}
+	return Getxattr(fs, p, name)
+}
+
+func (m *Mounter) Setxattr(path string, name string, value []byte) error {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return err
+	}
+	return Setxattr(fs, p, name, value)
+}
+
+func (m *Mounter) Listxattr(path string) ([]string, error) {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return nil, err
+	}
+	return Listxattr(fs, p)
+}
+
+func (m *Mounter) Removexattr(path string, name string) error {
+	fs, p, err := m.fs(path)
+	if err != nil {
+		return err
+	}
+	return Removexattr(fs, p, name)
+}
+
 func (m *Mounter) String() string {
 	s := make([]string, len(m.points))
 	for ii, v := range m.points {
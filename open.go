@@ -34,37 +34,194 @@ func Zip(r io.Reader, size int64) (VFS, error) {
 	if err != nil {
 		return nil, err
 	}
-	files := make(map[string]*File)
+	return zipTree(zr, func(file *zip.File, f *File) error {
+		var err error
+		f.Data, err = readZipFile(file)
+		return err
+	})
+}
+
+// ZipReaderAt returns an in-memory VFS with the contents of the .zip
+// file of the given size read from r. Unlike Zip, only the index of the
+// entries is loaded into memory, from the central directory, and the
+// data of each file is read from r and decompressed as it's read, so r
+// must be usable while the VFS is. Files are copied into memory when
+// they're modified.
+func ZipReaderAt(r io.ReaderAt, size int64) (VFS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return zipTree(zr, func(file *zip.File, f *File) error {
+		var err error
+		if f.Mode&os.ModeSymlink != 0 {
+			// Targets are needed for resolving paths
+			f.Data, err = readZipFile(file)
+		} else {
+			f.source, err = zipData(r, file)
+		}
+		return err
+	})
+}
+
+// zipTree returns an in-memory VFS with the entries of zr, calling data
+// for setting the data of each file.
+func zipTree(zr *zip.Reader, data func(file *zip.File, f *File) error) (VFS, error) {
+	t := newArchiveTree()
 	for _, file := range zr.File {
+		var err error
 		if file.Mode().IsDir() {
-			continue
+			err = t.mkdir(file.Name, &Dir{
+				Mode:    file.Mode(),
+				ModTime: file.ModTime(),
+			})
+		} else {
+			f := &File{
+				Mode:    file.Mode(),
+				ModTime: file.ModTime(),
+			}
+			if err = data(file, f); err == nil {
+				err = t.add(file.Name, f)
+			}
 		}
-		f, err := file.Open()
 		if err != nil {
 			return nil, err
 		}
-		data, err := io.ReadAll(f)
-		errClose := f.Close()
-		if errClose != nil {
-			return nil, errClose
-		}
+	}
+	return t.fs, nil
+}
+
+// zipData returns the source of the data of file, read from the
+// archive in r.
+func zipData(r io.ReaderAt, file *zip.File) (*archiveData, error) {
+	a := &archiveData{
+		size:   int64(file.UncompressedSize64),
+		stored: int64(file.CompressedSize64),
+	}
+	if file.Method == zip.Store && file.Flags&0x1 == 0 {
+		off, err := file.DataOffset()
 		if err != nil {
 			return nil, err
 		}
-		files[file.Name] = &File{
-			Data:    data,
-			Mode:    file.Mode(),
-			ModTime: file.ModTime(),
+		a.r = io.NewSectionReader(r, off, a.size)
+	} else {
+		a.open = func(off int64) (io.ReadCloser, error) {
+			rc, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := io.CopyN(io.Discard, rc, off); err != nil {
+				_ = rc.Close()
+				return nil, unexpectedEOF(err)
+			}
+			return rc, nil
 		}
 	}
-	return Map(files)
+	return a, nil
+}
+
+func readZipFile(file *zip.File) ([]byte, error) {
+	f, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return data, err
 }
 
 // Tar returns an in-memory VFS initialized with the
 // contents of the .tar file read from the given io.Reader.
+// Directories, links, owners and extended attributes are
+// kept, so WriteTar writes back an equivalent archive.
 func Tar(r io.Reader) (VFS, error) {
-	files := make(map[string]*File)
 	tr := tar.NewReader(r)
+	return tarTree(tr, func(hdr *tar.Header, f *File) error {
+		var err error
+		f.Data, err = io.ReadAll(tr)
+		return err
+	})
+}
+
+// TarReaderAt returns an in-memory VFS with the contents of the .tar file
+// read from r. Like ZipReaderAt, the headers are read once for building
+// the index of the entries, and the data of the files is read from r as
+// they're read, without copying it into memory, so r must be usable
+// while the VFS is. Files are copied into memory when they're modified.
+func TarReaderAt(r io.ReaderAt) (VFS, error) {
+	// tar.Reader skips the data with Seek
+	sr := io.NewSectionReader(r, 0, 1<<63-1)
+	return tarIndex(tar.NewReader(sr), func() int64 {
+		off, _ := sr.Seek(0, io.SeekCurrent)
+		return off
+	}, func(off, size int64) *archiveData {
+		return &archiveData{size: size, stored: size, r: io.NewSectionReader(r, off, size)}
+	})
+}
+
+// TarGzipReaderAt is like TarReaderAt, but for .tar.gz files. Since gzip
+// data can only be decompressed from its start, every file read requires
+// decompressing all the data before it, unless interval is positive. In
+// that case, the state of the decompression is saved every interval bytes
+// of decompressed data while building the index, which costs up to 32 KiB
+// each, and reads start from the nearest one.
+func TarGzipReaderAt(r io.ReaderAt, interval int64) (VFS, error) {
+	index := &gzipIndex{r: r, interval: interval}
+	z, err := index.scan()
+	if err != nil {
+		return nil, err
+	}
+	cr := &countingReader{r: z}
+	return tarIndex(tar.NewReader(cr), func() int64 {
+		return cr.n
+	}, func(off, size int64) *archiveData {
+		return &archiveData{
+			size:   size,
+			stored: size,
+			open: func(o int64) (io.ReadCloser, error) {
+				return index.open(off + o)
+			},
+			reopen: interval,
+		}
+	})
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// tarIndex returns an in-memory VFS with the entries read from tr, whose
+// data is returned by data, given its offset in the archive, returned by
+// offset after reading the header. Sparse files are read into memory.
+func tarIndex(tr *tar.Reader, offset func() int64, data func(off, size int64) *archiveData) (VFS, error) {
+	return tarTree(tr, func(hdr *tar.Header, f *File) error {
+		if tarSparse(hdr) {
+			var err error
+			f.Data, err = io.ReadAll(tr)
+			return err
+		}
+		f.source = data(offset(), hdr.Size)
+		return nil
+	})
+}
+
+// tarTree returns an in-memory VFS with the entries read from tr, calling
+// data for setting the data of the regular files which aren't empty. Hard
+// links share the File of their target, while symlinks store theirs as
+// their data. The owner, the extended attributes stored in PAX records and
+// the other PAX records of each header are kept in the entries.
+func tarTree(tr *tar.Reader, data func(hdr *tar.Header, f *File) error) (VFS, error) {
+	t := newArchiveTree()
 	for {
 		hdr, err := tr.Next()
 		if err != nil {
@@ -73,20 +230,112 @@ func Tar(r io.Reader) (VFS, error) {
 			}
 			return nil, err
 		}
-		if hdr.FileInfo().IsDir() {
-			continue
+		switch {
+		case hdr.Typeflag == tar.TypeXGlobalHeader:
+			// Global PAX records don't describe an entry
+		case hdr.Typeflag == tar.TypeLink:
+			err = t.link(hdr.Name, hdr.Linkname)
+		case hdr.FileInfo().IsDir():
+			err = t.mkdir(hdr.Name, &Dir{
+				Mode:       hdr.FileInfo().Mode(),
+				ModTime:    hdr.ModTime,
+				Uid:        hdr.Uid,
+				Gid:        hdr.Gid,
+				Xattrs:     tarXattrs(hdr),
+				Uname:      hdr.Uname,
+				Gname:      hdr.Gname,
+				PAXRecords: tarRecords(hdr),
+			})
+		default:
+			f := &File{
+				Mode:       hdr.FileInfo().Mode(),
+				ModTime:    hdr.ModTime,
+				Uid:        hdr.Uid,
+				Gid:        hdr.Gid,
+				Xattrs:     tarXattrs(hdr),
+				Uname:      hdr.Uname,
+				Gname:      hdr.Gname,
+				PAXRecords: tarRecords(hdr),
+			}
+			switch {
+			case hdr.Typeflag == tar.TypeSymlink:
+				f.Data = []byte(hdr.Linkname)
+			case hdr.Size > 0:
+				err = data(hdr, f)
+			}
+			if err == nil {
+				err = t.add(hdr.Name, f)
+			}
 		}
-		data, err := io.ReadAll(tr)
 		if err != nil {
 			return nil, err
 		}
-		files[hdr.Name] = &File{
-			Data:    data,
-			Mode:    hdr.FileInfo().Mode(),
-			ModTime: hdr.ModTime,
+	}
+	return t.fs, nil
+}
+
+// tarSparse returns whether hdr is for a sparse file, whose data is not
+// stored contiguously.
+func tarSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
 		}
 	}
-	return Map(files)
+	return false
+}
+
+// tarXattrs returns the extended attributes stored in the PAX
+// records of hdr, if any.
+func tarXattrs(hdr *tar.Header) map[string][]byte {
+	var xattrs map[string][]byte
+	for k, v := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(k, paxXattrPrefix); ok {
+			if xattrs == nil {
+				xattrs = make(map[string][]byte)
+			}
+			xattrs[name] = []byte(v)
+		}
+	}
+	return xattrs
+}
+
+// tarFieldKeys contains the PAX records stored in the fields of the
+// entries, which are the ones parsed into the fields of tar.Header
+// other than the access and change times.
+var tarFieldKeys = map[string]bool{
+	"path": true, "linkpath": true, "size": true, "mtime": true,
+	"uid": true, "gid": true, "uname": true, "gname": true,
+}
+
+// tarRecords returns the PAX records of hdr which are not stored in
+// the fields of the entries or as extended attributes, if any. The
+// records describing sparse files are dropped, since their data is
+// stored contiguously.
+func tarRecords(hdr *tar.Header) map[string]string {
+	var records map[string]string
+	for k, v := range hdr.PAXRecords {
+		if tarFieldKeys[k] || strings.HasPrefix(k, paxXattrPrefix) || strings.HasPrefix(k, "GNU.sparse.") {
+			continue
+		}
+		if records == nil {
+			records = make(map[string]string)
+		}
+		records[k] = v
+	}
+	return records
+}
+
+// closeWith sets the closer of the in-memory fs returned by an archive
+// loader, if it didn't fail.
+func closeWith(fs VFS, c io.Closer) VFS {
+	if mem, ok := fs.(*memoryFileSystem); ok {
+		mem.closer = c
+	}
+	return fs
 }
 
 // TarGzip returns an in-memory VFS initialized with the
@@ -115,13 +364,22 @@ func TarBzip2(r io.Reader) (VFS, error) {
 //   - .tar
 //   - .tar.gz
 //   - .tar.bz2
+//
+// .zip and .tar files are loaded with ZipReaderAt and TarReaderAt,
+// so they're kept open until the VFS is closed. The returned VFS
+// implements io.Closer, and closing it does nothing for the other
+// archives, which are loaded in memory.
 func Open(filename string) (VFS, error) {
 	file, err := os.Open(filepath.Clean(filename))
 	if err != nil {
 		return nil, err
 	}
 
+	keep := false
 	defer func() {
+		if keep {
+			return
+		}
 		if err := file.Close(); err != nil {
 			log.Fatal(err)
 		}
@@ -139,9 +397,13 @@ func Open(filename string) (VFS, error) {
 		if err != nil {
 			return nil, err
 		}
-		return Zip(file, st.Size())
+		fs, err := ZipReaderAt(file, st.Size())
+		keep = err == nil
+		return closeWith(fs, file), err
 	case ".tar":
-		return Tar(file)
+		fs, err := TarReaderAt(file)
+		keep = err == nil
+		return closeWith(fs, file), err
 	case ".tar.gz":
 		return TarGzip(file)
 	case ".tar.bz2":
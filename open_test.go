@@ -1,13 +1,18 @@
 package vfs
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -46,6 +51,30 @@ func TestOpenTar(t *testing.T) {
 	testOpenFilename(t, "fs.tar")
 }
 
+func TestOpenClose(t *testing.T) {
+	for _, name := range []string{"fs.zip", "fs.tar", "fs.tar.gz"} {
+		fs, err := Open(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, ok := fs.(io.Closer)
+		if !ok {
+			t.Fatalf("%s: Open returned a VFS without Close", name)
+		}
+		if err := c.Close(); err != nil {
+			t.Errorf("%s: Close = %v", name, err)
+		}
+		// Only the archives read in place are closed
+		data, err := ReadFile(fs, "a/b/c/d")
+		if inPlace := name != "fs.tar.gz"; inPlace != (err != nil) {
+			t.Errorf("%s: ReadFile after Close = %q, %v", name, data, err)
+		}
+		if err := c.Close(); err != nil {
+			t.Errorf("%s: second Close = %v", name, err)
+		}
+	}
+}
+
 func TestOpenTarGzip(t *testing.T) {
 	testOpenFilename(t, "fs.tar.gz")
 }
@@ -188,3 +217,360 @@ func TestZipEntryOpenFails(t *testing.T) {
 		t.Fatal("Zip when entry Open() fails (unsupported method) should return error")
 	}
 }
+
+// countingReaderAt records the bytes read through it.
+type countingReaderAt struct {
+	r    io.ReaderAt
+	mu   sync.Mutex
+	read int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.mu.Lock()
+	c.read += int64(n)
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *countingReaderAt) bytesRead() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.read
+}
+
+func TestZipReaderAtLazy(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, v := range []struct {
+		name   string
+		method uint16
+		data   []byte
+	}{
+		{"a/deflated", zip.Deflate, big},
+		{"a/stored", zip.Store, big},
+		{"b/c/small", zip.Deflate, []byte("small")},
+	} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: v.name, Method: v.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(v.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := &countingReaderAt{r: bytes.NewReader(buf.Bytes())}
+	fs, err := ZipReaderAt(r, int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var walked []string
+	err = Walk(fs, "/", func(fs VFS, p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Size() != int64(len(big)) && p != "/b/c/small" {
+			t.Errorf("%s has size %d", p, info.Size())
+		}
+		walked = append(walked, p)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 7 {
+		t.Errorf("walked %v, want 7 entries", walked)
+	}
+	// Only the central directory was read
+	if n := r.bytesRead(); n >= int64(len(big)) {
+		t.Errorf("read %d bytes for building the index, want less than %d", n, len(big))
+	}
+	for _, name := range []string{"a/deflated", "a/stored"} {
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := make([]byte, 16)
+		for _, off := range []int64{int64(len(big)) - 16, 32, 0} {
+			if _, err := f.Seek(off, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(f, p); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(p, big[off:off+16]) {
+				t.Errorf("%s contains %q at %d, want %q", name, p, off, big[off:off+16])
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ReadFile(fs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, big) {
+			t.Errorf("%s does not contain the data written", name)
+		}
+	}
+	if err := WriteFile(fs, "b/c/small", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("a/stored", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, fs, "b/c/small", "changed")
+	checkContents(t, fs, "a/stored", "x"+string(big[1:]))
+	u, err := Usage(fs, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Bytes != int64(2*len(big)+len("changed")) {
+		t.Errorf("usage = %+v, want the size of the files", u)
+	}
+}
+
+func tarTestData(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		data := files[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTarReaderAt(t *testing.T) {
+	big := inflateTestData()
+	files := map[string][]byte{"a/big": big, "a/small": []byte("small"), "b/empty": nil}
+	data := tarTestData(t, files)
+	r := &countingReaderAt{r: bytes.NewReader(data)}
+	fs, err := TarReaderAt(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := r.bytesRead(); n >= int64(len(big)) {
+		t.Errorf("read %d bytes for building the index, want less than %d", n, len(big))
+	}
+	infos, err := fs.ReadDir("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Size() != int64(len(big)) {
+		t.Errorf("a contains %v, want big and small", infos)
+	}
+	f, err := fs.Open("a/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	p := make([]byte, 100)
+	if _, err := f.(io.ReaderAt).ReadAt(p, 500000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, big[500000:500100]) {
+		t.Error("ReadAt returned the wrong data")
+	}
+	for name, want := range files {
+		checkContents(t, fs, name, string(want))
+	}
+}
+
+func TestTarGzipReaderAt(t *testing.T) {
+	big := inflateTestData()
+	files := map[string][]byte{"a": big, "b": big[:1000], "c": []byte("late")}
+	data := gzipData(t, gzip.DefaultCompression, tarTestData(t, files))
+	for _, interval := range []int64{0, 64 << 10} {
+		r := &countingReaderAt{r: bytes.NewReader(data)}
+		fs, err := TarGzipReaderAt(r, interval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexed := r.bytesRead()
+		checkContents(t, fs, "c", "late")
+		read := r.bytesRead() - indexed
+		// Without seek points, all the data before c is read
+		if interval > 0 && read > int64(len(data))/4 || interval == 0 && read < int64(len(data))/2 {
+			t.Errorf("read %d bytes of %d for a late file with interval %d", read, len(data), interval)
+		}
+		for name, want := range files {
+			checkContents(t, fs, name, string(want))
+		}
+		f, err := fs.Open("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, off := range []int64{900000, 10, 500000} {
+			if _, err := f.Seek(off, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			p := make([]byte, 10)
+			if _, err := io.ReadFull(f, p); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(p, big[off:off+10]) {
+				t.Errorf("a contains %q at %d, want %q", p, off, big[off:off+10])
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// tarTreeTestData returns a tar file with directories, links, owners
+// and extended attributes, and its headers.
+func tarTreeTestData(t *testing.T) ([]byte, []*tar.Header) {
+	mtime := time.Date(2021, 2, 3, 4, 5, 6, 7000, time.UTC)
+	// WriteTar only keeps fractional seconds for the entries
+	// with PAX records
+	secs := mtime.Truncate(time.Second)
+	hdrs := []*tar.Header{
+		{Name: "d/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: mtime, Uid: 1, Gid: 2, Uname: "bob", Gname: "staff",
+			PAXRecords: map[string]string{paxXattrPrefix + "user.a": "b", "comment": "dir"}},
+		{Name: "d/f", Typeflag: tar.TypeReg, Mode: 0640, ModTime: mtime, Uid: 3, Gid: 4, Uname: "alice", Gname: "users", Size: 4,
+			AccessTime: mtime.Add(time.Hour), ChangeTime: mtime.Add(-time.Hour),
+			PAXRecords: map[string]string{paxXattrPrefix + "user.c": "d", "LIBARCHIVE.creationtime": "1612325106"}},
+		{Name: "d/h", Typeflag: tar.TypeLink, Linkname: "d/f", Mode: 0640, ModTime: secs, Uid: 3, Gid: 4, Uname: "alice", Gname: "users"},
+		{Name: "e/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: secs},
+		{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "d/f", Mode: 0777, ModTime: mtime, Uid: 5, Gid: 6, Gname: "wheel",
+			PAXRecords: map[string]string{"comment": "link"}},
+		// Listed after its entries
+		{Name: "x/y", Typeflag: tar.TypeReg, Mode: 0600, ModTime: secs},
+		{Name: "x/", Typeflag: tar.TypeDir, Mode: 0711, ModTime: secs},
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "global"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, hdr := range hdrs {
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), hdrs
+}
+
+func TestTarTree(t *testing.T) {
+	data, hdrs := tarTreeTestData(t)
+	loaders := map[string]func() (VFS, error){
+		"Tar":         func() (VFS, error) { return Tar(bytes.NewReader(data)) },
+		"TarReaderAt": func() (VFS, error) { return TarReaderAt(bytes.NewReader(data)) },
+	}
+	for name, load := range loaders {
+		t.Run(name, func(t *testing.T) {
+			fs, err := load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			infos, err := fs.ReadDir("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(infos) != 4 {
+				t.Errorf("root contains %v, want d, e, s and x", infos)
+			}
+			for _, hdr := range hdrs {
+				st, err := fs.Lstat(hdr.Name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := hdr.FileInfo().Mode(); st.Mode() != want {
+					t.Errorf("%s has mode %s, want %s", hdr.Name, st.Mode(), want)
+				}
+				// Hard links have the time of their target
+				if hdr.Typeflag != tar.TypeLink && !st.ModTime().Equal(hdr.ModTime) {
+					t.Errorf("%s has modification time %s, want %s", hdr.Name, st.ModTime(), hdr.ModTime)
+				}
+				var uid, gid int
+				var uname, gname string
+				switch e := st.Sys().(type) {
+				case *File:
+					uid, gid, uname, gname = e.Uid, e.Gid, e.Uname, e.Gname
+				case *Dir:
+					uid, gid, uname, gname = e.Uid, e.Gid, e.Uname, e.Gname
+				}
+				if uid != hdr.Uid || gid != hdr.Gid {
+					t.Errorf("%s is owned by %d:%d, want %d:%d", hdr.Name, uid, gid, hdr.Uid, hdr.Gid)
+				}
+				if uname != hdr.Uname || gname != hdr.Gname {
+					t.Errorf("%s is owned by %q:%q, want %q:%q", hdr.Name, uname, gname, hdr.Uname, hdr.Gname)
+				}
+			}
+			if value, err := Getxattr(fs, "d", "user.a"); err != nil || string(value) != "b" {
+				t.Errorf("Getxattr(d) = %q, %v, want b", value, err)
+			}
+			if target, err := Readlink(fs, "s"); err != nil || target != "d/f" {
+				t.Errorf("Readlink(s) = %q, %v, want d/f", target, err)
+			}
+			if st, err := fs.Lstat("s"); err != nil || st.Sys().(*File).PAXRecords["comment"] != "link" {
+				t.Errorf("Lstat(s) = %v, %v, want the comment PAX record", st, err)
+			}
+			checkContents(t, fs, "s", "data")
+			checkContents(t, fs, "d/h", "data")
+			if err := WriteFile(fs, "d/f", []byte("linked"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			checkContents(t, fs, "d/h", "linked")
+		})
+	}
+}
+
+func TestZipDirectories(t *testing.T) {
+	mtime := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	hdr := &zip.FileHeader{Name: "e/", Modified: mtime}
+	hdr.SetMode(os.ModeDir | 0700)
+	if _, err := zw.CreateHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	loaders := map[string]func() (VFS, error){
+		"Zip":         func() (VFS, error) { return Zip(bytes.NewReader(buf.Bytes()), int64(buf.Len())) },
+		"ZipReaderAt": func() (VFS, error) { return ZipReaderAt(bytes.NewReader(buf.Bytes()), int64(buf.Len())) },
+	}
+	for name, load := range loaders {
+		t.Run(name, func(t *testing.T) {
+			fs, err := load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			st, err := fs.Stat("e")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Mode() != os.ModeDir|0700 || !st.ModTime().Equal(mtime) {
+				t.Errorf("e has mode %s and modification time %s, want %s and %s", st.Mode(), st.ModTime(), os.ModeDir|0700, mtime)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package vfs
+
+// pageSize is the size of the pages used to store the contents
+// of the files written through a handle.
+const pageSize = 64 << 10
+
+// page is a block of file data, covering pageSize bytes of the file.
+// Its buf might be shorter, in that case the rest of the page reads
+// as zeroes. Once a page is shared, it's never written again, and
+// writers must copy it first.
+type page struct {
+	buf    []byte
+	shared bool
+}
+
+// pages stores the contents of a file in fixed size pages, so writing
+// in the middle of large files or growing them does not copy all the
+// data. Missing pages are holes, which read as zeroes, and pages can
+// be shared by several files, which copy them when written. The
+// methods of pages must be called with the lock of their *File held.
+type pages struct {
+	pages []*page
+	size  int64
+}
+
+// newPages returns pages with the given data, without copying it.
+// The data is shared, so it's never modified.
+func newPages(data []byte) *pages {
+	p := &pages{
+		pages: make([]*page, 0, (len(data)+pageSize-1)/pageSize),
+		size:  int64(len(data)),
+	}
+	for len(data) > 0 {
+		n := min(len(data), pageSize)
+		p.pages = append(p.pages, &page{buf: data[:n:n], shared: true})
+		data = data[n:]
+	}
+	return p
+}
+
+// clone returns a copy of p sharing all its pages.
+func (p *pages) clone() *pages {
+	for _, v := range p.pages {
+		// Pages are never unshared, so if it's not shared
+		// it's only owned by p, which is locked.
+		if v != nil && !v.shared {
+			v.shared = true
+		}
+	}
+	return &pages{pages: append([]*page(nil), p.pages...), size: p.size}
+}
+
+// readAt reads into b from off, returning the number of bytes read,
+// which is only less than len(b) at the end of the data.
+func (p *pages) readAt(b []byte, off int64) int {
+	if off >= p.size {
+		return 0
+	}
+	b = b[:min(int64(len(b)), p.size-off)]
+	n := 0
+	for n < len(b) {
+		idx, start := int((off+int64(n))/pageSize), int((off+int64(n))%pageSize)
+		chunk := b[n:min(len(b), n+pageSize-start)]
+		var buf []byte
+		if idx < len(p.pages) && p.pages[idx] != nil {
+			buf = p.pages[idx].buf
+		}
+		c := 0
+		if start < len(buf) {
+			c = copy(chunk, buf[start:])
+		}
+		clear(chunk[c:])
+		n += len(chunk)
+	}
+	return n
+}
+
+// writeAt writes b at off, growing the data as needed.
+func (p *pages) writeAt(b []byte, off int64) {
+	if end := off + int64(len(b)); end > p.size {
+		p.size = end
+	}
+	if need := int((p.size + pageSize - 1) / pageSize); need > len(p.pages) {
+		p.pages = append(p.pages, make([]*page, need-len(p.pages))...)
+	}
+	for len(b) > 0 {
+		idx, start := int(off/pageSize), int(off%pageSize)
+		n := min(len(b), pageSize-start)
+		pg := p.writable(idx, start+n)
+		copy(pg.buf[start:], b[:n])
+		b = b[n:]
+		off += int64(n)
+	}
+}
+
+// writable returns the page at idx, ready to be written up to end.
+func (p *pages) writable(idx int, end int) *page {
+	pg := p.pages[idx]
+	switch {
+	case pg == nil:
+		pg = &page{buf: make([]byte, end, p.pageCap(idx, end, 0))}
+		p.pages[idx] = pg
+	case pg.shared:
+		buf := make([]byte, max(end, len(pg.buf)), p.pageCap(idx, end, len(pg.buf)))
+		copy(buf, pg.buf)
+		pg = &page{buf: buf}
+		p.pages[idx] = pg
+	case end > cap(pg.buf):
+		buf := make([]byte, end, p.pageCap(idx, end, cap(pg.buf)))
+		copy(buf, pg.buf)
+		pg.buf = buf
+	case end > len(pg.buf):
+		// Zero the bytes left behind by truncate
+		l := len(pg.buf)
+		pg.buf = pg.buf[:end]
+		clear(pg.buf[l:])
+	}
+	return pg
+}
+
+// pageCap returns the capacity for the buffer of the page at idx
+// which needs end bytes. Small files grow exponentially from old up
+// to pageSize, while the pages of larger ones are fully allocated.
+func (p *pages) pageCap(idx int, end int, old int) int {
+	if idx > 0 || p.size > pageSize {
+		return pageSize
+	}
+	return min(max(end, 2*old), pageSize)
+}
+
+// truncate changes the size of the data. Growing it adds a hole.
+func (p *pages) truncate(size int64) {
+	if size < p.size {
+		n := int((size + pageSize - 1) / pageSize)
+		clear(p.pages[min(n, len(p.pages)):])
+		p.pages = p.pages[:min(n, len(p.pages))]
+		// The last page must not have data past the end, since
+		// it would be visible if the data grows again.
+		if last := int(size % pageSize); last > 0 && n == len(p.pages) {
+			if pg := p.pages[n-1]; pg != nil && len(pg.buf) > last {
+				if pg.shared {
+					p.pages[n-1] = &page{buf: pg.buf[:last:last], shared: true}
+				} else {
+					pg.buf = pg.buf[:last]
+				}
+			}
+		}
+	}
+	p.size = size
+}
+
+// bytes returns all the data in a single slice.
+func (p *pages) bytes() []byte {
+	data := make([]byte, p.size)
+	p.readAt(data, 0)
+	return data
+}
+
+// allocated returns the number of bytes allocated for the pages,
+// which is smaller than size for sparse files.
+func (p *pages) allocated() int64 {
+	var n int64
+	for _, pg := range p.pages {
+		if pg != nil {
+			n += int64(len(pg.buf))
+		}
+	}
+	return n
+}
@@ -0,0 +1,129 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestPagesMatchFlatData(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	p := newPages(nil)
+	var want []byte
+	for ii := 0; ii < 2000; ii++ {
+		switch rnd.Intn(4) {
+		case 0, 1:
+			off := rnd.Int63n(3 * pageSize)
+			b := make([]byte, rnd.Intn(2*pageSize))
+			rnd.Read(b)
+			p.writeAt(b, off)
+			if end := int(off) + len(b); end > len(want) {
+				want = append(want, make([]byte, end-len(want))...)
+			}
+			copy(want[off:], b)
+		case 2:
+			size := rnd.Int63n(4 * pageSize)
+			p.truncate(size)
+			if int(size) < len(want) {
+				want = want[:size]
+			} else {
+				want = append(want, make([]byte, int(size)-len(want))...)
+			}
+		case 3:
+			p = p.clone()
+		}
+		if p.size != int64(len(want)) {
+			t.Fatalf("step %d: size = %d, want %d", ii, p.size, len(want))
+		}
+		off := rnd.Int63n(int64(len(want)) + 1)
+		got := make([]byte, rnd.Intn(2*pageSize))
+		n := p.readAt(got, off)
+		if !bytes.Equal(got[:n], want[off:min(int(off)+len(got), len(want))]) {
+			t.Fatalf("step %d: readAt(%d) returned different data", ii, off)
+		}
+	}
+	if !bytes.Equal(p.bytes(), want) {
+		t.Error("bytes returned different data")
+	}
+}
+
+func TestPagesCopyOnWrite(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), pageSize+10)
+	p := newPages(data)
+	p.writeAt([]byte("b"), 1)
+	if data[1] != 'a' {
+		t.Error("writing to pages modified the data they were created from")
+	}
+	c := p.clone()
+	p.writeAt([]byte("c"), 2)
+	c.truncate(5)
+	c.writeAt([]byte("d"), 7)
+	if got := string(p.bytes()[:4]); got != "abca" {
+		t.Errorf("original = %q, want \"abca\"", got)
+	}
+	if got := string(c.bytes()); got != "abaaa\x00\x00d" {
+		t.Errorf("clone = %q, want \"abaaa\\x00\\x00d\"", got)
+	}
+	if p.size != int64(len(data)) {
+		t.Errorf("original size = %d, want %d", p.size, len(data))
+	}
+}
+
+func TestPagesSparse(t *testing.T) {
+	p := newPages(nil)
+	p.writeAt([]byte("x"), 100*pageSize)
+	for ii, v := range p.pages[:100] {
+		if v != nil {
+			t.Fatalf("page %d was allocated for a hole", ii)
+		}
+	}
+	b := make([]byte, 4)
+	if n := p.readAt(b, 100*pageSize-2); n != 3 || !bytes.Equal(b[:n], []byte("\x00\x00x")) {
+		t.Errorf("readAt = %d, %q, want 3, \"\\x00\\x00x\"", n, b[:n])
+	}
+}
+
+func TestFileDataCompatibility(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := mem.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := info.Sys().(*File)
+	if data, err := f.Bytes(); err != nil || string(data) != "hello" {
+		t.Errorf("Bytes = %q, %v, want \"hello\"", data, err)
+	}
+	w, err := mem.OpenFile("f", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, " world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(FileSyncer).Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Data) != "hello world" {
+		t.Errorf("Data after Sync = %q, want \"hello world\"", f.Data)
+	}
+	if _, err := io.WriteString(w, "!"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(mem, "f"); err != nil || string(data) != "hello world!" {
+		t.Errorf("ReadFile = %q, %v, want \"hello world!\"", data, err)
+	}
+	if f.Data != nil {
+		t.Errorf("Data after Close = %q, want it built on demand", f.Data)
+	}
+	if data, err := f.Flatten(); err != nil || string(data) != "hello world!" || string(f.Data) != "hello world!" {
+		t.Errorf("Flatten = %q, %v, Data = %q, want \"hello world!\"", data, err, f.Data)
+	}
+}
@@ -0,0 +1,1535 @@
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A persistent in-memory file system keeps its contents in a directory
+// with the following files, where N is a generation number in hex:
+//
+//	snapshot-N: the contents of the file system when generation N
+//	started, missing for generation 0
+//	wal-N: the log of the changes made during generation N
+//
+// Compacting starts a new generation, writing its snapshot, and then
+// the files of the previous generations are removed. Since a crash
+// might happen before the snapshot is complete, the latest snapshot
+// is loaded on startup, and then all the logs from its generation on
+// are replayed.
+//
+// Snapshots start with snapshotMagic, followed by the attributes of
+// the root directory and its entries, and end with the CRC-32 of the
+// rest of the file. Each entry starts with its kind and its name, and
+// directories are followed by their entries and a snapEnd.
+//
+// The log is a sequence of records, each one with its length, its op
+// and its arguments, followed by the CRC-32 of the op and arguments.
+// A truncated or corrupted record marks the end of the log, since it
+// was being written when the process crashed.
+
+const snapshotMagic = "vfs-snapshot-1\n"
+
+// Entry kinds in snapshots.
+const (
+	snapEnd byte = iota
+	snapDir
+	snapFile
+	// snapLink is a hard link to a file already in the snapshot,
+	// identified by its position.
+	snapLink
+)
+
+// Encodings of the file data in snapshots.
+const (
+	snapRaw byte = iota
+	snapCompressed
+)
+
+// Log record ops. The handles opened for writing are identified by
+// a number, and the modification time is logged after the changes
+// which update it.
+const (
+	// id, path, flag, perm, mtime
+	walOpen byte = iota + 1
+	// id, offset, data, mtime
+	walWrite
+	// id, size, mtime
+	walTruncateFile
+	// id
+	walClose
+	// id, path, perm, mtime
+	walAtomic
+	// id
+	walCommit
+	// path, perm, mtime
+	walMkdir
+	// path
+	walRemove
+	// oldpath, newpath
+	walRename
+	// path, size, mtime
+	walTruncate
+	// oldname, newname
+	walLink
+	// oldname, newname, mtime
+	walSymlink
+	// path, mode
+	walChmod
+	// path, mtime
+	walChtimes
+	// path, uid, gid
+	walChown
+	// path, name, value
+	walSetxattr
+	// path, name
+	walRemovexattr
+)
+
+// compactLogSize is the minimum size of the log which starts a
+// compaction, which also requires it to be bigger than the latest
+// snapshot.
+const compactLogSize = 16 << 20
+
+var errCorruptPersistent = errors.New("corrupted persistent file system")
+
+// encoder writes the values stored in snapshots and log records. If w
+// is nil, they're only appended to buf.
+type encoder struct {
+	w   io.Writer
+	buf []byte
+	err error
+}
+
+func (e *encoder) flush() {
+	if e.w != nil && e.err == nil && len(e.buf) > 0 {
+		_, e.err = e.w.Write(e.buf)
+		e.buf = e.buf[:0]
+	}
+}
+
+func (e *encoder) byte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	if e.w != nil && len(b) >= 64<<10 {
+		// Avoid copying large file data
+		e.flush()
+		if e.err == nil {
+			_, e.err = e.w.Write(b)
+		}
+		return
+	}
+	e.buf = append(e.buf, b...)
+	if len(e.buf) >= 64<<10 {
+		e.flush()
+	}
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) time(t time.Time) {
+	e.varint(t.Unix())
+	e.uvarint(uint64(t.Nanosecond()))
+}
+
+func (e *encoder) attrs(mode os.FileMode, mtime time.Time, uid, gid int, xattrs map[string][]byte) {
+	e.uvarint(uint64(mode))
+	e.time(mtime)
+	e.varint(int64(uid))
+	e.varint(int64(gid))
+	e.uvarint(uint64(len(xattrs)))
+	for _, name := range slices.Sorted(maps.Keys(xattrs)) {
+		e.string(name)
+		e.bytes(xattrs[name])
+	}
+}
+
+// decoder reads the values written by encoder, adding the bytes read
+// to crc if it's set. Byte slices longer than limit are rejected, to
+// avoid huge allocations when reading corrupted data.
+type decoder struct {
+	r interface {
+		io.Reader
+		io.ByteReader
+	}
+	crc   hash.Hash32
+	limit int64
+	err   error
+}
+
+func (d *decoder) fail(err error) {
+	if err != nil && d.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		d.err = err
+	}
+}
+
+func (d *decoder) ReadByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == nil && d.crc != nil {
+		_, _ = d.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	b, err := d.ReadByte()
+	d.fail(err)
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d)
+	d.fail(err)
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(d)
+	d.fail(err)
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(d.limit) {
+		d.fail(errCorruptPersistent)
+		return nil
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(d.r, b)
+	if err == nil && d.crc != nil {
+		_, _ = d.crc.Write(b)
+	}
+	d.fail(err)
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) time() time.Time {
+	sec := d.varint()
+	nsec := d.uvarint()
+	if nsec >= uint64(time.Second) {
+		d.fail(errCorruptPersistent)
+	}
+	return time.Unix(sec, int64(nsec))
+}
+
+func (d *decoder) attrs() (mode os.FileMode, mtime time.Time, uid int, gid int, xattrs map[string][]byte) {
+	mode = os.FileMode(d.uvarint())
+	mtime = d.time()
+	uid = int(d.varint())
+	gid = int(d.varint())
+	n := d.uvarint()
+	for ii := uint64(0); ii < n && d.err == nil; ii++ {
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		name := d.string()
+		xattrs[name] = d.bytes()
+	}
+	return mode, mtime, uid, gid, xattrs
+}
+
+// persistName returns the name of the file of the given kind, either
+// "snapshot" or "wal", for generation gen.
+func persistName(kind string, gen uint64) string {
+	return fmt.Sprintf("%s-%016x", kind, gen)
+}
+
+// parsePersistName returns the kind and the generation of a file
+// named by persistName.
+func parsePersistName(name string) (string, uint64, bool) {
+	kind, hex, ok := strings.Cut(name, "-")
+	if !ok || (kind != "snapshot" && kind != "wal") || len(hex) != 16 {
+		return "", 0, false
+	}
+	gen, err := strconv.ParseUint(hex, 16, 64)
+	return kind, gen, err == nil
+}
+
+// syncDirEntries syncs the directory entries of dir, so the files created
+// or renamed in it survive a crash. It's not supported by every
+// platform, so errors are ignored.
+func syncDirEntries(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		_ = f.Sync()
+		_ = f.Close()
+	}
+}
+
+// snapshotWriter writes the entries of a snapshot of a memory file
+// system. Files are identified by their position, for hard links.
+type snapshotWriter struct {
+	e     *encoder
+	fs    *memoryFileSystem
+	files map[*File]uint64
+}
+
+func (w *snapshotWriter) dir(d *Dir) error {
+	// Entries of snapshots are frozen, so they're never modified
+	d.RLock()
+	names, entries := d.EntryNames, d.Entries
+	d.RUnlock()
+	for ii, name := range names {
+		e, err := w.fs.view(entries[ii])
+		if err != nil {
+			return err
+		}
+		switch e := e.(type) {
+		case *Dir:
+			w.e.byte(snapDir)
+			w.e.string(name)
+			e.RLock()
+			w.e.attrs(e.Mode, e.ModTime, e.Uid, e.Gid, e.Xattrs)
+			e.RUnlock()
+			if err := w.dir(e); err != nil {
+				return err
+			}
+		case *File:
+			w.file(name, e)
+		}
+		if w.e.err != nil {
+			return w.e.err
+		}
+	}
+	w.e.byte(snapEnd)
+	return w.e.err
+}
+
+func (w *snapshotWriter) file(name string, f *File) {
+	if id, ok := w.files[f]; ok {
+		w.e.byte(snapLink)
+		w.e.string(name)
+		w.e.uvarint(id)
+		return
+	}
+	w.files[f] = uint64(len(w.files))
+	f.RLock()
+	defer f.RUnlock()
+	w.e.byte(snapFile)
+	w.e.string(name)
+	w.e.attrs(f.Mode, f.ModTime, f.Uid, f.Gid, f.Xattrs)
+	switch {
+	case f.pages != nil || f.spill != nil || f.source != nil:
+		// Compressed files with open handles are compressed
+		// again when loaded, and spilled files and the ones
+		// read from archives are loaded in memory.
+		data, err := f.contents()
+		if err != nil {
+			w.e.err = err
+			return
+		}
+		w.e.byte(snapRaw)
+		w.e.bytes(data)
+	case f.Mode&ModeCompress != 0:
+		w.e.byte(snapCompressed)
+		w.e.bytes(f.Data)
+	default:
+		w.e.byte(snapRaw)
+		w.e.bytes(f.Data)
+	}
+}
+
+// writeSnapshot writes the contents of snap, which must be returned by
+// memoryFileSystem.snapshot, as the snapshot of generation gen in dir,
+// returning its size.
+func writeSnapshot(dir string, gen uint64, snap *memoryFileSystem) (int64, error) {
+	name := filepath.Join(dir, persistName("snapshot", gen))
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	size, err := writeSnapshotFile(f, snap)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+	syncDirEntries(dir)
+	return size, nil
+}
+
+func writeSnapshotFile(f *os.File, snap *memoryFileSystem) (int64, error) {
+	root, err := snap.top()
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriter(f)
+	crc := crc32.NewIEEE()
+	e := &encoder{w: io.MultiWriter(bw, crc)}
+	e.buf = append(e.buf, snapshotMagic...)
+	root.RLock()
+	e.attrs(root.Mode, root.ModTime, root.Uid, root.Gid, root.Xattrs)
+	root.RUnlock()
+	w := &snapshotWriter{e: e, fs: snap, files: make(map[*File]uint64)}
+	if err := w.dir(root); err != nil {
+		return 0, err
+	}
+	if e.flush(); e.err != nil {
+		return 0, e.err
+	}
+	if _, err := bw.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32())); err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+// readSnapshot returns a memory file system with the contents of the
+// snapshot at name, and the size of the snapshot.
+func readSnapshot(name string) (*memoryFileSystem, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = f.Close() }()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := st.Size()
+	if size < int64(len(snapshotMagic))+4 {
+		return nil, 0, fmt.Errorf("%s: %w", name, errCorruptPersistent)
+	}
+	d := &decoder{
+		r:     bufio.NewReader(io.LimitReader(f, size-4)),
+		crc:   crc32.NewIEEE(),
+		limit: size,
+	}
+	magic := make([]byte, len(snapshotMagic))
+	for ii := range magic {
+		magic[ii] = d.byte()
+	}
+	if d.err == nil && string(magic) != snapshotMagic {
+		d.fail(errCorruptPersistent)
+	}
+	fs := newMemory()
+	root := fs.root
+	root.Mode, root.ModTime, root.Uid, root.Gid, root.Xattrs = d.attrs()
+	var files []*File
+	if err := readSnapshotDir(d, root, &files); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if _, err := d.ReadByte(); err != io.EOF {
+		return nil, 0, fmt.Errorf("%s: %w", name, errCorruptPersistent)
+	}
+	var sum [4]byte
+	if _, err := f.ReadAt(sum[:], size-4); err != nil {
+		return nil, 0, err
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != d.crc.Sum32() {
+		return nil, 0, fmt.Errorf("%s: %w", name, errCorruptPersistent)
+	}
+	return fs, size, nil
+}
+
+func readSnapshotDir(d *decoder, dir *Dir, files *[]*File) error {
+	for {
+		kind := d.byte()
+		if d.err != nil {
+			return d.err
+		}
+		if kind == snapEnd {
+			return nil
+		}
+		name := d.string()
+		var entry Entry
+		switch kind {
+		case snapDir:
+			sub := &Dir{}
+			sub.Mode, sub.ModTime, sub.Uid, sub.Gid, sub.Xattrs = d.attrs()
+			entry = sub
+		case snapFile:
+			f := &File{}
+			f.Mode, f.ModTime, f.Uid, f.Gid, f.Xattrs = d.attrs()
+			encoding := d.byte()
+			f.Data = d.bytes()
+			if encoding == snapRaw && f.Mode&ModeCompress != 0 {
+				if err := setFileData(f, f.Data); err != nil {
+					return err
+				}
+			}
+			*files = append(*files, f)
+			entry = f
+		case snapLink:
+			id := d.uvarint()
+			if d.err == nil && id >= uint64(len(*files)) {
+				return errCorruptPersistent
+			}
+			if d.err == nil {
+				entry = (*files)[id]
+			}
+		default:
+			return errCorruptPersistent
+		}
+		if d.err != nil {
+			return d.err
+		}
+		// Add the directories before their entries, so
+		// they're all tracked by the file system versions.
+		if err := dir.Add(name, entry); err != nil {
+			return errCorruptPersistent
+		}
+		if sub, ok := entry.(*Dir); ok {
+			if err := readSnapshotDir(d, sub, files); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replayHandle is a handle opened while replaying a log. atomic is
+// set for the ones opened by CreateAtomic.
+type replayHandle struct {
+	f      *file
+	atomic *memoryAtomicFile
+}
+
+func (h *replayHandle) close() error {
+	if h.atomic != nil {
+		return h.atomic.Abort()
+	}
+	return h.f.Close()
+}
+
+// replayer applies the records of the logs to a memory file system.
+type replayer struct {
+	fs      *memoryFileSystem
+	handles map[uint64]*replayHandle
+	// maxID is the highest handle id seen
+	maxID uint64
+}
+
+// setModTime sets the modification time of the entry at path, which
+// is not followed if it's a symlink.
+func (r *replayer) setModTime(path string, t time.Time) error {
+	r.fs.mu.RLock()
+	e, _, _, err := r.fs.lentry(path)
+	r.fs.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	switch e := e.(type) {
+	case *File:
+		e.Lock()
+		e.ModTime = t
+		e.Unlock()
+	case *Dir:
+		e.Lock()
+		e.ModTime = t
+		e.Unlock()
+	}
+	return nil
+}
+
+func setHandleModTime(h *file, t time.Time) {
+	h.f.Lock()
+	h.f.ModTime = t
+	h.f.Unlock()
+}
+
+// apply applies a log record.
+func (r *replayer) apply(record []byte) error {
+	d := &decoder{r: bytes.NewReader(record), limit: int64(len(record))}
+	op := d.byte()
+	var err error
+	// Records for handles which were not reopened after a
+	// compaction, because their files were unreachable, are
+	// ignored.
+	handle := func() *replayHandle {
+		id := d.uvarint()
+		return r.handles[id]
+	}
+	switch op {
+	case walOpen, walAtomic:
+		id := d.uvarint()
+		path := d.string()
+		flag := 0
+		if op == walOpen {
+			flag = int(d.varint())
+		}
+		perm := os.FileMode(d.uvarint())
+		mtime := d.time()
+		if d.err != nil {
+			break
+		}
+		r.maxID = max(r.maxID, id)
+		if h := r.handles[id]; h != nil {
+			// Logged again after a compaction which did
+			// not finish writing its snapshot
+			delete(r.handles, id)
+			if err = h.close(); err != nil {
+				break
+			}
+		}
+		h := &replayHandle{}
+		if op == walOpen {
+			// Writes are logged with their offset
+			var f WFile
+			if f, err = r.fs.OpenFile(path, flag&^os.O_APPEND, perm); err == nil {
+				h.f = f.(*file)
+			}
+		} else {
+			var f AtomicFile
+			if f, err = r.fs.CreateAtomic(path, perm); err == nil {
+				h.atomic = f.(*memoryAtomicFile)
+				h.f = h.atomic.WFile.(*file)
+			}
+		}
+		if err == nil {
+			setHandleModTime(h.f, mtime)
+			r.handles[id] = h
+		}
+	case walWrite:
+		h := handle()
+		off := d.varint()
+		data := d.bytes()
+		mtime := d.time()
+		if h != nil && d.err == nil {
+			if _, err = h.f.WriteAt(data, off); err == nil {
+				setHandleModTime(h.f, mtime)
+			}
+		}
+	case walTruncateFile:
+		h := handle()
+		size := d.varint()
+		mtime := d.time()
+		if h != nil && d.err == nil {
+			if err = h.f.Truncate(size); err == nil {
+				setHandleModTime(h.f, mtime)
+			}
+		}
+	case walClose, walCommit:
+		id := d.uvarint()
+		if h := r.handles[id]; h != nil && d.err == nil {
+			delete(r.handles, id)
+			if op == walCommit {
+				err = h.atomic.Commit()
+			} else {
+				err = h.close()
+			}
+		}
+	case walMkdir:
+		path := d.string()
+		perm := os.FileMode(d.uvarint())
+		mtime := d.time()
+		if d.err == nil {
+			if err = r.fs.Mkdir(path, perm); err == nil {
+				err = r.setModTime(path, mtime)
+			}
+		}
+	case walRemove:
+		path := d.string()
+		if d.err == nil {
+			err = r.fs.Remove(path)
+		}
+	case walRename, walLink:
+		oldpath := d.string()
+		newpath := d.string()
+		if d.err == nil {
+			if op == walRename {
+				err = r.fs.Rename(oldpath, newpath)
+			} else {
+				err = r.fs.Link(oldpath, newpath)
+			}
+		}
+	case walTruncate:
+		path := d.string()
+		size := d.varint()
+		mtime := d.time()
+		if d.err == nil {
+			if err = r.fs.Truncate(path, size); err == nil {
+				err = r.fs.Chtimes(path, mtime, mtime)
+			}
+		}
+	case walSymlink:
+		oldname := d.string()
+		newname := d.string()
+		mtime := d.time()
+		if d.err == nil {
+			if err = r.fs.Symlink(oldname, newname); err == nil {
+				err = r.setModTime(newname, mtime)
+			}
+		}
+	case walChmod:
+		path := d.string()
+		mode := os.FileMode(d.uvarint())
+		if d.err == nil {
+			err = r.fs.Chmod(path, mode)
+		}
+	case walChtimes:
+		path := d.string()
+		mtime := d.time()
+		if d.err == nil {
+			err = r.fs.Chtimes(path, mtime, mtime)
+		}
+	case walChown:
+		path := d.string()
+		uid := int(d.varint())
+		gid := int(d.varint())
+		if d.err == nil {
+			err = r.fs.Chown(path, uid, gid)
+		}
+	case walSetxattr:
+		path := d.string()
+		name := d.string()
+		value := d.bytes()
+		if d.err == nil {
+			err = r.fs.Setxattr(path, name, value)
+		}
+	case walRemovexattr:
+		path := d.string()
+		name := d.string()
+		if d.err == nil {
+			err = r.fs.Removexattr(path, name)
+		}
+	default:
+		return errCorruptPersistent
+	}
+	if d.err != nil {
+		return errCorruptPersistent
+	}
+	return err
+}
+
+// replay applies the records of the log at name, returning whether it
+// was complete. Otherwise, it's truncated after the last complete
+// record.
+func (r *replayer) replay(name string) (bool, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+	st, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	br := bufio.NewReader(f)
+	var off int64
+	for {
+		n, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return true, nil
+		}
+		header := int64(len(binary.AppendUvarint(nil, n)))
+		if err != nil || n > uint64(st.Size()-off-header) {
+			break
+		}
+		record := make([]byte, n+4)
+		if _, err := io.ReadFull(br, record); err != nil {
+			break
+		}
+		data, sum := record[:n], record[n:]
+		if binary.LittleEndian.Uint32(sum) != crc32.ChecksumIEEE(data) {
+			break
+		}
+		if err := r.apply(data); err != nil {
+			return false, fmt.Errorf("%s: replaying record at offset %d: %w", name, off, err)
+		}
+		off += header + int64(len(record))
+	}
+	if err := f.Truncate(off); err != nil {
+		return false, err
+	}
+	return false, f.Sync()
+}
+
+// persistentFileSystem is the VFS returned by OpenPersistentMemory. The
+// changes are applied to the memory file system and logged while mu is
+// held, so they're logged in the same order they're applied.
+type persistentFileSystem struct {
+	fs  *memoryFileSystem
+	dir string
+	// lock is held while the directory is in use
+	lock *os.File
+	// compactMu is held while compacting
+	compactMu sync.Mutex
+	mu        sync.Mutex
+	gen       uint64
+	log       *os.File
+	logSize   int64
+	snapSize  int64
+	// compactSize is the log size which starts a compaction
+	compactSize int64
+	compacting  bool
+	// compactErr is the error of the last automatic compaction
+	compactErr error
+	nextID     uint64
+	handles    map[uint64]*persistentFile
+	// err is set when logging fails, since the log is no longer
+	// in sync with the file system
+	err    error
+	closed bool
+}
+
+// usable returns an error if the file system can't be modified. It
+// must be called with mu held.
+func (p *persistentFileSystem) usable() error {
+	if p.closed {
+		return os.ErrClosed
+	}
+	return p.err
+}
+
+// record appends a record to the log. It must be called with mu held.
+func (p *persistentFileSystem) record(op byte, args ...any) error {
+	if err := p.usable(); err != nil {
+		return err
+	}
+	e := &encoder{}
+	e.byte(op)
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			e.string(v)
+		case []byte:
+			e.bytes(v)
+		case int:
+			e.varint(int64(v))
+		case int64:
+			e.varint(v)
+		case uint64:
+			e.uvarint(v)
+		case os.FileMode:
+			e.uvarint(uint64(v))
+		case time.Time:
+			e.time(v)
+		default:
+			panic(fmt.Errorf("can't log %T", arg))
+		}
+	}
+	record := binary.AppendUvarint(make([]byte, 0, len(e.buf)+binary.MaxVarintLen64+4), uint64(len(e.buf)))
+	record = append(record, e.buf...)
+	record = binary.LittleEndian.AppendUint32(record, crc32.ChecksumIEEE(e.buf))
+	if _, err := p.log.Write(record); err != nil {
+		p.err = err
+		return err
+	}
+	p.logSize += int64(len(record))
+	if !p.compacting && p.logSize >= p.compactSize && p.logSize > p.snapSize {
+		p.compacting = true
+		go p.autoCompact()
+	}
+	return nil
+}
+
+func (p *persistentFileSystem) autoCompact() {
+	err := p.Compact()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.compacting = false
+	if err != nil && !errors.Is(err, os.ErrClosed) {
+		p.compactErr = err
+	}
+}
+
+// modTime returns the modification time of the entry at path, which is
+// not followed if it's a symlink. It must be called with mu held.
+func (p *persistentFileSystem) modTime(path string) time.Time {
+	if st, err := p.fs.Lstat(path); err == nil {
+		return st.ModTime()
+	}
+	return time.Time{}
+}
+
+// change applies a change which does not modify the modification
+// times and logs it.
+func (p *persistentFileSystem) change(apply func() error, op byte, args ...any) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.usable(); err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	return p.record(op, args...)
+}
+
+func (p *persistentFileSystem) Open(path string) (RFile, error) {
+	return p.fs.Open(path)
+}
+
+func (p *persistentFileSystem) OpenFile(path string, flag int, perm os.FileMode) (WFile, error) {
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if !write && flag&os.O_CREATE == 0 {
+		return p.fs.OpenFile(path, flag, perm)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.usable(); err != nil {
+		return nil, err
+	}
+	h, err := p.fs.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	f := h.(*file)
+	id := p.nextID
+	p.nextID++
+	err = p.record(walOpen, id, path, flag, perm, f.f.ModificationTime())
+	if err == nil && !write {
+		err = p.record(walClose, id)
+	}
+	if err != nil {
+		_ = h.Close()
+		return nil, err
+	}
+	if !write {
+		// Read-only handles can't change the file
+		return h, nil
+	}
+	pf := &persistentFile{file: f, p: p, id: id}
+	p.handles[id] = pf
+	return pf, nil
+}
+
+func (p *persistentFileSystem) Lstat(path string) (os.FileInfo, error) {
+	return p.fs.Lstat(path)
+}
+
+func (p *persistentFileSystem) Stat(path string) (os.FileInfo, error) {
+	return p.fs.Stat(path)
+}
+
+func (p *persistentFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	return p.fs.ReadDir(path)
+}
+
+func (p *persistentFileSystem) OpenDir(path string) (DirFile, error) {
+	return p.fs.OpenDir(path)
+}
+
+func (p *persistentFileSystem) Mkdir(path string, perm os.FileMode) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.usable(); err != nil {
+		return err
+	}
+	if err := p.fs.Mkdir(path, perm); err != nil {
+		return err
+	}
+	return p.record(walMkdir, path, perm, p.modTime(path))
+}
+
+func (p *persistentFileSystem) Remove(path string) error {
+	return p.change(func() error {
+		return p.fs.Remove(path)
+	}, walRemove, path)
+}
+
+func (p *persistentFileSystem) Rename(oldpath, newpath string) error {
+	return p.change(func() error {
+		return p.fs.Rename(oldpath, newpath)
+	}, walRename, oldpath, newpath)
+}
+
+func (p *persistentFileSystem) Truncate(name string, size int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.usable(); err != nil {
+		return err
+	}
+	if err := p.fs.Truncate(name, size); err != nil {
+		return err
+	}
+	st, err := p.fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	return p.record(walTruncate, name, size, st.ModTime())
+}
+
+func (p *persistentFileSystem) Link(oldname, newname string) error {
+	return p.change(func() error {
+		return p.fs.Link(oldname, newname)
+	}, walLink, oldname, newname)
+}
+
+func (p *persistentFileSystem) Symlink(oldname, newname string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.usable(); err != nil {
+		return err
+	}
+	if err := p.fs.Symlink(oldname, newname); err != nil {
+		return err
+	}
+	return p.record(walSymlink, oldname, newname, p.modTime(newname))
+}
+
+func (p *persistentFileSystem) Readlink(name string) (string, error) {
+	return p.fs.Readlink(name)
+}
+
+func (p *persistentFileSystem) CreateAtomic(path string, perm os.FileMode) (AtomicFile, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.usable(); err != nil {
+		return nil, err
+	}
+	a, err := p.fs.CreateAtomic(path, perm)
+	if err != nil {
+		return nil, err
+	}
+	ma := a.(*memoryAtomicFile)
+	id := p.nextID
+	p.nextID++
+	if err := p.record(walAtomic, id, path, perm, ma.f.ModificationTime()); err != nil {
+		_ = a.Abort()
+		return nil, err
+	}
+	pf := &persistentFile{file: ma.WFile.(*file), p: p, id: id, atomic: ma, path: path, perm: perm}
+	p.handles[id] = pf
+	return &persistentAtomicFile{persistentFile: pf}, nil
+}
+
+func (p *persistentFileSystem) Chmod(name string, mode os.FileMode) error {
+	return p.change(func() error {
+		return p.fs.Chmod(name, mode)
+	}, walChmod, name, mode)
+}
+
+func (p *persistentFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return p.change(func() error {
+		return p.fs.Chtimes(name, atime, mtime)
+	}, walChtimes, name, mtime)
+}
+
+func (p *persistentFileSystem) Chown(name string, uid, gid int) error {
+	return p.change(func() error {
+		return p.fs.Chown(name, uid, gid)
+	}, walChown, name, uid, gid)
+}
+
+func (p *persistentFileSystem) Getxattr(path string, name string) ([]byte, error) {
+	return p.fs.Getxattr(path, name)
+}
+
+func (p *persistentFileSystem) Setxattr(path string, name string, value []byte) error {
+	return p.change(func() error {
+		return p.fs.Setxattr(path, name, value)
+	}, walSetxattr, path, name, value)
+}
+
+func (p *persistentFileSystem) Listxattr(path string) ([]string, error) {
+	return p.fs.Listxattr(path)
+}
+
+func (p *persistentFileSystem) Removexattr(path string, name string) error {
+	return p.change(func() error {
+		return p.fs.Removexattr(path, name)
+	}, walRemovexattr, path, name)
+}
+
+func (p *persistentFileSystem) StatFS() (*FSStats, error) {
+	return p.fs.StatFS()
+}
+
+func (p *persistentFileSystem) Snapshot() (VFS, error) {
+	return p.fs.Snapshot()
+}
+
+// Fork returns a writable copy of the file system, which is kept only
+// in memory.
+func (p *persistentFileSystem) Fork() (VFS, error) {
+	return p.fs.Fork()
+}
+
+// Compact implements PersistentVFS.
+func (p *persistentFileSystem) Compact() error {
+	p.compactMu.Lock()
+	defer p.compactMu.Unlock()
+	snap, gen, err := p.rotate()
+	if err != nil {
+		return err
+	}
+	size, err := writeSnapshot(p.dir, gen, snap)
+	// Drop the copies made for the snapshot right away
+	snap.release()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.snapSize = size
+	p.mu.Unlock()
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+	for _, v := range entries {
+		if _, g, ok := parsePersistName(v.Name()); ok && g < gen {
+			if err := os.Remove(filepath.Join(p.dir, v.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rotate starts a new generation, returning a snapshot of the file
+// system at its start.
+func (p *persistentFileSystem) rotate() (*memoryFileSystem, uint64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.usable(); err != nil {
+		return nil, 0, err
+	}
+	if err := p.log.Sync(); err != nil {
+		return nil, 0, err
+	}
+	gen := p.gen + 1
+	log, err := openLog(p.dir, gen)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := p.log.Close(); err != nil {
+		_ = log.Close()
+		return nil, 0, err
+	}
+	p.log, p.gen, p.logSize = log, gen, 0
+	if err := p.reopen(); err != nil {
+		p.err = err
+		return nil, 0, err
+	}
+	return p.fs.snapshot(), gen, nil
+}
+
+// reopen logs the handles open for writing again at the start of the
+// log, so the changes made through them can be replayed after loading
+// the snapshot of its generation. The ones to files which are no longer
+// reachable are ignored, while the data written to atomic files is
+// logged again. It must be called with mu held.
+func (p *persistentFileSystem) reopen() error {
+	paths := make(map[*File]string)
+	for _, h := range p.handles {
+		if h.atomic == nil {
+			paths[h.f] = ""
+		}
+	}
+	p.fs.paths(paths)
+	for _, id := range slices.Sorted(maps.Keys(p.handles)) {
+		h := p.handles[id]
+		mtime := h.f.ModificationTime()
+		if h.atomic != nil {
+			data, err := h.f.Bytes()
+			if err != nil {
+				return err
+			}
+			if err := p.record(walAtomic, id, h.path, h.perm, mtime); err != nil {
+				return err
+			}
+			if err := p.record(walWrite, id, int64(0), data, mtime); err != nil {
+				return err
+			}
+			continue
+		}
+		if path := paths[h.f]; path != "" {
+			if err := p.record(walOpen, id, path, os.O_WRONLY, os.FileMode(0), mtime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// paths sets the values of files to one of the paths of each of them,
+// if they're reachable.
+func (fs *memoryFileSystem) paths(files map[*File]string) {
+	if len(files) == 0 {
+		return
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	var walk func(d *Dir, dir string)
+	walk = func(d *Dir, dir string) {
+		d.RLock()
+		defer d.RUnlock()
+		for ii, e := range d.Entries {
+			p := pathpkg.Join(dir, d.EntryNames[ii])
+			switch e := e.(type) {
+			case *Dir:
+				walk(e, p)
+			case *File:
+				if v, ok := files[e]; ok && v == "" {
+					files[e] = p
+				}
+			}
+		}
+	}
+	walk(fs.root, "/")
+}
+
+// Close implements PersistentVFS.
+func (p *persistentFileSystem) Close() error {
+	p.compactMu.Lock()
+	defer p.compactMu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	err := p.log.Sync()
+	if cerr := p.log.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := p.lock.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = p.compactErr
+	}
+	return err
+}
+
+func (p *persistentFileSystem) String() string {
+	return fmt.Sprintf("PersistentMemory %s", p.dir)
+}
+
+// persistentFile is a handle opened for writing by persistentFileSystem.
+// atomic, path and perm are set for the ones returned by CreateAtomic.
+type persistentFile struct {
+	*file
+	p      *persistentFileSystem
+	id     uint64
+	atomic *memoryAtomicFile
+	path   string
+	perm   os.FileMode
+	closed bool
+}
+
+func (f *persistentFile) Write(b []byte) (int, error) {
+	p := f.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.usable(); err != nil {
+		return 0, err
+	}
+	n, err := f.file.Write(b)
+	if n > 0 {
+		// Writes in append mode happen at the end, so the
+		// offset is only known afterwards.
+		end, serr := f.file.Seek(0, io.SeekCurrent)
+		if serr == nil {
+			serr = p.record(walWrite, f.id, end-int64(n), b[:n], f.f.ModificationTime())
+		}
+		if err == nil {
+			err = serr
+		}
+	}
+	return n, err
+}
+
+func (f *persistentFile) WriteAt(b []byte, off int64) (int, error) {
+	p := f.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.usable(); err != nil {
+		return 0, err
+	}
+	n, err := f.file.WriteAt(b, off)
+	if n > 0 {
+		if lerr := p.record(walWrite, f.id, off, b[:n], f.f.ModificationTime()); err == nil {
+			err = lerr
+		}
+	}
+	return n, err
+}
+
+func (f *persistentFile) Truncate(size int64) error {
+	p := f.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.usable(); err != nil {
+		return err
+	}
+	if err := f.file.Truncate(size); err != nil {
+		return err
+	}
+	return p.record(walTruncateFile, f.id, size, f.f.ModificationTime())
+}
+
+// Sync syncs the file data and the log to disk, so the changes made
+// so far survive a crash.
+func (f *persistentFile) Sync() error {
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	p := f.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.usable(); err != nil {
+		return err
+	}
+	return p.log.Sync()
+}
+
+func (f *persistentFile) Close() error {
+	p := f.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return f.close(f.file.Close)
+}
+
+// close closes the handle with the given function and logs it, if
+// it was not closed. It must be called with the lock of the file
+// system held.
+func (f *persistentFile) close(fn func() error) error {
+	if f.closed {
+		return fn()
+	}
+	f.closed = true
+	delete(f.p.handles, f.id)
+	err := fn()
+	if f.p.usable() == nil {
+		if lerr := f.p.record(walClose, f.id); err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
+
+// persistentAtomicFile is the AtomicFile returned by persistentFileSystem.
+type persistentAtomicFile struct {
+	*persistentFile
+}
+
+// Commit replaces the file and syncs the log, so the new contents
+// survive a crash once it returns.
+func (f *persistentAtomicFile) Commit() error {
+	p := f.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f.closed {
+		return f.atomic.Commit()
+	}
+	if err := p.usable(); err != nil {
+		return err
+	}
+	f.closed = true
+	delete(p.handles, f.id)
+	if err := f.atomic.Commit(); err != nil {
+		// The file was discarded
+		_ = p.record(walClose, f.id)
+		return err
+	}
+	if err := p.record(walCommit, f.id); err != nil {
+		return err
+	}
+	return p.log.Sync()
+}
+
+func (f *persistentAtomicFile) Abort() error {
+	p := f.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return f.close(f.atomic.Abort)
+}
+
+func (f *persistentAtomicFile) Close() error {
+	return f.Abort()
+}
+
+// openLog opens the log of generation gen in dir for appending,
+// creating it if needed.
+func openLog(dir string, gen uint64) (*os.File, error) {
+	log, err := os.OpenFile(filepath.Join(dir, persistName("wal", gen)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	syncDirEntries(dir)
+	return log, nil
+}
+
+// lockPersistentDir locks dir, so it's not used by several processes
+// at the same time. Locking is only supported on Linux.
+func lockPersistentDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "LOCK"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := (&osFile{File: f}).TryLock(true)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return f, nil
+	}
+	if err == nil && !ok {
+		err = &os.PathError{Op: "open", Path: dir, Err: syscall.EBUSY}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// load loads the latest snapshot and replays the logs written
+// after it.
+func (p *persistentFileSystem) load() error {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+	var snapshot uint64
+	hasSnapshot := false
+	logs := make(map[uint64]bool)
+	for _, v := range entries {
+		name := v.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Incomplete snapshot
+			if err := os.Remove(filepath.Join(p.dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		kind, gen, ok := parsePersistName(name)
+		switch {
+		case !ok:
+		case kind == "snapshot":
+			snapshot, hasSnapshot = max(snapshot, gen), true
+		default:
+			logs[gen] = true
+		}
+	}
+	p.fs = newMemory()
+	if hasSnapshot {
+		fs, size, err := readSnapshot(filepath.Join(p.dir, persistName("snapshot", snapshot)))
+		if err != nil {
+			return err
+		}
+		p.fs, p.snapSize = fs, size
+		p.gen = snapshot
+	}
+	r := &replayer{fs: p.fs, handles: make(map[uint64]*replayHandle)}
+	for gen := p.gen; logs[gen]; gen++ {
+		p.gen = gen
+		complete, err := r.replay(filepath.Join(p.dir, persistName("wal", gen)))
+		if err != nil {
+			return err
+		}
+		if !complete {
+			// The later logs can't be applied
+			break
+		}
+	}
+	for _, h := range r.handles {
+		if err := h.close(); err != nil {
+			return err
+		}
+	}
+	for _, v := range entries {
+		if _, gen, ok := parsePersistName(v.Name()); ok && (gen < snapshot || gen > p.gen) {
+			if err := os.Remove(filepath.Join(p.dir, v.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if p.log, err = openLog(p.dir, p.gen); err != nil {
+		return err
+	}
+	st, err := p.log.Stat()
+	if err != nil {
+		_ = p.log.Close()
+		return err
+	}
+	p.logSize = st.Size()
+	p.nextID = r.maxID + 1
+	return nil
+}
+
+// OpenPersistentMemory returns an in-memory file system whose contents are
+// stored in the directory at dir, which is created if needed. If it
+// already contains a file system, it's loaded first.
+//
+// The changes are appended to a log, which is replayed on startup, and
+// when it grows too much compared to the size of the data, a snapshot of
+// the file system is written in the background, replacing it. The log is
+// written as the changes are made, but it's only synced to disk by Sync,
+// Commit, Compact and Close, so a crash of the machine might lose the
+// latest changes, but not the ones made before. Compression, quotas and
+// the umask are not persisted, and files are stored decompressed until
+// the next compaction if they were compressed after it.
+func OpenPersistentMemory(dir string) (PersistentVFS, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := lockPersistentDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	p := &persistentFileSystem{
+		dir:         dir,
+		lock:        lock,
+		compactSize: compactLogSize,
+		handles:     make(map[uint64]*persistentFile),
+	}
+	if err := p.load(); err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	return p, nil
+}
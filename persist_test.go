@@ -0,0 +1,401 @@
+package vfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func openPersistent(t *testing.T, dir string) *persistentFileSystem {
+	t.Helper()
+	fs, err := OpenPersistentMemory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs.(*persistentFileSystem)
+}
+
+// persistentFiles returns the names of the snapshots and logs in dir.
+func persistentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range entries {
+		if _, _, ok := parsePersistName(v.Name()); ok {
+			names = append(names, v.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func persistentFixture(t *testing.T, fs VFS) time.Time {
+	h := snapshotFixture(t, fs)
+	if _, err := h.Write([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	if err := Chtimes(fs, "a/b/g", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := Chmod(fs, "a/b", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := Setxattr(fs, "a/f", "user.x", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "removed", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("removed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rename(fs, "c", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(fs, "atomic", []byte("atomic"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Truncate(fs, "a/f", 0); err != nil {
+		t.Fatal(err)
+	}
+	return mtime
+}
+
+func checkPersistentFixture(t *testing.T, fs VFS, mtime time.Time) {
+	t.Helper()
+	checkContents(t, fs, "a/b/link", "")
+	checkContents(t, fs, "a/b/g", "g")
+	checkContents(t, fs, "d", "cc")
+	checkContents(t, fs, "atomic", "atomic")
+	if target, err := Readlink(fs, "sym"); err != nil || target != "a/f" {
+		t.Errorf("Readlink = %q, %v, want a/f", target, err)
+	}
+	if value, err := Getxattr(fs, "a/b/link", "user.x"); err != nil || string(value) != "x" {
+		t.Errorf("Getxattr = %q, %v, want x", value, err)
+	}
+	for _, name := range []string{"c", "removed"} {
+		if _, err := fs.Lstat(name); !IsNotExist(err) {
+			t.Errorf("Lstat(%s) = %v, want not exist", name, err)
+		}
+	}
+	st, err := fs.Stat("a/b/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.ModTime().Equal(mtime) {
+		t.Errorf("modification time = %s, want %s", st.ModTime(), mtime)
+	}
+	if st, err := fs.Stat("a/b"); err != nil || st.Mode().Perm() != 0700 {
+		t.Errorf("Stat(a/b) = %v, %v, want mode 0700", st, err)
+	}
+	if st, err := fs.Stat("atomic"); err != nil || st.Mode().Perm() != 0600 {
+		t.Errorf("Stat(atomic) = %v, %v, want mode 0600", st, err)
+	}
+}
+
+func TestPersistentMemory(t *testing.T) {
+	dir := t.TempDir()
+	fs := openPersistent(t, dir)
+	mtime := persistentFixture(t, fs)
+	// Locking is only supported on Linux
+	if _, err := OpenPersistentMemory(dir); runtime.GOOS == "linux" && !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("opening a directory in use returned %v, want EBUSY", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("closed", 0755); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Mkdir after Close = %v, want ErrClosed", err)
+	}
+	// From the log
+	fs = openPersistent(t, dir)
+	checkPersistentFixture(t, fs, mtime)
+	if err := fs.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if files := persistentFiles(t, dir); len(files) != 2 || files[0] != persistName("snapshot", 1) || files[1] != persistName("wal", 1) {
+		t.Errorf("files after compaction = %v, want snapshot and log of generation 1", files)
+	}
+	// The copies made for writing the snapshot are dropped
+	fs.fs.versions.mu.Lock()
+	kept := len(fs.fs.versions.kept)
+	fs.fs.versions.mu.Unlock()
+	if kept != 0 {
+		t.Errorf("%d entries keep previous versions after compaction, want 0", kept)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// From the snapshot
+	fs = openPersistent(t, dir)
+	defer func() { _ = fs.Close() }()
+	checkPersistentFixture(t, fs, mtime)
+	// Hard links are preserved
+	if err := WriteFile(fs, "a/f", []byte("linked"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, fs, "a/b/link", "linked")
+}
+
+func TestPersistentMemoryTornLog(t *testing.T) {
+	dir := t.TempDir()
+	fs := openPersistent(t, dir)
+	if err := WriteFile(fs, "a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "b", []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(dir, persistName("wal", 0))
+	st, err := os.Stat(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut the close of b
+	if err := os.Truncate(log, st.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+	fs = openPersistent(t, dir)
+	checkContents(t, fs, "a", "a")
+	checkContents(t, fs, "b", "b")
+	if err := WriteFile(fs, "c", []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Appending continues after the last complete record
+	fs = openPersistent(t, dir)
+	defer func() { _ = fs.Close() }()
+	checkContents(t, fs, "c", "c")
+}
+
+func TestPersistentMemoryCompactOpenHandles(t *testing.T) {
+	dir := t.TempDir()
+	fs := openPersistent(t, dir)
+	if err := fs.Mkdir("d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	h, err := fs.OpenFile("d/f", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := CreateAtomic(fs, "d/atomic", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []WFile{h, a} {
+		if _, err := f.Write([]byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rename(fs, "d/f", "d/g"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []WFile{h, a} {
+		if _, err := f.Write([]byte("2")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs = openPersistent(t, dir)
+	defer func() { _ = fs.Close() }()
+	checkContents(t, fs, "d/g", "12")
+	checkContents(t, fs, "d/atomic", "12")
+}
+
+func TestPersistentMemoryInterruptedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	fs := openPersistent(t, dir)
+	if err := WriteFile(fs, "a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := CreateAtomic(fs, "b", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Write([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	// Start a new generation without writing its snapshot
+	if _, _, err := fs.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Write([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "a", []byte("aa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs = openPersistent(t, dir)
+	defer func() { _ = fs.Close() }()
+	checkContents(t, fs, "a", "aa")
+	checkContents(t, fs, "b", "bb")
+	if files := persistentFiles(t, dir); len(files) != 2 {
+		t.Errorf("files after interrupted compaction = %v, want the logs of generations 0 and 1", files)
+	}
+}
+
+func TestPersistentMemoryAutoCompact(t *testing.T) {
+	dir := t.TempDir()
+	fs := openPersistent(t, dir)
+	fs.compactSize = 1024
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	for ii := 0; ii < 100; ii++ {
+		if err := WriteFile(fs, "f", data[:ii], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Compaction runs in the background
+	for ii := 0; ; ii++ {
+		if files := persistentFiles(t, dir); len(files) == 2 && files[0] != persistName("wal", 0) {
+			break
+		}
+		if ii == 1000 {
+			t.Fatalf("files after writing more than the compaction size = %v, want a snapshot and a log", persistentFiles(t, dir))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs = openPersistent(t, dir)
+	defer func() { _ = fs.Close() }()
+	checkContents(t, fs, "f", string(data[:99]))
+}
+
+func TestPersistentMemoryCompressed(t *testing.T) {
+	dir := t.TempDir()
+	fs := openPersistent(t, dir)
+	data := bytes.Repeat([]byte("z"), 100000)
+	if err := WriteFile(fs, "z", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Compress(fs.fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(filepath.Join(dir, persistName("snapshot", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() >= int64(len(data)) {
+		t.Errorf("snapshot size = %d, want the compressed size", st.Size())
+	}
+	fs = openPersistent(t, dir)
+	defer func() { _ = fs.Close() }()
+	f, err := fs.Open("z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := f.(Compressor); !ok || !c.IsCompressed() {
+		t.Error("file is not compressed after loading the snapshot")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, fs, "z", string(data))
+}
+
+func TestPersistentSnapshotStorage(t *testing.T) {
+	hybrid, _ := newTestHybrid(t, 4)
+	if err := WriteFile(hybrid, "spilled", []byte("spilled data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "archived", Mode: 0644, Size: 8}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("archived")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := TarReaderAt(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Spilled files and the ones read from archives have no Data
+	for _, v := range []struct {
+		fs   *memoryFileSystem
+		name string
+		data string
+	}{
+		{hybrid.(*hybridFileSystem).memoryFileSystem, "spilled", "spilled data"},
+		{archive.(*memoryFileSystem), "archived", "archived"},
+	} {
+		dir := t.TempDir()
+		if _, err := writeSnapshot(dir, 1, v.fs.snapshot()); err != nil {
+			t.Fatal(err)
+		}
+		fs, _, err := readSnapshot(filepath.Join(dir, persistName("snapshot", 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkContents(t, fs, v.name, v.data)
+	}
+}
+
+func TestPersistentMemoryCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	fs := openPersistent(t, dir)
+	if err := WriteFile(fs, "a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, persistName("snapshot", 1))
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(snapshotMagic)+1] ^= 0xff
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenPersistentMemory(dir); !errors.Is(err, errCorruptPersistent) {
+		t.Errorf("opening a corrupted snapshot returned %v, want errCorruptPersistent", err)
+	}
+}
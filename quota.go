@@ -0,0 +1,915 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	pathpkg "path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrQuotaExceeded is returned by the operations which would exceed
+// the limits set with SetQuota. Since it matches syscall.ENOSPC with
+// errors.Is, code handling full disks handles it too.
+var ErrQuotaExceeded error = quotaExceededError{}
+
+type quotaExceededError struct{}
+
+func (quotaExceededError) Error() string {
+	return "quota exceeded"
+}
+
+func (quotaExceededError) Is(target error) bool {
+	return target == syscall.ENOSPC
+}
+
+var errNoQuota = errors.New("no quota set")
+
+// QuotaLimits are the limits of a subtree, set with SetQuota.
+type QuotaLimits struct {
+	// Bytes is the maximum size of the data of the files and
+	// symlinks in the subtree. Zero means no limit.
+	Bytes int64
+	// Files is the maximum number of entries in the subtree,
+	// including files, symlinks and directories, as well as
+	// the root of the subtree. Zero means no limit.
+	Files int64
+}
+
+// QuotaInfo contains the limits and the usage of a subtree, as
+// returned by QuotaUsage.
+type QuotaInfo struct {
+	// Limits are the limits set with SetQuota.
+	Limits QuotaLimits
+	// Bytes is the size of the data of the files and symlinks,
+	// which might be larger than the limit if it was set after
+	// they were written.
+	Bytes int64
+	// Files is the number of entries in the subtree.
+	Files int64
+}
+
+// quotaMu protects the usage of all the quotas. It's only held
+// while updating them, after any other lock.
+var quotaMu sync.Mutex
+
+// quota tracks the usage of a subtree with limits. The usage of the
+// nested subtrees is also counted in their parents. Its methods
+// might be called on a nil *quota, for entries without limits.
+type quota struct {
+	// dir is the root of the subtree, for in-memory file systems
+	dir    *Dir
+	parent *quota
+	limits QuotaLimits
+	bytes  int64
+	files  int64
+}
+
+// charge adds the given number of bytes and files to the usage of
+// q and its parents. If any limit would be exceeded, it returns
+// ErrQuotaExceeded without changing them. Releasing space, with
+// negative numbers, always succeeds.
+func (q *quota) charge(bytes int64, files int64) error {
+	if q == nil || (bytes == 0 && files == 0) {
+		return nil
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	for p := q; p != nil; p = p.parent {
+		if exceeds(p.bytes, bytes, p.limits.Bytes) || exceeds(p.files, files, p.limits.Files) {
+			return ErrQuotaExceeded
+		}
+	}
+	for p := q; p != nil; p = p.parent {
+		p.bytes += bytes
+		p.files += files
+	}
+	return nil
+}
+
+func exceeds(usage int64, delta int64, limit int64) bool {
+	return delta > 0 && limit > 0 && usage+delta > limit
+}
+
+func (q *quota) setLimits(limits QuotaLimits) {
+	quotaMu.Lock()
+	q.limits = limits
+	quotaMu.Unlock()
+}
+
+func (q *quota) info() *QuotaInfo {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	return &QuotaInfo{Limits: q.limits, Bytes: q.bytes, Files: q.files}
+}
+
+// limit reduces the capacity reported in st to the limits of q, the
+// quota of the whole file system, if any.
+func (q *quota) limit(st *FSStats) {
+	if q == nil {
+		return
+	}
+	info := q.info()
+	limit := func(total, free *int64, limit, used int64) {
+		if limit <= 0 || (*total > 0 && *total <= limit) {
+			return
+		}
+		avail := max(limit-used, 0)
+		if *total == 0 || avail < *free {
+			*free = avail
+		}
+		*total = limit
+	}
+	limit(&st.TotalBytes, &st.FreeBytes, info.Limits.Bytes, info.Bytes)
+	limit(&st.TotalInodes, &st.FreeInodes, info.Limits.Files, info.Files)
+}
+
+// entryQuota returns the quota which the given in-memory entry is
+// charged to in its parent directory. Since the root of a subtree
+// with limits is also charged to its own quota, moving it around
+// only needs to keep the parent one.
+func entryQuota(entry Entry) *quota {
+	switch e := entry.(type) {
+	case *File:
+		e.RLock()
+		defer e.RUnlock()
+		return e.quota
+	case *Dir:
+		if e.quota != nil && e.quota.dir == e {
+			return e.quota.parent
+		}
+		return e.quota
+	}
+	return nil
+}
+
+// chargeSize charges the growth of the data of f up to size bytes to
+// its quota, or releases the space if it shrinks. It must be called
+// with the lock of f held.
+func (f *File) chargeSize(size int64) error {
+	if f.quota == nil {
+		return nil
+	}
+	if err := f.quota.charge(size-f.charged, 0); err != nil {
+		return err
+	}
+	f.charged = size
+	return nil
+}
+
+// SetQuota implements QuotaVFS. Hard links are counted once, and they
+// can't be created across subtrees with different quotas, which also
+// can't be crossed by Rename, failing with syscall.EXDEV. The files
+// which are removed while they have open handles are still counted
+// until the handles are closed.
+func (fs *memoryFileSystem) SetQuota(path string, limits QuotaLimits) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	entry, _, _, err := fs.entry(path)
+	if err != nil {
+		return &os.PathError{Op: "setquota", Path: path, Err: err}
+	}
+	d, ok := entry.(*Dir)
+	if !ok {
+		return &os.PathError{Op: "setquota", Path: path, Err: syscall.ENOTDIR}
+	}
+	if d.quota != nil && d.quota.dir == d {
+		d.quota.setLimits(limits)
+		return nil
+	}
+	q := &quota{dir: d, parent: d.quota, limits: limits}
+	if err := q.adopt(d, make(map[*File]struct{})); err != nil {
+		return &os.PathError{Op: "setquota", Path: path, Err: err}
+	}
+	return nil
+}
+
+// adopt moves the entries in the subtree at d which are charged to the
+// parent of q to q, counting their usage. The nested subtrees with
+// their own quota are only reparented.
+func (q *quota) adopt(d *Dir, seen map[*File]struct{}) error {
+	d.RLock()
+	defer d.RUnlock()
+	if err := d.load(); err != nil {
+		return err
+	}
+	if d.quota != nil && d.quota.dir == d && d.quota != q {
+		quotaMu.Lock()
+		d.quota.parent = q
+		q.bytes += d.quota.bytes
+		q.files += d.quota.files
+		quotaMu.Unlock()
+		return nil
+	}
+	d.quota = q
+	q.add(0, 1)
+	for _, e := range d.Entries {
+		switch e := e.(type) {
+		case *Dir:
+			if err := q.adopt(e, seen); err != nil {
+				return err
+			}
+		case *File:
+			if _, ok := seen[e]; ok {
+				continue
+			}
+			seen[e] = struct{}{}
+			if err := q.adoptFile(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adoptFile moves f to q, charging its current size if it was
+// not charged to any quota.
+func (q *quota) adoptFile(f *File) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.quota != q.parent {
+		// Hard linked from a subtree with another quota
+		return nil
+	}
+	if f.quota == nil {
+		size, _, err := f.usage()
+		if err != nil {
+			return err
+		}
+		f.charged = size
+	}
+	f.quota = q
+	q.add(f.charged, 1)
+	return nil
+}
+
+// add adds to the usage of q alone, while it's being built by adopt.
+func (q *quota) add(bytes int64, files int64) {
+	quotaMu.Lock()
+	q.bytes += bytes
+	q.files += files
+	quotaMu.Unlock()
+}
+
+func (fs *memoryFileSystem) QuotaUsage(path string) (*QuotaInfo, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	entry, _, _, err := fs.entry(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "quota", Path: path, Err: err}
+	}
+	d, ok := entry.(*Dir)
+	if !ok || d.quota == nil || d.quota.dir != d {
+		return nil, &os.PathError{Op: "quota", Path: path, Err: errNoQuota}
+	}
+	return d.quota.info(), nil
+}
+
+// quotaFileSystem is the VFS returned by Quota. The quotas are keyed
+// by the cleaned path of their root, and the files opened for writing
+// by their path, so the handles to the same file share its size.
+type quotaFileSystem struct {
+	fs VFS
+	// mu serializes the namespace operations, and it protects
+	// quotas and files.
+	mu     sync.Mutex
+	quotas map[string]*quota
+	files  map[string]*quotaEntry
+}
+
+// quotaEntry tracks the size of a file with open handles. Its lock
+// serializes the writes, since their growth depends on the size.
+type quotaEntry struct {
+	mu   sync.Mutex
+	q    *quota
+	size int64
+	refs int
+}
+
+// write charges the growth caused by writing n bytes at off with fn,
+// releasing the space which was not written if it fails. It must
+// be called with the lock of e held.
+func (e *quotaEntry) write(path string, off int64, n int, fn func() (int, error)) (int, error) {
+	grow := max(off+int64(n)-e.size, 0)
+	if err := e.q.charge(grow, 0); err != nil {
+		return 0, &os.PathError{Op: "write", Path: path, Err: err}
+	}
+	written, err := fn()
+	end := max(off+int64(written), e.size)
+	_ = e.q.charge(end-e.size-grow, 0)
+	e.size = end
+	return written, err
+}
+
+// truncate charges the change of size caused by fn.
+func (e *quotaEntry) truncate(path string, size int64, fn func() error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.q.charge(size-e.size, 0); err != nil {
+		return &os.PathError{Op: "truncate", Path: path, Err: err}
+	}
+	if err := fn(); err != nil {
+		_ = e.q.charge(e.size-size, 0)
+		return err
+	}
+	e.size = size
+	return nil
+}
+
+func (fs *quotaFileSystem) VFS() VFS {
+	return fs.fs
+}
+
+// quota returns the quota charged for the entry at p, which must be a
+// cleaned path. For the root of a subtree with limits, it's its own.
+// It must always be called with the lock held.
+func (fs *quotaFileSystem) quota(p string) *quota {
+	for {
+		if q, ok := fs.quotas[p]; ok {
+			return q
+		}
+		if p == "/" {
+			return nil
+		}
+		p = pathpkg.Dir(p)
+	}
+}
+
+// parentQuota returns the quota of the directory containing p.
+func (fs *quotaFileSystem) parentQuota(p string) *quota {
+	return fs.quota(pathpkg.Dir(p))
+}
+
+func quotaPath(p string) string {
+	return pathpkg.Clean("/" + p)
+}
+
+// entry returns the tracked size of the file at p, starting to track
+// it with the given size if needed. It must always be called with
+// the lock held.
+func (fs *quotaFileSystem) entry(p string, size int64) *quotaEntry {
+	e := fs.files[p]
+	if e == nil {
+		e = &quotaEntry{q: fs.quota(p), size: size}
+		fs.files[p] = e
+	}
+	return e
+}
+
+// forget stops tracking the file at p, which was removed or replaced,
+// so the writes to its handles are no longer charged. It returns its
+// tracked size, or size if it was not tracked. It must always be
+// called with the lock held.
+func (fs *quotaFileSystem) forget(p string, size int64) int64 {
+	if e := fs.files[p]; e != nil {
+		e.mu.Lock()
+		size = e.size
+		e.q = nil
+		e.mu.Unlock()
+		delete(fs.files, p)
+	}
+	return size
+}
+
+// removed releases the space used by the entry at p, described by
+// info, which was removed. It must always be called with the lock held.
+func (fs *quotaFileSystem) removed(p string, info os.FileInfo) {
+	var size int64
+	if !info.IsDir() {
+		size = fs.forget(p, info.Size())
+	}
+	_ = fs.quota(p).charge(-size, -1)
+	// Directories must be empty, so there are no nested quotas
+	delete(fs.quotas, p)
+}
+
+// moved updates the quotas and the files tracked below oldpath,
+// which was renamed to newpath. It must always be called with the
+// lock held.
+func (fs *quotaFileSystem) moved(oldpath, newpath string) {
+	rel := func(p string) (string, bool) {
+		if p == oldpath {
+			return "", true
+		}
+		if strings.HasPrefix(p, oldpath+"/") {
+			return p[len(oldpath):], true
+		}
+		return "", false
+	}
+	for p, e := range fs.files {
+		if r, ok := rel(p); ok {
+			delete(fs.files, p)
+			fs.files[newpath+r] = e
+		}
+	}
+	for p, q := range fs.quotas {
+		if r, ok := rel(p); ok && p != "/" {
+			delete(fs.quotas, p)
+			fs.quotas[newpath+r] = q
+		}
+	}
+}
+
+func (fs *quotaFileSystem) Open(path string) (RFile, error) {
+	return fs.fs.Open(path)
+}
+
+func (fs *quotaFileSystem) OpenFile(path string, flag int, perm os.FileMode) (WFile, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0 {
+		return fs.fs.OpenFile(path, flag, perm)
+	}
+	p := quotaPath(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	info, err := fs.fs.Stat(p)
+	var created *quota
+	if err != nil && IsNotExist(err) && flag&os.O_CREATE != 0 {
+		created = fs.parentQuota(p)
+		if err := created.charge(0, 1); err != nil {
+			return nil, &os.PathError{Op: "open", Path: path, Err: err}
+		}
+	}
+	f, err := fs.fs.OpenFile(p, flag, perm)
+	if err != nil {
+		_ = created.charge(0, -1)
+		return nil, err
+	}
+	var size int64
+	if info != nil {
+		size = info.Size()
+	}
+	e := fs.entry(p, size)
+	e.refs++
+	if info != nil && flag&os.O_TRUNC != 0 {
+		e.mu.Lock()
+		_ = e.q.charge(-e.size, 0)
+		e.size = 0
+		e.mu.Unlock()
+	}
+	return &quotaFile{WFile: f, fs: fs, e: e, path: p, append: flag&os.O_APPEND != 0}, nil
+}
+
+// closed unregisters a handle to the file at p.
+func (fs *quotaFileSystem) closed(p string, e *quotaEntry) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	e.refs--
+	if e.refs == 0 && fs.files[p] == e {
+		delete(fs.files, p)
+	}
+}
+
+func (fs *quotaFileSystem) Lstat(path string) (os.FileInfo, error) {
+	return fs.fs.Lstat(path)
+}
+
+func (fs *quotaFileSystem) Stat(path string) (os.FileInfo, error) {
+	return fs.fs.Stat(path)
+}
+
+func (fs *quotaFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	return fs.fs.ReadDir(path)
+}
+
+func (fs *quotaFileSystem) OpenDir(path string) (DirFile, error) {
+	return OpenDir(fs.fs, path)
+}
+
+func (fs *quotaFileSystem) Mkdir(path string, perm os.FileMode) error {
+	p := quotaPath(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	q := fs.parentQuota(p)
+	if err := q.charge(0, 1); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	if err := fs.fs.Mkdir(p, perm); err != nil {
+		_ = q.charge(0, -1)
+		return err
+	}
+	return nil
+}
+
+func (fs *quotaFileSystem) Remove(path string) error {
+	p := quotaPath(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	info, err := fs.fs.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if err := fs.fs.Remove(p); err != nil {
+		return err
+	}
+	fs.removed(p, info)
+	return nil
+}
+
+func (fs *quotaFileSystem) Rename(oldpath, newpath string) error {
+	o, n := quotaPath(oldpath), quotaPath(newpath)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.parentQuota(o) != fs.parentQuota(n) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	dst, dstErr := fs.fs.Lstat(n)
+	if err := Rename(fs.fs, o, n); err != nil {
+		return err
+	}
+	if o == n {
+		return nil
+	}
+	if dstErr == nil {
+		fs.removed(n, dst)
+	}
+	fs.moved(o, n)
+	return nil
+}
+
+func (fs *quotaFileSystem) Truncate(name string, size int64) error {
+	p := quotaPath(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	info, err := fs.fs.Stat(p)
+	if err != nil {
+		return err
+	}
+	e := fs.entry(p, info.Size())
+	defer func() {
+		if e.refs == 0 {
+			delete(fs.files, p)
+		}
+	}()
+	return e.truncate(name, size, func() error {
+		return Truncate(fs.fs, p, size)
+	})
+}
+
+func (fs *quotaFileSystem) Link(oldname, newname string) error {
+	o, n := quotaPath(oldname), quotaPath(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	info, err := fs.fs.Lstat(o)
+	if err != nil {
+		return err
+	}
+	q := fs.parentQuota(n)
+	if fs.parentQuota(o) != q {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+	if err := q.charge(info.Size(), 1); err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	if err := Link(fs.fs, o, n); err != nil {
+		_ = q.charge(-info.Size(), -1)
+		return err
+	}
+	return nil
+}
+
+func (fs *quotaFileSystem) Symlink(oldname, newname string) error {
+	n := quotaPath(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	q := fs.parentQuota(n)
+	size := int64(len(oldname))
+	if err := q.charge(size, 1); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	if err := Symlink(fs.fs, oldname, n); err != nil {
+		_ = q.charge(-size, -1)
+		return err
+	}
+	return nil
+}
+
+func (fs *quotaFileSystem) Readlink(name string) (string, error) {
+	return Readlink(fs.fs, name)
+}
+
+func (fs *quotaFileSystem) CreateAtomic(path string, perm os.FileMode) (AtomicFile, error) {
+	p := quotaPath(path)
+	fs.mu.Lock()
+	q := fs.parentQuota(p)
+	fs.mu.Unlock()
+	if err := q.charge(0, 1); err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	f, err := CreateAtomic(fs.fs, p, perm)
+	if err != nil {
+		_ = q.charge(0, -1)
+		return nil, err
+	}
+	h := &quotaFile{WFile: f, fs: fs, e: &quotaEntry{q: q}, path: p}
+	return &quotaAtomicFile{quotaFile: h, f: f}, nil
+}
+
+func (fs *quotaFileSystem) Chmod(name string, mode os.FileMode) error {
+	return Chmod(fs.fs, name, mode)
+}
+
+func (fs *quotaFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return Chtimes(fs.fs, name, atime, mtime)
+}
+
+func (fs *quotaFileSystem) Chown(name string, uid, gid int) error {
+	return Chown(fs.fs, name, uid, gid)
+}
+
+func (fs *quotaFileSystem) Getxattr(path string, name string) ([]byte, error) {
+	return Getxattr(fs.fs, path, name)
+}
+
+func (fs *quotaFileSystem) Setxattr(path string, name string, value []byte) error {
+	return Setxattr(fs.fs, path, name, value)
+}
+
+func (fs *quotaFileSystem) Listxattr(path string) ([]string, error) {
+	return Listxattr(fs.fs, path)
+}
+
+func (fs *quotaFileSystem) Removexattr(path string, name string) error {
+	return Removexattr(fs.fs, path, name)
+}
+
+// StatFS returns the stats of the underlying VFS, with the capacity
+// reduced to the limits of the whole file system.
+func (fs *quotaFileSystem) StatFS() (*FSStats, error) {
+	fs.mu.Lock()
+	root := fs.quotas["/"]
+	fs.mu.Unlock()
+	st, err := StatFS(fs.fs)
+	if errors.Is(err, errors.ErrUnsupported) {
+		info := root.info()
+		st, err = &FSStats{UsedBytes: info.Bytes, UsedInodes: info.Files}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	root.limit(st)
+	return st, nil
+}
+
+// SetQuota implements QuotaVFS. The usage of a new subtree is counted
+// by walking it.
+func (fs *quotaFileSystem) SetQuota(path string, limits QuotaLimits) error {
+	p := quotaPath(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if q, ok := fs.quotas[p]; ok {
+		q.setLimits(limits)
+		return nil
+	}
+	info, err := fs.fs.Stat(p)
+	if err != nil {
+		return &os.PathError{Op: "setquota", Path: path, Err: err}
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "setquota", Path: path, Err: syscall.ENOTDIR}
+	}
+	parent := fs.quota(p)
+	q := &quota{parent: parent, limits: limits}
+	err = Walk(fs.fs, p, func(_ VFS, _ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		q.files++
+		if !info.IsDir() {
+			q.bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	below := func(k string) bool {
+		return k == p || p == "/" || strings.HasPrefix(k, p+"/")
+	}
+	quotaMu.Lock()
+	for k, v := range fs.quotas {
+		if v.parent == parent && below(k) {
+			v.parent = q
+		}
+	}
+	quotaMu.Unlock()
+	for k, e := range fs.files {
+		if below(k) {
+			e.mu.Lock()
+			if e.q == parent {
+				e.q = q
+			}
+			e.mu.Unlock()
+		}
+	}
+	fs.quotas[p] = q
+	return nil
+}
+
+func (fs *quotaFileSystem) QuotaUsage(path string) (*QuotaInfo, error) {
+	fs.mu.Lock()
+	q := fs.quotas[quotaPath(path)]
+	fs.mu.Unlock()
+	if q == nil {
+		return nil, &os.PathError{Op: "quota", Path: path, Err: errNoQuota}
+	}
+	return q.info(), nil
+}
+
+func (fs *quotaFileSystem) String() string {
+	return fmt.Sprintf("Quota %s", fs.fs)
+}
+
+// quotaFile is a handle opened for writing by quotaFileSystem. The
+// optional interfaces return an error wrapping errors.ErrUnsupported
+// if the underlying handle does not implement them.
+type quotaFile struct {
+	WFile
+	fs     *quotaFileSystem
+	e      *quotaEntry
+	path   string
+	append bool
+	closed bool
+}
+
+func (f *quotaFile) unsupported(op string) error {
+	return &os.PathError{Op: op, Path: f.path, Err: errors.ErrUnsupported}
+}
+
+func (f *quotaFile) Write(p []byte) (int, error) {
+	f.e.mu.Lock()
+	defer f.e.mu.Unlock()
+	off := f.e.size
+	if !f.append {
+		var err error
+		if off, err = f.WFile.Seek(0, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+	}
+	return f.e.write(f.path, off, len(p), func() (int, error) {
+		return f.WFile.Write(p)
+	})
+}
+
+func (f *quotaFile) WriteAt(p []byte, off int64) (int, error) {
+	w, ok := f.WFile.(io.WriterAt)
+	if !ok {
+		return 0, f.unsupported("writeat")
+	}
+	f.e.mu.Lock()
+	defer f.e.mu.Unlock()
+	return f.e.write(f.path, off, len(p), func() (int, error) {
+		return w.WriteAt(p, off)
+	})
+}
+
+func (f *quotaFile) ReadAt(p []byte, off int64) (int, error) {
+	if r, ok := f.WFile.(io.ReaderAt); ok {
+		return r.ReadAt(p, off)
+	}
+	return 0, f.unsupported("readat")
+}
+
+func (f *quotaFile) Truncate(size int64) error {
+	t, ok := f.WFile.(FileTruncater)
+	if !ok {
+		return f.unsupported("truncate")
+	}
+	return f.e.truncate(f.path, size, func() error {
+		return t.Truncate(size)
+	})
+}
+
+func (f *quotaFile) Sync() error {
+	if s, ok := f.WFile.(FileSyncer); ok {
+		return s.Sync()
+	}
+	return f.unsupported("sync")
+}
+
+func (f *quotaFile) Stat() (os.FileInfo, error) {
+	if s, ok := f.WFile.(FileStater); ok {
+		return s.Stat()
+	}
+	return nil, f.unsupported("stat")
+}
+
+func (f *quotaFile) Name() string {
+	if n, ok := f.WFile.(FileNamer); ok {
+		return n.Name()
+	}
+	return f.path
+}
+
+func (f *quotaFile) Lock(exclusive bool) error {
+	if l, ok := f.WFile.(Locker); ok {
+		return l.Lock(exclusive)
+	}
+	return f.unsupported("flock")
+}
+
+func (f *quotaFile) TryLock(exclusive bool) (bool, error) {
+	if l, ok := f.WFile.(Locker); ok {
+		return l.TryLock(exclusive)
+	}
+	return false, f.unsupported("flock")
+}
+
+func (f *quotaFile) Unlock() error {
+	if l, ok := f.WFile.(Locker); ok {
+		return l.Unlock()
+	}
+	return f.unsupported("flock")
+}
+
+func (f *quotaFile) Close() error {
+	err := f.WFile.Close()
+	if !f.closed {
+		f.closed = true
+		f.fs.closed(f.path, f.e)
+	}
+	return err
+}
+
+// quotaAtomicFile is the AtomicFile returned by quotaFileSystem. The
+// new file is charged to the quota of its directory until it's
+// aborted, while the one it replaces is released once committed.
+type quotaAtomicFile struct {
+	*quotaFile
+	f    AtomicFile
+	done bool
+}
+
+func (f *quotaAtomicFile) Commit() error {
+	if f.done {
+		return f.f.Commit()
+	}
+	f.done = true
+	fs := f.fs
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	old, oldErr := fs.fs.Lstat(f.path)
+	if err := f.f.Commit(); err != nil {
+		f.abort()
+		return err
+	}
+	if oldErr == nil {
+		fs.removed(f.path, old)
+	}
+	return nil
+}
+
+func (f *quotaAtomicFile) Abort() error {
+	if f.done {
+		return f.f.Abort()
+	}
+	f.done = true
+	err := f.f.Abort()
+	f.abort()
+	return err
+}
+
+// abort releases the space charged for the new file.
+func (f *quotaAtomicFile) abort() {
+	f.e.mu.Lock()
+	_ = f.e.q.charge(-f.e.size, -1)
+	f.e.mu.Unlock()
+}
+
+func (f *quotaAtomicFile) Close() error {
+	return f.Abort()
+}
+
+// Quota returns a QuotaVFS wrapping fs, which limits the space and the
+// number of entries in fs, as well as in the subtrees with limits set
+// with SetQuota. Operations which would exceed them fail with
+// ErrQuotaExceeded. If fs implements QuotaVFS itself, like the in-memory
+// file systems do, the limits are set on its root and fs is returned.
+//
+// Otherwise, the current usage is counted by walking fs, and then kept
+// up to date by the wrapper, so fs must not be modified bypassing it.
+// Unlike with the in-memory file systems, hard links are counted as
+// separate files.
+func Quota(fs VFS, limits QuotaLimits) (QuotaVFS, error) {
+	if q, ok := fs.(QuotaVFS); ok {
+		err := q.SetQuota("/", limits)
+		if err == nil {
+			return q, nil
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return nil, err
+		}
+	}
+	q := &quotaFileSystem{
+		fs:     fs,
+		quotas: make(map[string]*quota),
+		files:  make(map[string]*quotaEntry),
+	}
+	if err := q.SetQuota("/", limits); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
@@ -0,0 +1,227 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func checkQuota(t *testing.T, fs VFS, path string, bytes int64, files int64) {
+	t.Helper()
+	info, err := QuotaUsage(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Bytes != bytes || info.Files != files {
+		t.Errorf("usage of %s = %d bytes and %d files, want %d and %d", path, info.Bytes, info.Files, bytes, files)
+	}
+}
+
+func isQuotaExceeded(err error) bool {
+	return errors.Is(err, ErrQuotaExceeded) && errors.Is(err, syscall.ENOSPC)
+}
+
+func testQuota(t *testing.T, fs VFS) {
+	data := bytes.Repeat([]byte("a"), 60)
+	qfs, err := Quota(fs, QuotaLimits{Bytes: 100, Files: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(qfs, "a", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(qfs, "b", data, 0644); !isQuotaExceeded(err) {
+		t.Errorf("exceeding the bytes limit returned %v, want ErrQuotaExceeded", err)
+	}
+	checkQuota(t, qfs, "/", 60, 3)
+	if err := qfs.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := qfs.Mkdir("d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetQuota(qfs, "d", QuotaLimits{Bytes: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(qfs, "d/x", data[:20], 0644); !isQuotaExceeded(err) {
+		t.Errorf("exceeding the subtree limit returned %v, want ErrQuotaExceeded", err)
+	}
+	if err := WriteFile(qfs, "d/x", data[:5], 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, qfs, "d", 5, 2)
+	checkQuota(t, qfs, "/", 65, 4)
+	if err := Rename(qfs, "d/x", "x"); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("renaming out of a subtree with a quota returned %v, want EXDEV", err)
+	}
+	if err := Rename(qfs, "d", "e"); err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, qfs, "e", 5, 2)
+	if err := WriteFile(qfs, "f", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := qfs.OpenFile("g", os.O_WRONLY|os.O_CREATE, 0644); !isQuotaExceeded(err) {
+		t.Errorf("exceeding the files limit with OpenFile returned %v, want ErrQuotaExceeded", err)
+	}
+	if err := qfs.Mkdir("g", 0755); !isQuotaExceeded(err) {
+		t.Errorf("exceeding the files limit with Mkdir returned %v, want ErrQuotaExceeded", err)
+	}
+	if err := Truncate(qfs, "a", 10); err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, qfs, "/", 15, 5)
+	// The new file is counted until it replaces the old one
+	if err := WriteFileAtomic(qfs, "a", data[:30], 0644); !isQuotaExceeded(err) {
+		t.Errorf("exceeding the files limit atomically returned %v, want ErrQuotaExceeded", err)
+	}
+	if err := qfs.Remove("f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(qfs, "a", data[:30], 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, qfs, "/", 35, 4)
+	if err := WriteFileAtomic(qfs, "a", bytes.Repeat(data, 2), 0644); !isQuotaExceeded(err) {
+		t.Errorf("exceeding the bytes limit atomically returned %v, want ErrQuotaExceeded", err)
+	}
+	checkQuota(t, qfs, "/", 35, 4)
+	st, err := StatFS(qfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.TotalBytes != 100 || st.FreeBytes != 65 || st.TotalInodes != 5 {
+		t.Errorf("StatFS = %+v, want the capacity set by the quota", st)
+	}
+}
+
+func TestMemoryQuota(t *testing.T) {
+	testQuota(t, Memory())
+}
+
+func TestTmpFSQuota(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testQuota(t, fs)
+}
+
+func TestQuotaExistingData(t *testing.T) {
+	fs := Memory()
+	if err := WriteFile(fs, "a", make([]byte, 50), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Link(fs, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "c", bytes.Repeat([]byte("c"), 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Compress(fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetQuota(fs, "/", QuotaLimits{Bytes: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	// Hard links are counted once, and compressed files by their size
+	checkQuota(t, fs, "/", 1050, 3)
+	if err := WriteFile(fs, "d", []byte("d"), 0644); !isQuotaExceeded(err) {
+		t.Errorf("writing over the limit returned %v, want ErrQuotaExceeded", err)
+	}
+	if err := fs.Remove("c"); err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, fs, "/", 50, 3)
+}
+
+func TestMemoryQuotaOpenHandles(t *testing.T) {
+	fs := Memory()
+	if err := SetQuota(fs, "/", QuotaLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "f", make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("f"); err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, fs, "/", 10, 2)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, fs, "/", 0, 1)
+}
+
+func TestMemoryQuotaLinks(t *testing.T) {
+	fs := Memory()
+	if err := MkdirAll(fs, "d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetQuota(fs, "d", QuotaLimits{Files: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Link(fs, "f", "d/f"); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("linking into a subtree with a quota returned %v, want EXDEV", err)
+	}
+	if err := Symlink(fs, "../f", "d/f"); err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, fs, "d", 4, 2)
+	if _, err := QuotaUsage(fs, "/"); err == nil {
+		t.Error("QuotaUsage without a quota did not fail")
+	}
+	ch, err := Chroot("d", fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkQuota(t, ch, "/", 4, 2)
+}
+
+func TestMemoryQuotaConcurrentWrites(t *testing.T) {
+	fs := Memory()
+	if err := SetQuota(fs, "/", QuotaLimits{Bytes: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for ii := 0; ii < 4; ii++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer func() { _ = f.Close() }()
+			for {
+				if _, err := f.Write([]byte("0123456789")); err != nil {
+					if !isQuotaExceeded(err) {
+						t.Error(err)
+					}
+					return
+				}
+			}
+		}(string(rune('a' + ii)))
+	}
+	wg.Wait()
+	checkQuota(t, fs, "/", 1000, 5)
+	u, err := Usage(fs, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Bytes != 1000 {
+		t.Errorf("files contain %d bytes, want 1000", u.Bytes)
+	}
+}
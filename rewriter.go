@@ -1,8 +1,10 @@
 package vfs
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"time"
 )
 
 type rewriterFileSystem struct {
@@ -34,6 +36,10 @@ func (fs *rewriterFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
 	return fs.fs.ReadDir(fs.rewriter(path))
 }
 
+func (fs *rewriterFileSystem) OpenDir(path string) (DirFile, error) {
+	return OpenDir(fs.fs, fs.rewriter(path))
+}
+
 func (fs *rewriterFileSystem) Mkdir(path string, perm os.FileMode) error {
 	return fs.fs.Mkdir(fs.rewriter(path), perm)
 }
@@ -42,6 +48,88 @@ func (fs *rewriterFileSystem) Remove(path string) error {
 	return fs.fs.Remove(fs.rewriter(path))
 }
 
+func (fs *rewriterFileSystem) OpenContext(ctx context.Context, path string) (RFile, error) {
+	return AsContextVFS(fs.fs).OpenContext(ctx, fs.rewriter(path))
+}
+
+func (fs *rewriterFileSystem) OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (WFile, error) {
+	return AsContextVFS(fs.fs).OpenFileContext(ctx, fs.rewriter(path), flag, perm)
+}
+
+func (fs *rewriterFileSystem) LstatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	return AsContextVFS(fs.fs).LstatContext(ctx, fs.rewriter(path))
+}
+
+func (fs *rewriterFileSystem) StatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	return AsContextVFS(fs.fs).StatContext(ctx, fs.rewriter(path))
+}
+
+func (fs *rewriterFileSystem) ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error) {
+	return AsContextVFS(fs.fs).ReadDirContext(ctx, fs.rewriter(path))
+}
+
+func (fs *rewriterFileSystem) MkdirContext(ctx context.Context, path string, perm os.FileMode) error {
+	return AsContextVFS(fs.fs).MkdirContext(ctx, fs.rewriter(path), perm)
+}
+
+func (fs *rewriterFileSystem) RemoveContext(ctx context.Context, path string) error {
+	return AsContextVFS(fs.fs).RemoveContext(ctx, fs.rewriter(path))
+}
+
+func (fs *rewriterFileSystem) CreateAtomic(path string, perm os.FileMode) (AtomicFile, error) {
+	return CreateAtomic(fs.fs, fs.rewriter(path), perm)
+}
+
+func (fs *rewriterFileSystem) Rename(oldpath, newpath string) error {
+	return Rename(fs.fs, fs.rewriter(oldpath), fs.rewriter(newpath))
+}
+
+func (fs *rewriterFileSystem) Link(oldname, newname string) error {
+	return Link(fs.fs, fs.rewriter(oldname), fs.rewriter(newname))
+}
+
+// Symlink creates newname as a symbolic link to oldname. Only newname
+// is rewritten, the link target is stored verbatim.
+func (fs *rewriterFileSystem) Symlink(oldname, newname string) error {
+	return Symlink(fs.fs, oldname, fs.rewriter(newname))
+}
+
+func (fs *rewriterFileSystem) Readlink(name string) (string, error) {
+	return Readlink(fs.fs, fs.rewriter(name))
+}
+
+func (fs *rewriterFileSystem) Truncate(name string, size int64) error {
+	return Truncate(fs.fs, fs.rewriter(name), size)
+}
+
+func (fs *rewriterFileSystem) Chmod(name string, mode os.FileMode) error {
+	return Chmod(fs.fs, fs.rewriter(name), mode)
+}
+
+func (fs *rewriterFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return Chtimes(fs.fs, fs.rewriter(name), atime, mtime)
+}
+
+func (fs *rewriterFileSystem) Chown(name string, uid, gid int) error {
+	return Chown(fs.fs, fs.rewriter(name), uid, gid)
+}
+
+func (fs *rewriterFileSystem) Getxattr(path string, name string) ([]byte, error) {
+	return Getxattr(fs.fs, fs.rewriter(path), name)
+}
+
+func (fs *rewriterFileSystem) Setxattr(path string, name string, value []byte) error {
+	return Setxattr(fs.fs, fs.rewriter(path), name, value)
+}
+
+func (fs *rewriterFileSystem) Listxattr(path string) ([]string, error) {
+	return Listxattr(fs.fs, fs.rewriter(path))
+}
+
+func (fs *rewriterFileSystem) Removexattr(path string, name string) error {
+	return Removexattr(fs.fs, fs.rewriter(path), name)
+}
+
 func (fs *rewriterFileSystem) String() string {
 	return fmt.Sprintf("Rewriter %s", fs.fs.String())
 }
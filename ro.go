@@ -1,9 +1,11 @@
 package vfs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"time"
 )
 
 var (
@@ -25,7 +27,7 @@ func (fs *readOnlyFileSystem) Open(path string) (RFile, error) {
 }
 
 func (fs *readOnlyFileSystem) OpenFile(path string, flag int, perm os.FileMode) (WFile, error) {
-	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR) != 0 {
+	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0 {
 		return nil, ErrReadOnlyFileSystem
 	}
 	return fs.fs.OpenFile(path, flag, perm)
@@ -43,6 +45,10 @@ func (fs *readOnlyFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
 	return fs.fs.ReadDir(path)
 }
 
+func (fs *readOnlyFileSystem) OpenDir(path string) (DirFile, error) {
+	return OpenDir(fs.fs, path)
+}
+
 func (fs *readOnlyFileSystem) Mkdir(path string, perm os.FileMode) error {
 	return ErrReadOnlyFileSystem
 }
@@ -51,6 +57,89 @@ func (fs *readOnlyFileSystem) Remove(path string) error {
 	return ErrReadOnlyFileSystem
 }
 
+func (fs *readOnlyFileSystem) OpenContext(ctx context.Context, path string) (RFile, error) {
+	return AsContextVFS(fs.fs).OpenContext(ctx, path)
+}
+
+func (fs *readOnlyFileSystem) OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (WFile, error) {
+	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0 {
+		return nil, ErrReadOnlyFileSystem
+	}
+	return AsContextVFS(fs.fs).OpenFileContext(ctx, path, flag, perm)
+}
+
+func (fs *readOnlyFileSystem) LstatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	return AsContextVFS(fs.fs).LstatContext(ctx, path)
+}
+
+func (fs *readOnlyFileSystem) StatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	return AsContextVFS(fs.fs).StatContext(ctx, path)
+}
+
+func (fs *readOnlyFileSystem) ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error) {
+	return AsContextVFS(fs.fs).ReadDirContext(ctx, path)
+}
+
+func (fs *readOnlyFileSystem) MkdirContext(ctx context.Context, path string, perm os.FileMode) error {
+	return ErrReadOnlyFileSystem
+}
+
+func (fs *readOnlyFileSystem) RemoveContext(ctx context.Context, path string) error {
+	return ErrReadOnlyFileSystem
+}
+
+func (fs *readOnlyFileSystem) CreateAtomic(path string, perm os.FileMode) (AtomicFile, error) {
+	return nil, ErrReadOnlyFileSystem
+}
+
+func (fs *readOnlyFileSystem) Rename(oldpath, newpath string) error {
+	return ErrReadOnlyFileSystem
+}
+
+func (fs *readOnlyFileSystem) Link(oldname, newname string) error {
+	return ErrReadOnlyFileSystem
+}
+
+func (fs *readOnlyFileSystem) Symlink(oldname, newname string) error {
+	return ErrReadOnlyFileSystem
+}
+
+func (fs *readOnlyFileSystem) Readlink(name string) (string, error) {
+	return Readlink(fs.fs, name)
+}
+
+func (fs *readOnlyFileSystem) Truncate(name string, size int64) error {
+	return ErrReadOnlyFileSystem
+}
+
+func (fs *readOnlyFileSystem) Chmod(name string, mode os.FileMode) error {
+	return ErrReadOnlyFileSystem
+}
+
+func (fs *readOnlyFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return ErrReadOnlyFileSystem
+}
+
+func (fs *readOnlyFileSystem) Chown(name string, uid, gid int) error {
+	return ErrReadOnlyFileSystem
+}
+
+func (fs *readOnlyFileSystem) Getxattr(path string, name string) ([]byte, error) {
+	return Getxattr(fs.fs, path, name)
+}
+
+func (fs *readOnlyFileSystem) Setxattr(path string, name string, value []byte) error {
+	return ErrReadOnlyFileSystem
+}
+
+func (fs *readOnlyFileSystem) Listxattr(path string) ([]string, error) {
+	return Listxattr(fs.fs, path)
+}
+
+func (fs *readOnlyFileSystem) Removexattr(path string, name string) error {
+	return ErrReadOnlyFileSystem
+}
+
 func (fs *readOnlyFileSystem) String() string {
 	return fmt.Sprintf("RO %s", fs.fs.String())
 }
@@ -0,0 +1,456 @@
+package vfs
+
+import (
+	"maps"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// versions keeps track of the generations of the tree of an in-memory
+// file system. Taking a snapshot ends the current generation, and the
+// entries modified afterwards keep a frozen copy of the state seen by
+// the snapshots which are still alive. Its lock is always acquired
+// after the locks of the entries.
+type versions struct {
+	mu sync.Mutex
+	// gen is the current generation
+	gen uint64
+	// live is the number of alive snapshots of each generation
+	live map[uint64]int
+	// kept contains the histories with previous states, which
+	// are pruned when the snapshots seeing them are released
+	kept map[*history]struct{}
+}
+
+// pin ends the current generation, returning it. The versions seen
+// by it are kept until unpin is called.
+func (v *versions) pin() uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.live == nil {
+		v.live = make(map[uint64]int)
+	}
+	gen := v.gen
+	v.live[gen]++
+	v.gen++
+	return gen
+}
+
+// retain keeps the versions seen by gen, which must be pinned, until
+// unpin is called once more.
+func (v *versions) retain(gen uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.live[gen]++
+}
+
+func (v *versions) unpin(gen uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.live[gen]--; v.live[gen] == 0 {
+		delete(v.live, gen)
+		for h := range v.kept {
+			h.prune()
+		}
+	}
+}
+
+// seen returns whether an alive snapshot sees a state which lasted
+// from generation from until to, excluded. It must be called with
+// the lock held.
+func (v *versions) seen(from, to uint64) bool {
+	for gen := range v.live {
+		if gen >= from && gen < to {
+			return true
+		}
+	}
+	return false
+}
+
+// version is the frozen state of an entry since generation gen.
+type version struct {
+	gen   uint64
+	entry Entry
+}
+
+// history contains the versions of an entry still seen by snapshots.
+// The entries copied by freeze have no history, since they're never
+// modified. gen and old are protected by the lock of versions.
+type history struct {
+	// versions is set once the entry is added to a directory
+	versions *versions
+	// gen is the generation the current state comes from
+	gen uint64
+	// old contains the previous states, oldest first
+	old []version
+}
+
+// adopt sets the versions of a new entry added to a directory
+// tracked by v.
+func (h *history) adopt(v *versions) {
+	if h.versions == nil && v != nil {
+		v.mu.Lock()
+		h.versions, h.gen = v, v.gen
+		v.mu.Unlock()
+	}
+}
+
+// frozen returns whether the current state has already been copied.
+func (h *history) frozen() bool {
+	n := len(h.old)
+	return n > 0 && h.old[n-1].gen == h.gen
+}
+
+// preserve must be called with the lock of the entry held for writing
+// before modifying it. If a snapshot sees its current state, it's
+// copied with freeze, and the versions no longer seen are dropped.
+func (h *history) preserve(freeze func() (Entry, error)) error {
+	v := h.versions
+	if v == nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h.gen != v.gen {
+		if v.seen(h.gen, v.gen) && !h.frozen() {
+			e, err := freeze()
+			if err != nil {
+				return err
+			}
+			h.keep(e)
+		}
+		h.gen = v.gen
+	}
+	h.prune()
+	return nil
+}
+
+// keep adds the frozen copy of the current state. It must be called
+// with the lock of versions held.
+func (h *history) keep(e Entry) {
+	if len(h.old) == 0 {
+		if h.versions.kept == nil {
+			h.versions.kept = make(map[*history]struct{})
+		}
+		h.versions.kept[h] = struct{}{}
+	}
+	h.old = append(h.old, version{gen: h.gen, entry: e})
+}
+
+// prune drops the versions no longer seen by any snapshot. The last
+// one lasts until the current generation, since the entry has not been
+// modified since then. It must be called with the lock of versions
+// held.
+func (h *history) prune() {
+	if len(h.old) == 0 {
+		return
+	}
+	v := h.versions
+	kept := h.old[:0]
+	for ii, o := range h.old {
+		end := v.gen
+		if ii+1 < len(h.old) {
+			end = h.old[ii+1].gen
+		}
+		if v.seen(o.gen, end) {
+			kept = append(kept, o)
+		}
+	}
+	clear(h.old[len(kept):])
+	if len(kept) == 0 {
+		kept = nil
+		delete(v.kept, h)
+	}
+	h.old = kept
+}
+
+// at returns the state of the entry seen at generation gen, copying
+// it with freeze if it's the current one, or nil if the entry did not
+// exist yet. It must be called with the lock of the entry held.
+func (h *history) at(gen uint64, freeze func() (Entry, error)) (Entry, error) {
+	v := h.versions
+	if v == nil {
+		return nil, nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h.gen <= gen {
+		if !h.frozen() {
+			e, err := freeze()
+			if err != nil {
+				return nil, err
+			}
+			h.keep(e)
+		}
+		return h.old[len(h.old)-1].entry, nil
+	}
+	for ii := len(h.old) - 1; ii >= 0; ii-- {
+		if h.old[ii].gen <= gen {
+			return h.old[ii].entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// freeze returns a copy of f sharing its data, which is never modified.
+// Spilled data is shared too, and f copies it before writing it. It must
+// be called with the lock of f held.
+func (f *File) freeze() (Entry, error) {
+	c := &File{
+		Data:       f.Data,
+		Mode:       f.Mode,
+		ModTime:    f.ModTime,
+		Uid:        f.Uid,
+		Gid:        f.Gid,
+		Xattrs:     maps.Clone(f.Xattrs),
+		Uname:      f.Uname,
+		Gname:      f.Gname,
+		PAXRecords: maps.Clone(f.PAXRecords),
+		links:      f.links,
+		source:     f.source,
+	}
+	switch {
+	case f.spill != nil:
+		c.spill = f.spill.share()
+	case f.pages != nil:
+		// Compressed files with open handles have their
+		// current data in pages, and Data is stale.
+		c.pages = f.pages.clone()
+		c.Data = nil
+	}
+	return c, nil
+}
+
+// freeze returns a copy of d, which is never modified. It must be
+// called with the lock of d held.
+func (d *Dir) freeze() (Entry, error) {
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return &Dir{
+		Mode:       d.Mode,
+		ModTime:    d.ModTime,
+		Uid:        d.Uid,
+		Gid:        d.Gid,
+		Xattrs:     maps.Clone(d.Xattrs),
+		Uname:      d.Uname,
+		Gname:      d.Gname,
+		PAXRecords: maps.Clone(d.PAXRecords),
+		EntryNames: slices.Clone(d.EntryNames),
+		Entries:    slices.Clone(d.Entries),
+	}, nil
+}
+
+// preserve calls the preserve method of the history of entry, which
+// must be locked for writing.
+func preserve(entry Entry) error {
+	switch e := entry.(type) {
+	case *File:
+		return e.hist.preserve(e.freeze)
+	case *Dir:
+		return e.hist.preserve(e.freeze)
+	}
+	return nil
+}
+
+// snapshot is set for the memoryFileSystem of a snapshot, which sees
+// the tree as it was at generation gen.
+type snapshot struct {
+	versions *versions
+	gen      uint64
+	// cleanup unpins gen once the snapshot is garbage collected
+	cleanup runtime.Cleanup
+}
+
+// view returns entry as seen by fs. For snapshots, it's a frozen copy
+// of its state at their generation, and entry itself otherwise.
+func (fs *memoryFileSystem) view(entry Entry) (Entry, error) {
+	if fs.snap == nil {
+		return entry, nil
+	}
+	var v Entry
+	var err error
+	switch e := entry.(type) {
+	case *File:
+		e.RLock()
+		v, err = e.hist.at(fs.snap.gen, e.freeze)
+		e.RUnlock()
+	case *Dir:
+		e.RLock()
+		v, err = e.hist.at(fs.snap.gen, e.freeze)
+		e.RUnlock()
+	}
+	if v == nil && err == nil {
+		return entry, nil
+	}
+	return v, err
+}
+
+// top returns the root directory as seen by fs.
+func (fs *memoryFileSystem) top() (*Dir, error) {
+	root, err := fs.view(fs.root)
+	if err != nil {
+		return nil, err
+	}
+	return root.(*Dir), nil
+}
+
+// Snapshot returns a read-only VFS with the current contents of fs, which
+// are not affected by its later changes. It takes constant time, since the
+// tree is shared, and the entries modified afterwards keep a copy of their
+// previous state while the snapshot is alive. Snapshots are released when
+// they're garbage collected.
+func (fs *memoryFileSystem) Snapshot() (VFS, error) {
+	return ReadOnly(fs.snapshot()), nil
+}
+
+func (fs *memoryFileSystem) snapshot() *memoryFileSystem {
+	// Prevent namespace changes while the generation ends, so the
+	// snapshot does not see any of them halfway.
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	snap := &snapshot{versions: fs.versions}
+	if fs.snap != nil {
+		// Snapshots of a snapshot see the same generation
+		snap.gen = fs.snap.gen
+		fs.versions.retain(snap.gen)
+	} else {
+		snap.gen = fs.versions.pin()
+	}
+	s := &memoryFileSystem{
+		root:     fs.root,
+		umask:    fs.umask,
+		versions: fs.versions,
+		snap:     snap,
+	}
+	snap.cleanup = runtime.AddCleanup(s, func(snap *snapshot) {
+		snap.versions.unpin(snap.gen)
+	}, s.snap)
+	return s
+}
+
+// release unpins the generation of a snapshot returned by snapshot
+// without waiting for it to be garbage collected, so the versions kept
+// for it are dropped. The snapshot must not be used afterwards.
+func (fs *memoryFileSystem) release() {
+	fs.snap.cleanup.Stop()
+	fs.snap.versions.unpin(fs.snap.gen)
+}
+
+// Fork returns a writable copy of fs, independent from it. It takes
+// constant time too: the directories of the copy are copied from a
+// snapshot of fs the first time they're used, and the files share their
+// data with fs until they're written. Like Memory, the copy keeps all
+// its data in memory, and it has no quotas.
+func (fs *memoryFileSystem) Fork() (VFS, error) {
+	snap := fs.snapshot()
+	root, err := snap.top()
+	if err != nil {
+		return nil, err
+	}
+	f := newMemory()
+	f.umask = snap.umask
+	f.root = (&forkSource{snap: snap}).dir(root, f.versions)
+	return f, nil
+}
+
+// forkSource is the snapshot the directories of a Fork are copied from.
+type forkSource struct {
+	snap *memoryFileSystem
+	mu   sync.Mutex
+	// files maps the files of the snapshot to their copies,
+	// so hard links are preserved
+	files map[*File]*File
+}
+
+// lazyDir is the source of a directory created by Fork, whose entries
+// are copied the first time they're used.
+type lazyDir struct {
+	once sync.Once
+	src  *forkSource
+	// dir is the frozen directory to copy from
+	dir *Dir
+	err error
+}
+
+// dir returns a copy of the frozen directory d, whose entries
+// are loaded on demand.
+func (s *forkSource) dir(d *Dir, v *versions) *Dir {
+	return &Dir{
+		Mode:       d.Mode,
+		ModTime:    d.ModTime,
+		Uid:        d.Uid,
+		Gid:        d.Gid,
+		Xattrs:     maps.Clone(d.Xattrs),
+		Uname:      d.Uname,
+		Gname:      d.Gname,
+		PAXRecords: maps.Clone(d.PAXRecords),
+		lazy:       &lazyDir{src: s, dir: d},
+		hist:       history{versions: v},
+	}
+}
+
+// file returns the copy of the frozen file f.
+func (s *forkSource) file(f *File, v *versions) (*File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.files[f]; ok {
+		return c, nil
+	}
+	// Cloning the pages marks them as shared
+	f.Lock()
+	e, err := f.freeze()
+	f.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	c := e.(*File)
+	c.links = 0
+	c.hist.versions = v
+	if s.files == nil {
+		s.files = make(map[*File]*File)
+	}
+	s.files[f] = c
+	return c, nil
+}
+
+// load copies the entries of a directory created by Fork the first
+// time they're used. It must be called with the lock of d held, before
+// using EntryNames or Entries.
+func (d *Dir) load() error {
+	if d.lazy == nil {
+		return nil
+	}
+	l := d.lazy
+	l.once.Do(func() {
+		src := l.dir
+		names := slices.Clone(src.EntryNames)
+		entries := make([]Entry, len(src.Entries))
+		for ii, e := range src.Entries {
+			v, err := l.src.snap.view(e)
+			if err != nil {
+				l.err = err
+				return
+			}
+			switch v := v.(type) {
+			case *Dir:
+				entries[ii] = l.src.dir(v, d.hist.versions)
+			case *File:
+				c, err := l.src.file(v, d.hist.versions)
+				if err != nil {
+					l.err = err
+					return
+				}
+				link(c, 1)
+				entries[ii] = c
+			default:
+				entries[ii] = v
+			}
+		}
+		d.EntryNames, d.Entries = names, entries
+		// Release the snapshot once everything is copied
+		l.src, l.dir = nil, nil
+	})
+	return l.err
+}
@@ -0,0 +1,379 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func checkContents(t *testing.T, fs VFS, path string, want string) {
+	t.Helper()
+	data, err := ReadFile(fs, path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != want {
+		t.Errorf("%s in %s contains %q, want %q", path, fs, data, want)
+	}
+}
+
+func snapshotFixture(t *testing.T, fs VFS) WFile {
+	if err := MkdirAll(fs, "a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"a/f": "f", "a/b/g": "g", "c": "c"} {
+		if err := WriteFile(fs, name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Link(fs, "a/f", "a/b/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(fs, "a/f", "sym"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("c", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestMemorySnapshot(t *testing.T) {
+	fs := Memory()
+	h := snapshotFixture(t, fs)
+	defer func() { _ = h.Close() }()
+	snap, err := Snapshot(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Write([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "a/b/link", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rename(fs, "a/b", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Chmod(fs, "a", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := Setxattr(fs, "a/f", "user.x", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, fs, "a/f", "changed")
+	checkContents(t, fs, "c", "cc")
+	checkContents(t, snap, "a/f", "f")
+	checkContents(t, snap, "a/b/link", "f")
+	checkContents(t, snap, "a/b/g", "g")
+	checkContents(t, snap, "sym", "f")
+	checkContents(t, snap, "c", "c")
+	infos, err := snap.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range infos {
+		names = append(names, v.Name())
+	}
+	if len(names) != 3 || names[0] != "a" || names[1] != "c" || names[2] != "sym" {
+		t.Errorf("snapshot contains %v, want [a c sym]", names)
+	}
+	st, err := snap.Stat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0755 {
+		t.Errorf("snapshot mode = %s, want 0755", st.Mode())
+	}
+	if _, err := Getxattr(snap, "a/f", "user.x"); !errors.Is(err, ErrNoXattr) {
+		t.Errorf("Getxattr on snapshot = %v, want ErrNoXattr", err)
+	}
+	u, err := Usage(snap, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Files != 5 || u.Dirs != 3 || u.Bytes != int64(len("fgca/f")) {
+		t.Errorf("snapshot usage = %+v, want 5 files, 3 dirs and 6 bytes", u)
+	}
+	fork, err := Fork(snap.(Container).VFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, fork, "a/b/link", "f")
+	if err := WriteFile(snap, "c", nil, 0644); err == nil {
+		t.Error("writing to a snapshot did not fail")
+	}
+}
+
+func TestMemorySnapshotHistory(t *testing.T) {
+	fs := newMemory()
+	if err := WriteFile(fs, "f", []byte("0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var snaps []VFS
+	for _, data := range []string{"1", "2", "3"} {
+		snap, err := fs.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		snaps = append(snaps, snap)
+		if err := WriteFile(fs, "f", []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for ii, snap := range snaps {
+		checkContents(t, snap, "f", string(rune('0'+ii)))
+	}
+	runtime.KeepAlive(snaps)
+	snaps = nil
+	waitSnapshotsReleased(t, fs)
+	// The versions are dropped when the snapshots are released,
+	// without waiting for the next change
+	f, _, _, err := fs.entry("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.versions.mu.Lock()
+	n, kept := len(f.(*File).hist.old), len(fs.versions.kept)
+	fs.versions.mu.Unlock()
+	if n != 0 || kept != 0 {
+		t.Errorf("file keeps %d versions and %d entries keep any after releasing the snapshots, want 0", n, kept)
+	}
+}
+
+// waitSnapshotsReleased waits for the cleanups of the snapshots of fs
+// which are no longer reachable, which run in the background after a GC.
+func waitSnapshotsReleased(t *testing.T, fs *memoryFileSystem) {
+	t.Helper()
+	for ii := 0; ; ii++ {
+		runtime.GC()
+		fs.versions.mu.Lock()
+		live := len(fs.versions.live)
+		fs.versions.mu.Unlock()
+		if live == 0 {
+			return
+		}
+		if ii == 100 {
+			t.Fatalf("%d snapshots still alive after being released", live)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMemoryFork(t *testing.T) {
+	fs := Memory()
+	compressed := bytes.Repeat([]byte("z"), 10000)
+	if err := WriteFile(fs, "z", compressed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Compress(fs); err != nil {
+		t.Fatal(err)
+	}
+	h := snapshotFixture(t, fs)
+	defer func() { _ = h.Close() }()
+	fork, err := Fork(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Write([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fork, "a/b/link", []byte("fork"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveAll(fork, "c"); err != nil {
+		t.Fatal(err)
+	}
+	// Hard links are kept in the fork
+	checkContents(t, fork, "a/f", "fork")
+	checkContents(t, fork, "sym", "fork")
+	checkContents(t, fork, "a/b/g", "g")
+	checkContents(t, fork, "z", string(compressed))
+	if _, err := fork.Stat("c"); !IsNotExist(err) {
+		t.Errorf("removed file in fork returned %v, want not exist", err)
+	}
+	checkContents(t, fs, "a/f", "f")
+	checkContents(t, fs, "c", "cc")
+	fork2, err := Fork(fork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fork, "a/f", []byte("again"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, fork2, "a/b/link", "fork")
+	checkContents(t, fork, "a/b/link", "again")
+	ch, err := Chroot("a", fork2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := Snapshot(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, snap, "b/g", "g")
+	if _, err := Fork(&errOpenVFS{VFS: Memory()}); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Fork on unsupported VFS = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestHybridSnapshot(t *testing.T) {
+	spill, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := Hybrid(10, spill)
+	defer func() { _ = fs.Close() }()
+	if err := WriteFile(fs, "big", bytes.Repeat([]byte("b"), 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := Snapshot(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("big"); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, snap, "big", string(bytes.Repeat([]byte("b"), 100)))
+}
+
+func TestHybridSnapshotSharesSpill(t *testing.T) {
+	spill, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := Hybrid(10, spill)
+	defer func() { _ = fs.Close() }()
+	mem := fs.(*hybridFileSystem).memoryFileSystem
+	data := string(bytes.Repeat([]byte("b"), 100))
+	if err := WriteFile(fs, "big", []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := Snapshot(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reading through the snapshot does not copy the data
+	checkContents(t, snap, "big", data)
+	if n := fs.InMemory(); n != 0 {
+		t.Errorf("InMemory after reading a snapshot = %d, want 0", n)
+	}
+	f, _, _, err := mem.entry("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.versions.mu.Lock()
+	for _, o := range f.(*File).hist.old {
+		if c := o.entry.(*File); c.spill == nil || c.Data != nil {
+			t.Error("frozen copy of a spilled file does not share its spilled data")
+		}
+	}
+	mem.versions.mu.Unlock()
+	// Writing copies the data in the spill VFS
+	if err := WriteFile(fs, "big", bytes.Repeat([]byte("c"), 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, snap, "big", data)
+	if n := spilledFiles(t, spill); n != 2 {
+		t.Errorf("%d files spilled after writing a shared file, want 2", n)
+	}
+	runtime.KeepAlive(snap)
+	snap = nil
+	waitSnapshotsReleased(t, mem)
+	// The copy is removed once the frozen copy is collected
+	for ii := 0; spilledFiles(t, spill) != 1; ii++ {
+		if ii == 100 {
+			t.Fatalf("%d files spilled after releasing the snapshot, want 1", spilledFiles(t, spill))
+		}
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	checkContents(t, fs, "big", string(bytes.Repeat([]byte("c"), 100)))
+}
+
+func TestHybridForkSpilled(t *testing.T) {
+	spill, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := Hybrid(10, spill)
+	defer func() { _ = fs.Close() }()
+	data := string(bytes.Repeat([]byte("b"), 100))
+	if err := WriteFile(fs, "big", []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fork, err := Fork(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fork.OpenFile("big", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("fork")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, fork, "big", data+"fork")
+	checkContents(t, fs, "big", data)
+}
+
+func TestMemorySnapshotConcurrent(t *testing.T) {
+	fs := Memory()
+	if err := WriteFile(fs, "f", make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f, err := fs.OpenFile("f", os.O_WRONLY, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer func() { _ = f.Close() }()
+		for ii := byte(0); ; ii++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := f.(io.WriterAt).WriteAt(bytes.Repeat([]byte{ii}, 10), 0); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for ii := 0; ii < 100; ii++ {
+		snap, err := Snapshot(fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ReadFile(snap, "f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every write replaces all the data, so snapshots
+		// must never see a mix of two of them.
+		if !bytes.Equal(data, bytes.Repeat(data[:1], 10)) {
+			t.Fatalf("snapshot contains %v, which was never written", data)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,264 @@
+package vfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+)
+
+// FSStats contains the capacity and usage of a file system, as
+// returned by StatFS. File systems without a fixed capacity, like
+// the in-memory ones, report zero TotalBytes, FreeBytes, TotalInodes
+// and FreeInodes.
+type FSStats struct {
+	// TotalBytes is the size of the file system.
+	TotalBytes int64
+	// FreeBytes is the space available for new data.
+	FreeBytes int64
+	// UsedBytes is the space used by the stored data.
+	UsedBytes int64
+	// TotalInodes is the maximum number of files and directories.
+	TotalInodes int64
+	// FreeInodes is the number of files and directories which
+	// might still be created.
+	FreeInodes int64
+	// UsedInodes is the number of files and directories.
+	UsedInodes int64
+	// id identifies the storage described by the stats, so the
+	// Mounter counts it once, or it's nil if it's unknown.
+	id any
+}
+
+// StatFS returns the capacity and usage of the given fs. If fs does not
+// implement FSStater, an error wrapping errors.ErrUnsupported is returned.
+func StatFS(fs VFS) (*FSStats, error) {
+	if s, ok := fs.(FSStater); ok {
+		return s.StatFS()
+	}
+	return nil, unsupported("statfs", fs)
+}
+
+// DiskUsage is the space used by a tree, as returned by Usage.
+type DiskUsage struct {
+	// Bytes is the logical size of the files, as read
+	// from them.
+	Bytes int64
+	// StoredBytes is the space used to store the files. It's
+	// smaller than Bytes for compressed and sparse files, and
+	// it's rounded up to whole blocks for on-disk files.
+	StoredBytes int64
+	// Files is the number of files, including symlinks.
+	Files int64
+	// Dirs is the number of directories, including the root
+	// of the tree.
+	Dirs int64
+}
+
+// Usage walks the tree at path in the given fs, returning the space used
+// by its files, much like du. Files with several hard links are only
+// counted once when fs allows detecting them, like the in-memory and
+// the on-disk file systems do. The space used by the directories
+// themselves is not counted.
+func Usage(fs VFS, path string) (*DiskUsage, error) {
+	u := &DiskUsage{}
+	seen := make(map[any]struct{})
+	err := Walk(fs, path, func(fs VFS, p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			u.Dirs++
+			return nil
+		}
+		u.Files++
+		if id, ok := fileID(info); ok {
+			if _, dup := seen[id]; dup {
+				return nil
+			}
+			seen[id] = struct{}{}
+		}
+		logical, stored, err := fileUsage(info)
+		if err != nil {
+			return &os.PathError{Op: "usage", Path: p, Err: err}
+		}
+		u.Bytes += logical
+		u.StoredBytes += stored
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// fileUsage returns the logical and the stored size of the file
+// described by info.
+func fileUsage(info os.FileInfo) (int64, int64, error) {
+	if f, ok := info.Sys().(*File); ok {
+		f.RLock()
+		defer f.RUnlock()
+		return f.usage()
+	}
+	return info.Size(), storedSize(info), nil
+}
+
+// usage returns the logical size of the file data and the number of
+// bytes used to store it. For compressed files, the former requires
+// decompressing the data if they have no open handles. It must be
+// called with the lock of f held.
+func (f *File) usage() (int64, int64, error) {
+	switch {
+	case f.spill != nil:
+		return f.spill.size, f.stored(), nil
+	case f.source != nil:
+		return f.source.size, f.stored(), nil
+	case f.pages != nil:
+		return f.pages.size, f.stored(), nil
+	case f.Mode&ModeCompress != 0 && len(f.Data) > 0:
+		zr, err := zlib.NewReader(bytes.NewReader(f.Data))
+		if err != nil {
+			return 0, 0, err
+		}
+		defer func() { _ = zr.Close() }()
+		n, err := io.Copy(io.Discard, zr)
+		if err != nil {
+			return 0, 0, err
+		}
+		return n, f.stored(), nil
+	}
+	return int64(len(f.Data)), f.stored(), nil
+}
+
+// stored returns the number of bytes used to store the file data,
+// which unlike its logical size never requires decompressing it. It
+// must be called with the lock of f held.
+func (f *File) stored() int64 {
+	switch {
+	case f.spill != nil:
+		return f.spill.size
+	case f.source != nil:
+		return f.source.stored
+	case f.pages != nil:
+		stored := f.pages.allocated()
+		if f.Mode&ModeCompress != 0 {
+			// Compressed data is kept while the handles are open
+			stored += int64(len(f.Data))
+		}
+		return stored
+	}
+	return int64(len(f.Data))
+}
+
+func (fs *memoryFileSystem) StatFS() (*FSStats, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	st := &FSStats{id: fs}
+	seen := make(map[*File]struct{})
+	var walk func(d *Dir) error
+	walk = func(d *Dir) error {
+		d.RLock()
+		defer d.RUnlock()
+		if err := d.load(); err != nil {
+			return err
+		}
+		st.UsedInodes++
+		for _, e := range d.Entries {
+			e, err := fs.view(e)
+			if err != nil {
+				return err
+			}
+			switch e := e.(type) {
+			case *Dir:
+				if err := walk(e); err != nil {
+					return err
+				}
+			case *File:
+				if _, ok := seen[e]; ok {
+					continue
+				}
+				seen[e] = struct{}{}
+				e.RLock()
+				st.UsedBytes += e.stored()
+				e.RUnlock()
+				st.UsedInodes++
+			}
+		}
+		return nil
+	}
+	root, err := fs.top()
+	if err != nil {
+		return nil, err
+	}
+	if err := walk(root); err != nil {
+		return nil, err
+	}
+	if q := root.quota; q != nil && q.dir == root {
+		q.limit(st)
+	}
+	return st, nil
+}
+
+// StatFS returns the sum of the stats of the mounted file systems. The
+// ones which do not implement FSStater are ignored, unless none of
+// them does. File systems mounted several times, and the on-disk ones
+// on the same device, are only counted once.
+func (m *Mounter) StatFS() (*FSStats, error) {
+	st := &FSStats{}
+	supported := false
+	mounted := make(map[any]struct{})
+	stored := make(map[any]struct{})
+	for _, mp := range m.points {
+		if counted(mounted, mp.fs) {
+			continue
+		}
+		s, err := StatFS(mp.fs)
+		if err != nil {
+			if errors.Is(err, errors.ErrUnsupported) {
+				continue
+			}
+			return nil, err
+		}
+		supported = true
+		if counted(stored, s.id) {
+			continue
+		}
+		st.TotalBytes += s.TotalBytes
+		st.FreeBytes += s.FreeBytes
+		st.UsedBytes += s.UsedBytes
+		st.TotalInodes += s.TotalInodes
+		st.FreeInodes += s.FreeInodes
+		st.UsedInodes += s.UsedInodes
+	}
+	if !supported {
+		return nil, unsupported("statfs", m)
+	}
+	return st, nil
+}
+
+// counted returns whether key is in keys, adding it otherwise. Keys
+// which can't be compared are never seen.
+func counted(keys map[any]struct{}, key any) bool {
+	if key == nil || !reflect.TypeOf(key).Comparable() {
+		return false
+	}
+	if _, ok := keys[key]; ok {
+		return true
+	}
+	keys[key] = struct{}{}
+	return false
+}
+
+func (fs *chrootFileSystem) StatFS() (*FSStats, error) {
+	return StatFS(fs.fs)
+}
+
+func (fs *readOnlyFileSystem) StatFS() (*FSStats, error) {
+	return StatFS(fs.fs)
+}
+
+func (fs *rewriterFileSystem) StatFS() (*FSStats, error) {
+	return StatFS(fs.fs)
+}
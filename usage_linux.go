@@ -0,0 +1,57 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns a key identifying the file described by info, so
+// files with several hard links are only counted once.
+func fileID(info os.FileInfo) (any, bool) {
+	switch s := info.Sys().(type) {
+	case *File:
+		return s, true
+	case *syscall.Stat_t:
+		if s.Nlink > 1 {
+			return [2]uint64{uint64(s.Dev), uint64(s.Ino)}, true
+		}
+	}
+	return nil, false
+}
+
+// storedSize returns the space allocated on disk for the
+// file described by info.
+func storedSize(info os.FileInfo) int64 {
+	if s, ok := info.Sys().(*syscall.Stat_t); ok {
+		// Blocks are always counted in 512 byte units
+		return int64(s.Blocks) * 512
+	}
+	return info.Size()
+}
+
+func (fs *fileSystem) StatFS() (*FSStats, error) {
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(fs.root, &s); err != nil {
+		return nil, &os.PathError{Op: "statfs", Path: fs.root, Err: err}
+	}
+	bsize := int64(s.Frsize)
+	if bsize == 0 {
+		bsize = int64(s.Bsize)
+	}
+	st := &FSStats{
+		TotalBytes:  int64(s.Blocks) * bsize,
+		FreeBytes:   int64(s.Bavail) * bsize,
+		UsedBytes:   int64(s.Blocks-s.Bfree) * bsize,
+		TotalInodes: int64(s.Files),
+		FreeInodes:  int64(s.Ffree),
+		UsedInodes:  int64(s.Files - s.Ffree),
+	}
+	// Some file systems don't report an id, and can't be told apart
+	if s.Fsid != (syscall.Fsid{}) {
+		st.id = diskID(s.Fsid)
+	}
+	return st, nil
+}
+
+// diskID identifies an on-disk file system in FSStats.
+type diskID syscall.Fsid
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package vfs
+
+import (
+	"errors"
+	"os"
+)
+
+// fileID returns a key identifying the file described by info, so
+// files with several hard links are only counted once. Only the
+// in-memory files can be identified on this platform.
+func fileID(info os.FileInfo) (any, bool) {
+	if f, ok := info.Sys().(*File); ok {
+		return f, true
+	}
+	return nil, false
+}
+
+// storedSize returns the space used by the file described by info,
+// which is its size on this platform.
+func storedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+// Capacity reporting for on-disk file systems is only supported on Linux.
+
+func (fs *fileSystem) StatFS() (*FSStats, error) {
+	return nil, &os.PathError{Op: "statfs", Path: fs.root, Err: errors.ErrUnsupported}
+}
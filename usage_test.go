@@ -0,0 +1,228 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMemoryUsage(t *testing.T) {
+	fs := Memory()
+	if err := MkdirAll(fs, "a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "a/f", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Link(fs, "a/f", "a/b/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(fs, "f", "a/sym"); err != nil {
+		t.Fatal(err)
+	}
+	compressible := bytes.Repeat([]byte("a"), 10000)
+	if err := WriteFile(fs, "a/b/c", compressible, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Compress(fs); err != nil {
+		t.Fatal(err)
+	}
+	u, err := Usage(fs, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Dirs != 2 || u.Files != 4 {
+		t.Errorf("Usage counted %d dirs and %d files, want 2 and 4", u.Dirs, u.Files)
+	}
+	if want := int64(len("hello") + len("f") + len(compressible)); u.Bytes != want {
+		t.Errorf("Usage Bytes = %d, want %d", u.Bytes, want)
+	}
+	if u.StoredBytes >= u.Bytes-int64(len(compressible))/2 {
+		t.Errorf("Usage StoredBytes = %d, want less than %d for compressed data", u.StoredBytes, u.Bytes)
+	}
+	st, err := StatFS(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.UsedBytes != u.StoredBytes || st.UsedInodes != 6 {
+		t.Errorf("StatFS used %d bytes and %d inodes, want %d and 6", st.UsedBytes, st.UsedInodes, u.StoredBytes)
+	}
+	if st.TotalBytes != 0 || st.FreeBytes != 0 {
+		t.Errorf("StatFS reported a capacity of %d bytes, %d free, want 0", st.TotalBytes, st.FreeBytes)
+	}
+}
+
+func TestMemoryUsageSparse(t *testing.T) {
+	fs := Memory()
+	f, err := fs.OpenFile("sparse", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.(io.WriterAt).WriteAt([]byte("x"), 10*pageSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	u, err := Usage(fs, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Bytes != 10*pageSize+1 || u.StoredBytes > pageSize {
+		t.Errorf("Usage = %d bytes, %d stored, want %d and at most %d", u.Bytes, u.StoredBytes, 10*pageSize+1, pageSize)
+	}
+}
+
+func TestTmpFSUsage(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	if err := WriteFile(fs, "f", bytes.Repeat([]byte("a"), 5000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Link(fs, "f", "g"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := Usage(fs, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Dirs != 1 || u.Files != 2 || u.Bytes != 5000 {
+		t.Errorf("Usage = %+v, want 1 dir, 2 files and 5000 bytes", u)
+	}
+	st, err := StatFS(fs)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.TotalBytes <= 0 || st.UsedBytes > st.TotalBytes || st.FreeBytes > st.TotalBytes {
+		t.Errorf("StatFS = %+v, want consistent capacity", st)
+	}
+}
+
+func TestStatFSWrappers(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "sub/f", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := Chroot("sub", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := Memory()
+	if err := WriteFile(other, "g", []byte("more data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(other, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mkdir("/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(ch, "/sub"); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		fs    VFS
+		bytes int64
+	}{
+		{ch, 4},
+		{ReadOnly(ch), 4},
+		{m, 13},
+	} {
+		st, err := StatFS(v.fs)
+		if err != nil {
+			t.Errorf("StatFS(%s): %v", v.fs, err)
+			continue
+		}
+		if st.UsedBytes != v.bytes {
+			t.Errorf("StatFS(%s) used %d bytes, want %d", v.fs, st.UsedBytes, v.bytes)
+		}
+	}
+	u, err := Usage(m, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Files != 2 || u.Bytes != 13 {
+		t.Errorf("Usage(%s) = %+v, want 2 files and 13 bytes", m, u)
+	}
+	if _, err := StatFS(&errOpenVFS{VFS: Memory()}); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("StatFS on unsupported VFS = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestMounterStatFSDuplicates(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := Chroot("/", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(mem, "/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		fs    VFS
+		point string
+	}{
+		{mem, "/again"},
+		{ch, "/chroot"},
+	} {
+		if err := mem.Mkdir(v.point, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Mount(v.fs, v.point); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st, err := StatFS(m); err != nil || st.UsedBytes != 4 {
+		t.Errorf("StatFS(%s) = %+v, %v, want 4 bytes used", m, st, err)
+	}
+	// Two on-disk file systems in the same device
+	a, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+	b, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = b.Close() }()
+	want, err := StatFS(a)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.id == nil {
+		t.Skip("the temporary directory has no file system id")
+	}
+	disks := &Mounter{}
+	if err := disks.Mount(a, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Mkdir("b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := disks.Mount(b, "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := StatFS(disks); err != nil || st.TotalBytes != want.TotalBytes {
+		t.Errorf("StatFS(%s) = %+v, %v, want %d total bytes", disks, st, err, want.TotalBytes)
+	}
+}
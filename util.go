@@ -1,12 +1,15 @@
 package vfs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	iofs "io/fs"
 	"os"
 	pathpkg "path"
 	"strings"
+	"time"
 )
 
 var (
@@ -22,7 +25,24 @@ var (
 // WalkFunc is the function type used by Walk to iterate over a VFS.
 type WalkFunc func(fs VFS, path string, info os.FileInfo, err error) error
 
-func walk(fs VFS, p string, info os.FileInfo, fn WalkFunc) error {
+// walkBatchSize is the number of entries read at once by Walk from
+// file systems implementing DirOpener.
+const walkBatchSize = 256
+
+// openDir is like OpenDir, but it uses cfs when fs does not implement
+// DirOpener, so ctx is passed to ContextVFS backends.
+func openDir(ctx context.Context, fs VFS, cfs ContextVFS, p string) (DirFile, error) {
+	if d, ok := fs.(DirOpener); ok {
+		return d.OpenDir(p)
+	}
+	infos, err := cfs.ReadDirContext(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return &infoDir{infos: infos}, nil
+}
+
+func walk(ctx context.Context, fs VFS, cfs ContextVFS, p string, info os.FileInfo, fn WalkFunc) error {
 	err := fn(fs, p, info, nil)
 	if err != nil {
 		if info.IsDir() && err == ErrSkipDir {
@@ -33,36 +53,58 @@ func walk(fs VFS, p string, info os.FileInfo, fn WalkFunc) error {
 	if !info.IsDir() {
 		return nil
 	}
-	infos, err := fs.ReadDir(p)
+	dir, err := openDir(ctx, fs, cfs, p)
 	if err != nil {
 		return fn(fs, p, info, err)
 	}
-	for _, v := range infos {
-		name := pathpkg.Join(p, v.Name())
-		fileInfo, err := fs.Lstat(name)
+	defer func() { _ = dir.Close() }()
+	for {
+		if err := ctx.Err(); err != nil {
+			return fn(fs, p, info, err)
+		}
+		entries, err := dir.ReadDir(walkBatchSize)
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			if err := fn(fs, name, fileInfo, err); err != nil && err != ErrSkipDir {
+			return fn(fs, p, info, err)
+		}
+		for _, v := range entries {
+			name := pathpkg.Join(p, v.Name())
+			fileInfo, err := cfs.LstatContext(ctx, name)
+			if err != nil {
+				if err := fn(fs, name, fileInfo, err); err != nil && err != ErrSkipDir {
+					return err
+				}
+				continue
+			}
+			if err := walk(ctx, fs, cfs, name, fileInfo, fn); err != nil && (!fileInfo.IsDir() || err != ErrSkipDir) {
 				return err
 			}
-			continue
-		}
-		if err := walk(fs, name, fileInfo, fn); err != nil && (!fileInfo.IsDir() || err != ErrSkipDir) {
-			return err
 		}
 	}
-	return nil
 }
 
 // Walk iterates over all the files in the VFS which descend from the given
 // root (including root itself), descending into any subdirectories. In each
-// directory, files are visited in alphabetical order. The given function might
-// chose to skip a directory by returning ErrSkipDir.
+// directory, files are visited in alphabetical order, unless fs implements
+// DirOpener, in which case they're visited in directory order and streamed
+// in batches rather than read at once. The given function might chose to skip
+// a directory by returning ErrSkipDir.
 func Walk(fs VFS, root string, fn WalkFunc) error {
-	info, err := fs.Lstat(root)
+	return WalkContext(context.Background(), fs, root, fn)
+}
+
+// WalkContext is like Walk, but it uses the ContextVFS returned by
+// AsContextVFS for listing the directories, so the walk is aborted when
+// ctx is done. In that case, fn is called with the error from ctx.
+func WalkContext(ctx context.Context, fs VFS, root string, fn WalkFunc) error {
+	cfs := AsContextVFS(fs)
+	info, err := cfs.LstatContext(ctx, root)
 	if err != nil {
 		return fn(fs, root, nil, err)
 	}
-	return walk(fs, root, info, fn)
+	return walk(ctx, fs, cfs, root, info, fn)
 }
 
 func makeDir(fs VFS, path string, perm os.FileMode) error {
@@ -101,7 +143,17 @@ func MkdirAll(fs VFS, path string, perm os.FileMode) error {
 // RemoveAll removes all files from the given fs and path, including
 // directories (by removing its contents first).
 func RemoveAll(fs VFS, path string) error {
-	stat, err := fs.Lstat(path)
+	return RemoveAllContext(context.Background(), fs, path)
+}
+
+// RemoveAllContext is like RemoveAll, but it stops removing files
+// when ctx is done, returning its error.
+func RemoveAllContext(ctx context.Context, fs VFS, path string) error {
+	return removeAll(ctx, AsContextVFS(fs), path)
+}
+
+func removeAll(ctx context.Context, fs ContextVFS, path string) error {
+	stat, err := fs.LstatContext(ctx, path)
 	if err != nil {
 		if err == os.ErrNotExist {
 			return nil
@@ -109,18 +161,18 @@ func RemoveAll(fs VFS, path string) error {
 		return err
 	}
 	if stat.IsDir() {
-		files, err := fs.ReadDir(path)
+		files, err := fs.ReadDirContext(ctx, path)
 		if err != nil {
 			return err
 		}
 		for _, v := range files {
 			filePath := pathpkg.Join(path, v.Name())
-			if err := RemoveAll(fs, filePath); err != nil {
+			if err := removeAll(ctx, fs, filePath); err != nil {
 				return err
 			}
 		}
 	}
-	return fs.Remove(path)
+	return fs.RemoveContext(ctx, path)
 }
 
 // ReadFile reads the file at the given path from the given fs, returning
@@ -134,6 +186,17 @@ func ReadFile(fs VFS, path string) ([]byte, error) {
 	return io.ReadAll(f)
 }
 
+// ReadFileContext is like ReadFile, but it stops reading the file
+// when ctx is done, returning its error.
+func ReadFileContext(ctx context.Context, fs VFS, path string) ([]byte, error) {
+	f, err := AsContextVFS(fs).OpenContext(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return io.ReadAll(&contextReader{ctx: ctx, r: f})
+}
+
 // WriteFile writes a file at the given path and fs with the given data and
 // permissions. If the file already exists, WriteFile truncates it before
 // writing. If the file can't be created, an error will be returned.
@@ -155,9 +218,28 @@ func WriteFile(fs VFS, path string, data []byte, perm os.FileMode) error {
 
 // Clone copies all the files from the src VFS to dst. Note that files or directories with
 // all permissions set to 0 will be set to 0755 for directories and 0644 for files. If you
-// need more granularity, use Walk directly to clone the file systems.
+// need more granularity, use Walk directly to clone the file systems. If dst implements
+// AttrSetter, modification times are preserved too.
 func Clone(dst VFS, src VFS) error {
-	err := Walk(src, "/", func(fs VFS, path string, info os.FileInfo, err error) error {
+	return CloneContext(context.Background(), dst, src)
+}
+
+// CloneContext is like Clone, but it stops copying files when ctx is
+// done, returning its error.
+func CloneContext(ctx context.Context, dst VFS, src VFS) error {
+	cdst := AsContextVFS(dst)
+	chtimes := func(path string, mtime time.Time) error {
+		err := Chtimes(dst, path, mtime, mtime)
+		if errors.Is(err, errors.ErrUnsupported) {
+			return nil
+		}
+		return err
+	}
+	// Directory times must be set once all their entries have been
+	// created, since adding entries might update them.
+	var dirs []string
+	var dirTimes []time.Time
+	err := WalkContext(ctx, src, "/", func(fs VFS, path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -166,13 +248,22 @@ func Clone(dst VFS, src VFS) error {
 			if perm == 0 {
 				perm = 0755
 			}
-			err := dst.Mkdir(path, info.Mode()|perm)
+			err := cdst.MkdirContext(ctx, path, info.Mode()|perm)
 			if err != nil && !IsExist(err) {
 				return err
 			}
+			dirs = append(dirs, path)
+			dirTimes = append(dirTimes, info.ModTime())
 			return nil
 		}
-		data, err := ReadFile(fs, path)
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := Readlink(fs, path)
+			if err != nil {
+				return err
+			}
+			return Symlink(dst, target, path)
+		}
+		data, err := ReadFileContext(ctx, fs, path)
 		if err != nil {
 			return err
 		}
@@ -180,14 +271,318 @@ func Clone(dst VFS, src VFS) error {
 		if perm == 0 {
 			perm = 0644
 		}
-		if err := WriteFile(dst, path, data, info.Mode()|perm); err != nil {
+		f, err := cdst.OpenFileContext(ctx, path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode()|perm)
+		if err != nil {
 			return err
 		}
-		return nil
+		_, err = f.Write(data)
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+		if err != nil {
+			return err
+		}
+		return chtimes(path, info.ModTime())
 	})
+	if err != nil {
+		return err
+	}
+	for ii := len(dirs) - 1; ii >= 0; ii-- {
+		if err := chtimes(dirs[ii], dirTimes[ii]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenDir opens the directory at path in the given fs for streaming its
+// entries. If fs does not implement DirOpener, the entries are read at once
+// using fs.ReadDir.
+func OpenDir(fs VFS, path string) (DirFile, error) {
+	if d, ok := fs.(DirOpener); ok {
+		return d.OpenDir(path)
+	}
+	infos, err := fs.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return &infoDir{infos: infos}, nil
+}
+
+// infoDir is a DirFile returning the entries read by VFS.ReadDir.
+type infoDir struct {
+	infos []os.FileInfo
+}
+
+func (d *infoDir) ReadDir(n int) ([]os.DirEntry, error) {
+	if n > 0 && len(d.infos) == 0 {
+		return nil, io.EOF
+	}
+	count := len(d.infos)
+	if n > 0 && n < count {
+		count = n
+	}
+	entries := make([]os.DirEntry, count)
+	for ii, v := range d.infos[:count] {
+		entries[ii] = iofs.FileInfoToDirEntry(v)
+	}
+	d.infos = d.infos[count:]
+	return entries, nil
+}
+
+func (d *infoDir) Close() error {
+	return nil
+}
+
+// CreateAtomic returns a handle for atomically replacing the file at path in
+// the given fs, using perm for the new file. If fs does not implement
+// AtomicCreator, the data is written to a temporary file in the same
+// directory, which is renamed to path on Commit, so fs must implement
+// Renamer.
+func CreateAtomic(fs VFS, path string, perm os.FileMode) (AtomicFile, error) {
+	if a, ok := fs.(AtomicCreator); ok {
+		return a.CreateAtomic(path, perm)
+	}
+	return newRenameAtomicFile(fs, path, perm)
+}
+
+// WriteFileAtomic is like WriteFile, but it uses CreateAtomic, so the file
+// at path is either fully replaced or left unchanged.
+func WriteFileAtomic(fs VFS, path string, data []byte, perm os.FileMode) error {
+	f, err := CreateAtomic(fs, path, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Abort()
+		return err
+	}
+	return f.Commit()
+}
+
+// Rename moves the entry at oldpath to newpath in the given fs. If fs does
+// not implement Renamer, an error wrapping errors.ErrUnsupported is returned.
+func Rename(fs VFS, oldpath, newpath string) error {
+	if r, ok := fs.(Renamer); ok {
+		return r.Rename(oldpath, newpath)
+	}
+	return unsupported("rename", fs)
+}
+
+// Truncate changes the size of the file at name in the given fs. If fs
+// does not implement Truncater, the file is opened for writing and
+// truncated using its FileTruncater implementation. If neither is
+// available, an error wrapping errors.ErrUnsupported is returned.
+func Truncate(fs VFS, name string, size int64) error {
+	if t, ok := fs.(Truncater); ok {
+		return t.Truncate(name, size)
+	}
+	f, err := fs.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if t, ok := f.(FileTruncater); ok {
+		err = t.Truncate(size)
+	} else {
+		err = unsupported("truncate", fs)
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
 	return err
 }
 
+// Link creates newname as a hard link to oldname in the given fs. If fs
+// does not implement Linker, an error wrapping errors.ErrUnsupported is
+// returned.
+func Link(fs VFS, oldname, newname string) error {
+	if l, ok := fs.(Linker); ok {
+		return l.Link(oldname, newname)
+	}
+	return unsupported("link", fs)
+}
+
+// Symlink creates newname as a symbolic link to oldname in the given fs. If
+// fs does not implement Symlinker, an error wrapping errors.ErrUnsupported
+// is returned.
+func Symlink(fs VFS, oldname, newname string) error {
+	if s, ok := fs.(Symlinker); ok {
+		return s.Symlink(oldname, newname)
+	}
+	return unsupported("symlink", fs)
+}
+
+// Readlink returns the target of the symbolic link at name in the given
+// fs. If fs does not implement Symlinker, an error wrapping
+// errors.ErrUnsupported is returned.
+func Readlink(fs VFS, name string) (string, error) {
+	if s, ok := fs.(Symlinker); ok {
+		return s.Readlink(name)
+	}
+	return "", unsupported("readlink", fs)
+}
+
+// Chmod changes the permission bits of the entry at name in the given fs.
+// If fs does not implement AttrSetter, an error wrapping
+// errors.ErrUnsupported is returned.
+func Chmod(fs VFS, name string, mode os.FileMode) error {
+	if a, ok := fs.(AttrSetter); ok {
+		return a.Chmod(name, mode)
+	}
+	return unsupported("chmod", fs)
+}
+
+// Chtimes changes the access and modification times of the entry at name
+// in the given fs. If fs does not implement AttrSetter, an error wrapping
+// errors.ErrUnsupported is returned.
+func Chtimes(fs VFS, name string, atime time.Time, mtime time.Time) error {
+	if a, ok := fs.(AttrSetter); ok {
+		return a.Chtimes(name, atime, mtime)
+	}
+	return unsupported("chtimes", fs)
+}
+
+// Chown changes the numeric user and group ids of the entry at name in the
+// given fs. If fs does not implement AttrSetter, an error wrapping
+// errors.ErrUnsupported is returned.
+func Chown(fs VFS, name string, uid, gid int) error {
+	if a, ok := fs.(AttrSetter); ok {
+		return a.Chown(name, uid, gid)
+	}
+	return unsupported("chown", fs)
+}
+
+// LockPath opens the file at path in the given fs, creating it if it
+// doesn't exist, and acquires an exclusive advisory lock on it, blocking
+// until it's available. The returned function releases the lock. Since
+// it only relies on Open and OpenFile, it works with any wrapper around
+// a file system whose files implement Locker. Otherwise, an error
+// wrapping errors.ErrUnsupported is returned.
+func LockPath(fs VFS, path string) (unlock func() error, err error) {
+	var f RFile
+	f, err = fs.Open(path)
+	if IsNotExist(err) {
+		f, err = fs.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l, ok := f.(Locker)
+	if !ok {
+		_ = f.Close()
+		return nil, unsupported("lock", fs)
+	}
+	if err := l.Lock(true); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return func() error {
+		err := l.Unlock()
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+		return err
+	}, nil
+}
+
+// OSFile returns the *os.File backing f, for using the parts of its API
+// not covered by RFile, like Fd or SyscallConn. The boolean is false if
+// f is not an *os.File and does not implement OSFiler.
+func OSFile(f RFile) (*os.File, bool) {
+	switch f := f.(type) {
+	case *os.File:
+		return f, true
+	case OSFiler:
+		return f.OSFile(), true
+	}
+	return nil, false
+}
+
+// Getxattr returns the value of the extended attribute name of the entry
+// at path in the given fs. If fs does not implement XattrVFS, an error
+// wrapping errors.ErrUnsupported is returned.
+func Getxattr(fs VFS, path string, name string) ([]byte, error) {
+	if x, ok := fs.(XattrVFS); ok {
+		return x.Getxattr(path, name)
+	}
+	return nil, unsupported("getxattr", fs)
+}
+
+// Setxattr sets the value of the extended attribute name of the entry at
+// path in the given fs. If fs does not implement XattrVFS, an error
+// wrapping errors.ErrUnsupported is returned.
+func Setxattr(fs VFS, path string, name string, value []byte) error {
+	if x, ok := fs.(XattrVFS); ok {
+		return x.Setxattr(path, name, value)
+	}
+	return unsupported("setxattr", fs)
+}
+
+// Listxattr returns the names of the extended attributes of the entry at
+// path in the given fs. If fs does not implement XattrVFS, an error
+// wrapping errors.ErrUnsupported is returned.
+func Listxattr(fs VFS, path string) ([]string, error) {
+	if x, ok := fs.(XattrVFS); ok {
+		return x.Listxattr(path)
+	}
+	return nil, unsupported("listxattr", fs)
+}
+
+// Removexattr removes the extended attribute name from the entry at path
+// in the given fs. If fs does not implement XattrVFS, an error wrapping
+// errors.ErrUnsupported is returned.
+func Removexattr(fs VFS, path string, name string) error {
+	if x, ok := fs.(XattrVFS); ok {
+		return x.Removexattr(path, name)
+	}
+	return unsupported("removexattr", fs)
+}
+
+// SetQuota sets the limits of the subtree at path in the given fs. If fs
+// does not implement QuotaVFS, an error wrapping errors.ErrUnsupported is
+// returned. See also Quota.
+func SetQuota(fs VFS, path string, limits QuotaLimits) error {
+	if q, ok := fs.(QuotaVFS); ok {
+		return q.SetQuota(path, limits)
+	}
+	return unsupported("setquota", fs)
+}
+
+// QuotaUsage returns the limits and the usage of the subtree at path in
+// the given fs. If fs does not implement QuotaVFS, an error wrapping
+// errors.ErrUnsupported is returned.
+func QuotaUsage(fs VFS, path string) (*QuotaInfo, error) {
+	if q, ok := fs.(QuotaVFS); ok {
+		return q.QuotaUsage(path)
+	}
+	return nil, unsupported("quota", fs)
+}
+
+// Snapshot returns a read-only VFS with the current contents of the given
+// fs, which are not affected by its later changes. If fs does not
+// implement Snapshotter, an error wrapping errors.ErrUnsupported is
+// returned.
+func Snapshot(fs VFS) (VFS, error) {
+	if s, ok := fs.(Snapshotter); ok {
+		return s.Snapshot()
+	}
+	return nil, unsupported("snapshot", fs)
+}
+
+// Fork returns a writable copy of the given fs, independent from it. If fs
+// does not implement Snapshotter, an error wrapping errors.ErrUnsupported
+// is returned.
+func Fork(fs VFS) (VFS, error) {
+	if s, ok := fs.(Snapshotter); ok {
+		return s.Fork()
+	}
+	return nil, unsupported("fork", fs)
+}
+
+func unsupported(op string, fs VFS) error {
+	return fmt.Errorf("%s: %s: %w", op, fs, errors.ErrUnsupported)
+}
+
 // IsExist returns wheter the error indicates that the file or directory
 // already exists.
 func IsExist(err error) bool {
@@ -216,7 +611,7 @@ func Compress(fs VFS) error {
 			return err
 		}
 		mode := info.Mode()
-		if mode.IsDir() || mode&ModeCompress != 0 {
+		if !mode.IsRegular() || mode&ModeCompress != 0 {
 			return nil
 		}
 		f, err := fs.Open(p)
@@ -1,8 +1,10 @@
 package vfs
 
 import (
+	"context"
 	"io"
 	"os"
+	"time"
 )
 
 // Opener is the interface which specifies the methods for
@@ -67,6 +69,55 @@ type VFS interface {
 	String() string
 }
 
+// ContextVFS is the context-aware variant of VFS. Its methods mirror the
+// ones in VFS, taking a context.Context which allows cancelling the
+// operation or setting a deadline for it, e.g. for file systems backed
+// by a remote service. Use AsContextVFS to obtain a ContextVFS from any
+// VFS. See also the shorthand functions WalkContext, CloneContext,
+// RemoveAllContext, ReadFileContext, WriteTarContext and WriteZipContext.
+type ContextVFS interface {
+	// OpenContext is like VFS.Open. Implementations might keep using
+	// ctx for the operations on the returned file.
+	OpenContext(ctx context.Context, path string) (RFile, error)
+	// OpenFileContext is like VFS.OpenFile. Implementations might
+	// keep using ctx for the operations on the returned file.
+	OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (WFile, error)
+	// LstatContext is like VFS.Lstat.
+	LstatContext(ctx context.Context, path string) (os.FileInfo, error)
+	// StatContext is like VFS.Stat.
+	StatContext(ctx context.Context, path string) (os.FileInfo, error)
+	// ReadDirContext is like VFS.ReadDir.
+	ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error)
+	// MkdirContext is like VFS.Mkdir.
+	MkdirContext(ctx context.Context, path string, perm os.FileMode) error
+	// RemoveContext is like VFS.Remove.
+	RemoveContext(ctx context.Context, path string) error
+	// String returns a human-readable description of the VFS.
+	String() string
+}
+
+// DirFile is the directory handle returned by DirOpener.OpenDir. It
+// allows listing huge directories without loading all their entries at
+// once, and must be closed after use.
+type DirFile interface {
+	// ReadDir reads the next entries in the directory, like
+	// os.File.ReadDir. If n > 0, it returns at most n entries and
+	// io.EOF at the end of the directory. Otherwise, it returns all
+	// the remaining entries. Entries are returned in directory
+	// order, which is not sorted for on-disk file systems.
+	ReadDir(n int) ([]os.DirEntry, error)
+	io.Closer
+}
+
+// DirOpener is implemented by file systems which can stream the
+// contents of their directories. See also the shorthand function
+// OpenDir.
+type DirOpener interface {
+	// OpenDir opens the directory at path for reading its
+	// entries.
+	OpenDir(path string) (DirFile, error)
+}
+
 // TemporaryVFS represents a temporary on-disk file system which can be removed
 // by calling its Close method.
 type TemporaryVFS interface {
@@ -77,9 +128,253 @@ type TemporaryVFS interface {
 	Close() error
 }
 
+// HandleLister is implemented by file systems which can list their
+// open handles. See TrackHandles.
+type HandleLister interface {
+	// OpenHandles returns the tracked handles which are still open.
+	OpenHandles() []OpenHandle
+}
+
+// HybridVFS is the in-memory file system returned by Hybrid, which
+// spills large files to disk.
+type HybridVFS interface {
+	VFS
+	// SetBudget sets the number of bytes of file data which might
+	// be kept in memory. Once exceeded, files are spilled to disk
+	// as they grow. Zero, the default, means no limit.
+	SetBudget(budget int64)
+	// InMemory returns the number of bytes of file data kept in
+	// memory, not including the spilled files.
+	InMemory() int64
+	// Close removes all the spilled data, including the spill VFS.
+	// The file system must not be used afterwards.
+	Close() error
+}
+
+// PersistentVFS is the in-memory file system returned by
+// OpenPersistentMemory, which stores its contents on disk.
+type PersistentVFS interface {
+	VFS
+	// Compact writes a snapshot of the file system, replacing the
+	// log of the changes made since the previous one. It's done in
+	// the background as the log grows, but it can be called to make
+	// the next startup faster.
+	Compact() error
+	// Close syncs the log to disk and releases the directory. The
+	// file system must not be used afterwards.
+	Close() error
+}
+
 // Container is implemented by some file systems which
 // contain another one.
 type Container interface {
 	// VFS returns the underlying VFS.
 	VFS() VFS
 }
+
+// Umasker is implemented by file systems which allow setting the mask
+// applied to the permissions of new files and directories, like the
+// in-memory ones. On-disk file systems use the process umask instead.
+type Umasker interface {
+	// Umask sets the new mask, returning the previous one.
+	Umask(mask os.FileMode) os.FileMode
+}
+
+// Renamer is implemented by file systems which can move or rename
+// entries without copying their contents. See also the shorthand
+// function Rename.
+type Renamer interface {
+	// Rename moves the entry at oldpath to newpath. If newpath
+	// already exists and it's not a directory, it's replaced. If
+	// both oldpath and newpath are directories, newpath must be
+	// empty.
+	Rename(oldpath, newpath string) error
+}
+
+// Truncater is implemented by file systems which can change the size of
+// a file in place. See also the shorthand function Truncate.
+type Truncater interface {
+	// Truncate changes the size of the file at name. If the file
+	// grows, the new bytes are zeroes.
+	Truncate(name string, size int64) error
+}
+
+// FileTruncater is implemented by the files returned from a VFS which
+// can change their size, like *os.File or the in-memory files.
+type FileTruncater interface {
+	// Truncate changes the size of the file. If the file grows,
+	// the new bytes are zeroes.
+	Truncate(size int64) error
+}
+
+// Linker is implemented by file systems which support hard links. See
+// also the shorthand function Link.
+type Linker interface {
+	// Link creates newname as a hard link to the file at oldname.
+	// Both names share the same data, which is only removed when
+	// the last name is removed.
+	Link(oldname, newname string) error
+}
+
+// Symlinker is implemented by file systems which support symbolic
+// links. See also the shorthand functions Symlink and Readlink.
+type Symlinker interface {
+	// Symlink creates newname as a symbolic link to oldname. Relative
+	// targets are resolved from the directory containing the link.
+	Symlink(oldname, newname string) error
+	// Readlink returns the target of the symbolic link at name.
+	Readlink(name string) (string, error)
+}
+
+// AttrSetter is implemented by file systems which allow changing the
+// metadata of their entries after creation. See also the shorthand
+// functions Chmod, Chtimes and Chown.
+type AttrSetter interface {
+	// Chmod changes the permission bits of the entry at name,
+	// following symlinks.
+	Chmod(name string, mode os.FileMode) error
+	// Chtimes changes the access and modification times of the
+	// entry at name, following symlinks. File systems which don't
+	// keep track of access times might ignore atime.
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	// Chown changes the numeric user and group ids of the entry
+	// at name, following symlinks.
+	Chown(name string, uid, gid int) error
+}
+
+// FileStater is implemented by the files returned from a VFS which can
+// return their own os.FileInfo, like *os.File or the in-memory files.
+// Files implementing random access also implement io.ReaderAt and,
+// when writable, io.WriterAt.
+type FileStater interface {
+	// Stat returns the os.FileInfo describing the file.
+	Stat() (os.FileInfo, error)
+}
+
+// FileNamer is implemented by the files returned from a VFS which
+// know their own name, like *os.File or the in-memory files.
+type FileNamer interface {
+	// Name returns the name of the file as passed to Open or
+	// OpenFile.
+	Name() string
+}
+
+// FileSyncer is implemented by the files returned from a VFS which can
+// flush their contents to the underlying storage, like *os.File or the
+// in-memory files.
+type FileSyncer interface {
+	// Sync commits the current contents of the file to its storage.
+	Sync() error
+}
+
+// Locker is implemented by the files returned from a VFS which support
+// advisory locking, like the on-disk files on Linux or the in-memory
+// files. Locks belong to the handle, so two handles to the same file
+// conflict even when used from the same goroutine, and they're released
+// when the handle is closed. See also the shorthand function LockPath.
+type Locker interface {
+	// Lock acquires a shared or an exclusive lock on the file,
+	// blocking until it's available. If the handle already holds
+	// a lock of the other type, it's released first, so the
+	// conversion is not atomic.
+	Lock(exclusive bool) error
+	// TryLock is like Lock, but it returns false rather than
+	// blocking when the lock is held by another handle. Like
+	// in Lock, a lock of the other type held by the handle is
+	// released first, even if TryLock fails.
+	TryLock(exclusive bool) (bool, error)
+	// Unlock releases the lock held by the handle, if any.
+	Unlock() error
+}
+
+// OSFiler is implemented by the files returned from a VFS which are
+// backed by an *os.File, like the ones from FS and TmpFS. See also the
+// shorthand function OSFile.
+type OSFiler interface {
+	// OSFile returns the underlying *os.File. It must not be
+	// closed directly, since the handle might need to release
+	// its own resources, so the handle must be closed instead.
+	OSFile() *os.File
+}
+
+// AtomicFile is the handle returned by CreateAtomic. The data written
+// to it only replaces the file at its path when Commit is called, so
+// readers see either the old or the new contents, never a mix.
+// Closing the handle without committing it discards the data.
+type AtomicFile interface {
+	WFile
+	// Commit replaces the file at the handle path with the data
+	// written to the handle, closing it.
+	Commit() error
+	// Abort discards the data written to the handle, closing it.
+	// It does nothing if the handle has been committed, so it's
+	// safe to defer it.
+	Abort() error
+}
+
+// AtomicCreator is implemented by file systems which provide their
+// own mechanism for atomically replacing files. See also the shorthand
+// functions CreateAtomic and WriteFileAtomic.
+type AtomicCreator interface {
+	// CreateAtomic returns a handle for replacing the file at path.
+	// The new file has the given permissions, although file systems
+	// replacing the contents in place might keep the permissions of
+	// an existing file.
+	CreateAtomic(path string, perm os.FileMode) (AtomicFile, error)
+}
+
+// XattrVFS is implemented by file systems which can store extended
+// attributes, arbitrary name/value pairs associated with files and
+// directories. All the methods follow symlinks. See also the shorthand
+// functions Getxattr, Setxattr, Listxattr and Removexattr.
+type XattrVFS interface {
+	VFS
+	// Getxattr returns the value of the extended attribute name
+	// of the entry at path.
+	Getxattr(path string, name string) ([]byte, error)
+	// Setxattr sets the value of the extended attribute name of
+	// the entry at path, creating it if needed.
+	Setxattr(path string, name string, value []byte) error
+	// Listxattr returns the names of the extended attributes of
+	// the entry at path, sorted alphabetically.
+	Listxattr(path string) ([]string, error)
+	// Removexattr removes the extended attribute name from the
+	// entry at path.
+	Removexattr(path string, name string) error
+}
+
+// FSStater is implemented by file systems which can report their
+// capacity and usage. See also the shorthand function StatFS.
+type FSStater interface {
+	// StatFS returns the capacity and usage of the file system.
+	StatFS() (*FSStats, error)
+}
+
+// QuotaVFS is implemented by file systems which can limit the space and
+// the number of entries used by their subtrees, like the in-memory ones
+// and the ones returned by Quota. Operations which would exceed a limit
+// fail with ErrQuotaExceeded. See also the shorthand functions SetQuota
+// and QuotaUsage.
+type QuotaVFS interface {
+	VFS
+	// SetQuota sets the limits of the subtree at path, which must be
+	// a directory, and starts tracking its usage if it was not.
+	// Zero limits mean no limit, so the usage is only tracked.
+	SetQuota(path string, limits QuotaLimits) error
+	// QuotaUsage returns the limits and the usage of the subtree at
+	// path, which must have been set with SetQuota.
+	QuotaUsage(path string) (*QuotaInfo, error)
+}
+
+// Snapshotter is implemented by file systems which can take cheap point
+// in time copies of their contents, like the in-memory ones. See also
+// the shorthand functions Snapshot and Fork.
+type Snapshotter interface {
+	VFS
+	// Snapshot returns a read-only VFS with the current contents of
+	// the file system, which are not affected by its later changes.
+	Snapshot() (VFS, error)
+	// Fork returns a writable copy of the file system, independent
+	// from it.
+	Fork() (VFS, error)
+}
@@ -1,16 +1,24 @@
 package vfs
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 const (
@@ -974,3 +982,1954 @@ func (e *errReadDirVFSWrapper) ReadDir(path string) ([]os.FileInfo, error) {
 	}
 	return e.VFS.ReadDir(path)
 }
+
+// --- Rename ---
+
+func testRename(t *testing.T, fs VFS) {
+	if err := WriteFile(fs, "a", []byte("A"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := MkdirAll(fs, "d/e", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rename(fs, "a", "d/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("a"); !IsNotExist(err) {
+		t.Errorf("Stat(a) after rename = %v, want ErrNotExist", err)
+	}
+	data, err := ReadFile(fs, "d/b")
+	if err != nil || string(data) != "A" {
+		t.Errorf("ReadFile(d/b) = %q, %v, want \"A\"", data, err)
+	}
+	// Replace an existing file
+	if err := WriteFile(fs, "c", []byte("C"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rename(fs, "c", "d/b"); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ReadFile(fs, "d/b")
+	if err != nil || string(data) != "C" {
+		t.Errorf("ReadFile(d/b) after replace = %q, %v, want \"C\"", data, err)
+	}
+	// Rename within the same directory
+	if err := Rename(fs, "d/b", "d/a"); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := fs.ReadDir("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name() != "a" || infos[1].Name() != "e" {
+		t.Errorf("ReadDir(d) after rename = %v", infos)
+	}
+	// Move a directory with its contents
+	if err := Rename(fs, "d", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("x/e"); err != nil {
+		t.Errorf("Stat(x/e) after moving d = %v", err)
+	}
+	if err := Rename(fs, "x", "x/e/f"); err == nil {
+		t.Error("allowed moving a directory into itself")
+	}
+	if err := Rename(fs, "x/a", "x/e"); err == nil {
+		t.Error("allowed replacing a directory with a file")
+	}
+	if err := Rename(fs, "nonexistent", "y"); !IsNotExist(err) {
+		t.Errorf("Rename(nonexistent) = %v, want ErrNotExist", err)
+	}
+	if err := Rename(fs, "x/a", "nonexistent/a"); !IsNotExist(err) {
+		t.Errorf("Rename into nonexistent dir = %v, want ErrNotExist", err)
+	}
+}
+
+func TestMemoryRename(t *testing.T) {
+	testRename(t, Memory())
+}
+
+func TestTmpFSRename(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testRename(t, fs)
+}
+
+func TestMemoryRenameNonEmptyDir(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := MkdirAll(mem, "b/c", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rename(mem, "a", "b"); err == nil {
+		t.Error("allowed replacing a non-empty directory")
+	}
+	if err := Rename(mem, "/", "z"); err == nil {
+		t.Error("allowed renaming the root directory")
+	}
+	if err := Rename(mem, "b/c", "a"); err != nil {
+		t.Errorf("replacing empty directory = %v", err)
+	}
+}
+
+func TestMemoryRenameIntoSymlinkedSubtree(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(mem, "/a/b", "a/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rename(mem, "a/b", "a/link/c"); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Rename into its own subtree through a symlink = %v, want EINVAL", err)
+	}
+	if info, err := mem.Stat("a/b"); err != nil || !info.IsDir() {
+		t.Errorf("Stat(a/b) = %v, %v, want the directory left in place", info, err)
+	}
+}
+
+func TestMemoryRenameThroughSymlinkedParent(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "d/x", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(mem, "d", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rename(mem, "d/x", "link/x"); err != nil {
+		t.Errorf("Rename to the same entry through a symlink = %v", err)
+	}
+	if data, err := ReadFile(mem, "d/x"); err != nil || string(data) != "x" {
+		t.Errorf("ReadFile(d/x) = %q, %v, want \"x\"", data, err)
+	}
+}
+
+func TestRenameWrappers(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "sub/f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := Chroot("sub", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Rename(ch, "f", "g"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("sub/g"); err != nil {
+		t.Errorf("Stat(sub/g) after chroot rename = %v", err)
+	}
+	rew := Rewriter(mem, func(p string) string { return "sub/" + p })
+	if err := Rename(rew, "g", "h"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("sub/h"); err != nil {
+		t.Errorf("Stat(sub/h) after rewriter rename = %v", err)
+	}
+	if err := Rename(ReadOnly(mem), "sub/h", "sub/i"); err != ErrReadOnlyFileSystem {
+		t.Errorf("Rename on RO fs = %v, want ErrReadOnlyFileSystem", err)
+	}
+	if err := Rename(&errWriteVFSWithClose{vfs: mem}, "sub/h", "sub/i"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Rename on VFS without Renamer = %v, want ErrUnsupported", err)
+	}
+	if err := Rename(Rewriter(&errWriteVFSWithClose{vfs: mem}, path.Clean), "sub/h", "sub/i"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Rename through Rewriter without Renamer = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestMounterRename(t *testing.T) {
+	m := &Mounter{}
+	root := Memory()
+	if err := MkdirAll(root, "mnt", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(root, "f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(root, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(Memory(), "/mnt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Rename("/f", "/g"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.Stat("g"); err != nil {
+		t.Errorf("Stat(g) after rename = %v", err)
+	}
+	err := m.Rename("/g", "/mnt/g")
+	if !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("Rename across mounts = %v, want EXDEV", err)
+	}
+	if err := (&Mounter{}).Rename("/a", "/b"); !IsNotExist(err) {
+		t.Errorf("Rename with no mounts = %v, want ErrNotExist", err)
+	}
+}
+
+// --- Symlinks ---
+
+func testSymlink(t *testing.T, fs VFS) {
+	if err := MkdirAll(fs, "d/e", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "d/e/f", []byte("F"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(fs, "e/f", "d/lf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(fs, "d/e", "le"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(fs, "e/f", "d/lf"); !IsExist(err) {
+		t.Errorf("Symlink over existing entry = %v, want ErrExist", err)
+	}
+	target, err := Readlink(fs, "d/lf")
+	if err != nil || target != "e/f" {
+		t.Errorf("Readlink(d/lf) = %q, %v, want \"e/f\"", target, err)
+	}
+	if _, err := Readlink(fs, "d/e/f"); err == nil {
+		t.Error("Readlink on a regular file should fail")
+	}
+	data, err := ReadFile(fs, "d/lf")
+	if err != nil || string(data) != "F" {
+		t.Errorf("ReadFile(d/lf) = %q, %v, want \"F\"", data, err)
+	}
+	// Intermediate symlinks are followed
+	data, err = ReadFile(fs, "le/f")
+	if err != nil || string(data) != "F" {
+		t.Errorf("ReadFile(le/f) = %q, %v, want \"F\"", data, err)
+	}
+	info, err := fs.Lstat("d/lf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat(d/lf) mode = %v, want symlink", info.Mode())
+	}
+	info, err = fs.Stat("le")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Errorf("Stat(le) should follow the symlink to a directory")
+	}
+	// Writing through a symlink modifies the target
+	if err := WriteFile(fs, "d/lf", []byte("G"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ReadFile(fs, "d/e/f")
+	if err != nil || string(data) != "G" {
+		t.Errorf("ReadFile(d/e/f) after writing symlink = %q, %v, want \"G\"", data, err)
+	}
+	// Removing the symlink does not remove the target
+	if err := fs.Remove("le"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("d/e"); err != nil {
+		t.Errorf("Stat(d/e) after removing le = %v", err)
+	}
+	// Dangling symlinks
+	if err := Symlink(fs, "nonexistent", "dangling"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("dangling"); !IsNotExist(err) {
+		t.Errorf("Stat(dangling) = %v, want ErrNotExist", err)
+	}
+	if _, err := fs.Lstat("dangling"); err != nil {
+		t.Errorf("Lstat(dangling) = %v", err)
+	}
+}
+
+func TestMemorySymlink(t *testing.T) {
+	testSymlink(t, Memory())
+}
+
+func TestTmpFSSymlink(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testSymlink(t, fs)
+}
+
+func TestMemorySymlinkLoop(t *testing.T) {
+	mem := Memory()
+	if err := Symlink(mem, "b", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(mem, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("a"); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("Stat(a) = %v, want ELOOP", err)
+	}
+	if _, err := mem.OpenFile("a", os.O_CREATE|os.O_WRONLY, 0644); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("OpenFile(a) = %v, want ELOOP", err)
+	}
+	if _, err := mem.Lstat("a"); err != nil {
+		t.Errorf("Lstat(a) = %v", err)
+	}
+}
+
+func TestMemorySymlinkAbsoluteAndParent(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(mem, "/f", "a/b/abs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(mem, "../../f", "a/b/rel"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a/b/abs", "a/b/rel"} {
+		if data, err := ReadFile(mem, p); err != nil || string(data) != "f" {
+			t.Errorf("ReadFile(%s) = %q, %v, want \"f\"", p, data, err)
+		}
+	}
+	// Create the target through a dangling symlink
+	if err := Symlink(mem, "b/new", "a/ln"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "a/ln", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(mem, "a/b/new"); err != nil || string(data) != "new" {
+		t.Errorf("ReadFile(a/b/new) = %q, %v, want \"new\"", data, err)
+	}
+}
+
+func TestSymlinkWrappers(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "sub/f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := Chroot("sub", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(ch, "/f", "l"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := Readlink(ch, "l"); err != nil || target != "/f" {
+		t.Errorf("Readlink(chroot, l) = %q, %v, want \"/f\"", target, err)
+	}
+	if data, err := ReadFile(ch, "l"); err != nil || string(data) != "f" {
+		t.Errorf("ReadFile(chroot, l) = %q, %v, want \"f\"", data, err)
+	}
+	rew := Rewriter(mem, func(p string) string { return "sub/" + p })
+	if err := Symlink(rew, "f", "m"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := Readlink(rew, "m"); err != nil || target != "f" {
+		t.Errorf("Readlink(rewriter, m) = %q, %v, want \"f\"", target, err)
+	}
+	ro := ReadOnly(mem)
+	if err := Symlink(ro, "f", "sub/n"); err != ErrReadOnlyFileSystem {
+		t.Errorf("Symlink on RO fs = %v, want ErrReadOnlyFileSystem", err)
+	}
+	if target, err := Readlink(ro, "sub/m"); err != nil || target != "f" {
+		t.Errorf("Readlink(ro, sub/m) = %q, %v, want \"f\"", target, err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(mem, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(m, "f", "/sub/o"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := Readlink(m, "/sub/o"); err != nil || target != "f" {
+		t.Errorf("Readlink(mounter, /sub/o) = %q, %v, want \"f\"", target, err)
+	}
+	if err := Symlink(&errWriteVFSWithClose{vfs: mem}, "f", "p"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Symlink on VFS without Symlinker = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestMounterSymlinkAbsolute(t *testing.T) {
+	root, mnt := Memory(), Memory()
+	if err := MkdirAll(root, "mnt", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mnt, "y", []byte("y"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(root, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(mnt, "/mnt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(m, "/mnt/y", "/mnt/x"); err != nil {
+		t.Fatal(err)
+	}
+	// The target is stored relative to the root of the mount
+	if target, err := Readlink(mnt, "x"); err != nil || target != "/y" {
+		t.Errorf("Readlink(mnt, x) = %q, %v, want \"/y\"", target, err)
+	}
+	if target, err := Readlink(m, "/mnt/x"); err != nil || target != "/mnt/y" {
+		t.Errorf("Readlink(mounter, /mnt/x) = %q, %v, want \"/mnt/y\"", target, err)
+	}
+	if data, err := ReadFile(m, "/mnt/x"); err != nil || string(data) != "y" {
+		t.Errorf("ReadFile(mounter, /mnt/x) = %q, %v, want \"y\"", data, err)
+	}
+	if err := Symlink(m, "/mnt/y", "/z"); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("Symlink to another mount = %v, want EXDEV", err)
+	}
+}
+
+func TestCloneSymlink(t *testing.T) {
+	src := Memory()
+	if err := WriteFile(src, "f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(src, "f", "l"); err != nil {
+		t.Fatal(err)
+	}
+	dst := Memory()
+	if err := Clone(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := Readlink(dst, "l"); err != nil || target != "f" {
+		t.Errorf("Readlink(l) after Clone = %q, %v, want \"f\"", target, err)
+	}
+}
+
+// --- Attributes ---
+
+func testAttrs(t *testing.T, fs VFS) {
+	if err := WriteFile(fs, "f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := MkdirAll(fs, "d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Chmod(fs, "f", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Chmod(fs, "d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2015, 10, 21, 16, 29, 0, 0, time.UTC)
+	if err := Chtimes(fs, "f", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := Chtimes(fs, "d", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("f perm = %o, want 0600", perm)
+	}
+	if !info.Mode().IsRegular() {
+		t.Errorf("f mode = %v, Chmod should not change the file type", info.Mode())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("f mtime = %v, want %v", info.ModTime(), mtime)
+	}
+	info, err = fs.Stat("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 || !info.IsDir() {
+		t.Errorf("d mode = %v, want drwx------", info.Mode())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("d mtime = %v, want %v", info.ModTime(), mtime)
+	}
+	// Changing ownership to the current ids is always allowed
+	if err := Chown(fs, "f", os.Getuid(), os.Getgid()); err != nil {
+		t.Errorf("Chown(f) = %v", err)
+	}
+	if err := Chmod(fs, "nonexistent", 0644); !IsNotExist(err) {
+		t.Errorf("Chmod(nonexistent) = %v, want ErrNotExist", err)
+	}
+}
+
+func TestMemoryAttrs(t *testing.T) {
+	testAttrs(t, Memory())
+}
+
+func TestTmpFSAttrs(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testAttrs(t, fs)
+}
+
+func TestMemoryChown(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Chown(mem, "f", 1000, 100); err != nil {
+		t.Fatal(err)
+	}
+	info, err := mem.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := info.Sys().(*File)
+	f.Uname, f.Gname = "bob", "users"
+	if err := Chown(mem, "f", -1, 200); err != nil {
+		t.Fatal(err)
+	}
+	if f.Uid != 1000 || f.Gid != 200 {
+		t.Errorf("owner = %d:%d, want 1000:200", f.Uid, f.Gid)
+	}
+	// The names of the changed ids are stale
+	if f.Uname != "bob" || f.Gname != "" {
+		t.Errorf("owner names = %q:%q, want \"bob\":\"\"", f.Uname, f.Gname)
+	}
+}
+
+func TestAttrsWrappers(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "sub/f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2015, 10, 21, 16, 29, 0, 0, time.UTC)
+	ch, err := Chroot("sub", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(mem, "/"); err != nil {
+		t.Fatal(err)
+	}
+	wrappers := []struct {
+		fs   VFS
+		name string
+	}{
+		{ch, "f"},
+		{Rewriter(mem, func(p string) string { return "sub/" + p }), "f"},
+		{m, "/sub/f"},
+	}
+	for _, v := range wrappers {
+		if err := Chmod(v.fs, v.name, 0600); err != nil {
+			t.Errorf("%s: Chmod = %v", v.fs, err)
+		}
+		if err := Chtimes(v.fs, v.name, mtime, mtime); err != nil {
+			t.Errorf("%s: Chtimes = %v", v.fs, err)
+		}
+		if err := Chown(v.fs, v.name, 1, 1); err != nil {
+			t.Errorf("%s: Chown = %v", v.fs, err)
+		}
+		info, err := v.fs.Stat(v.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 || !info.ModTime().Equal(mtime) {
+			t.Errorf("%s: Stat = %v %v", v.fs, info.Mode(), info.ModTime())
+		}
+	}
+	ro := ReadOnly(mem)
+	if err := Chmod(ro, "sub/f", 0644); err != ErrReadOnlyFileSystem {
+		t.Errorf("Chmod on RO fs = %v, want ErrReadOnlyFileSystem", err)
+	}
+	if err := Chtimes(ro, "sub/f", mtime, mtime); err != ErrReadOnlyFileSystem {
+		t.Errorf("Chtimes on RO fs = %v, want ErrReadOnlyFileSystem", err)
+	}
+	if err := Chown(ro, "sub/f", 0, 0); err != ErrReadOnlyFileSystem {
+		t.Errorf("Chown on RO fs = %v, want ErrReadOnlyFileSystem", err)
+	}
+	if err := Chmod(&errWriteVFSWithClose{vfs: mem}, "sub/f", 0644); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Chmod on VFS without AttrSetter = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestClonePreservesModTime(t *testing.T) {
+	src := Memory()
+	if err := MkdirAll(src, "d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(src, "d/f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2015, 10, 21, 16, 29, 0, 0, time.UTC)
+	if err := Chtimes(src, "d/f", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := Chtimes(src, "d", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = dst.Close() }()
+	if err := Clone(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"d", "d/f"} {
+		info, err := dst.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s mtime after Clone = %v, want %v", p, info.ModTime(), mtime)
+		}
+	}
+}
+
+// --- Truncate ---
+
+func testTruncate(t *testing.T, fs VFS) {
+	if err := WriteFile(fs, "f", []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Truncate(fs, "f", 3); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "f"); err != nil || string(data) != "012" {
+		t.Errorf("ReadFile after shrinking = %q, %v, want \"012\"", data, err)
+	}
+	if err := Truncate(fs, "f", 5); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "f"); err != nil || string(data) != "012\x00\x00" {
+		t.Errorf("ReadFile after growing = %q, %v, want \"012\\x00\\x00\"", data, err)
+	}
+	if err := Truncate(fs, "nonexistent", 0); !IsNotExist(err) {
+		t.Errorf("Truncate(nonexistent) = %v, want ErrNotExist", err)
+	}
+	if err := Truncate(fs, "f", -1); err == nil {
+		t.Error("Truncate(-1) should fail")
+	}
+}
+
+func TestMemoryTruncate(t *testing.T) {
+	testTruncate(t, Memory())
+}
+
+func TestTmpFSTruncate(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testTruncate(t, fs)
+}
+
+func TestTruncateWithoutTruncater(t *testing.T) {
+	// errWriteVFSWithClose does not implement Truncater, so
+	// the truncation goes through the file handle.
+	testTruncate(t, &errWriteVFSWithClose{vfs: Memory()})
+}
+
+func TestMemoryTruncateCompressed(t *testing.T) {
+	mem := Memory()
+	plain := bytes.Repeat([]byte("x"), 2000)
+	if err := WriteFile(mem, "f", plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Compress(mem); err != nil {
+		t.Fatal(err)
+	}
+	if err := Truncate(mem, "f", 1000); err != nil {
+		t.Fatal(err)
+	}
+	info, err := mem.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&ModeCompress == 0 {
+		t.Error("Truncate should keep the file compressed")
+	}
+	if data, err := ReadFile(mem, "f"); err != nil || !bytes.Equal(data, plain[:1000]) {
+		t.Errorf("ReadFile after truncating compressed file: len=%d, %v", len(data), err)
+	}
+	if err := Truncate(mem, "/", 0); err == nil {
+		t.Error("Truncate on a directory should fail")
+	}
+}
+
+func TestTruncateWrappers(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := Chroot("sub", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTruncate(t, ch)
+	testTruncate(t, Rewriter(mem, func(p string) string { return "sub/" + p }))
+	m := &Mounter{}
+	if err := m.Mount(mem, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Truncate(m, "/sub/f", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := Truncate(ReadOnly(mem), "sub/f", 0); err != ErrReadOnlyFileSystem {
+		t.Errorf("Truncate on RO fs = %v, want ErrReadOnlyFileSystem", err)
+	}
+}
+
+// --- OpenFile flags ---
+
+type openFlagTest struct {
+	name     string
+	existing bool
+	flag     int
+	// op is called with the opened file, it might be nil
+	op      func(f WFile) error
+	wantErr bool
+	// want is the expected content after closing the file, or
+	// "-" if the file must not exist.
+	want string
+}
+
+var openFlagTests = []openFlagTest{
+	{name: "rdonly missing", flag: os.O_RDONLY, wantErr: true, want: "-"},
+	{name: "rdonly create", flag: os.O_RDONLY | os.O_CREATE, want: ""},
+	{name: "rdonly existing", existing: true, flag: os.O_RDONLY, op: func(f WFile) error {
+		if _, err := f.Write([]byte("x")); err == nil {
+			return errors.New("write allowed on O_RDONLY file")
+		}
+		return nil
+	}, want: "hello"},
+	{name: "wronly missing", flag: os.O_WRONLY, wantErr: true, want: "-"},
+	{name: "wronly create", flag: os.O_WRONLY | os.O_CREATE, op: writeString("abc"), want: "abc"},
+	{name: "wronly existing", existing: true, flag: os.O_WRONLY, op: writeString("HE"), want: "HEllo"},
+	{name: "wronly read", existing: true, flag: os.O_WRONLY, op: func(f WFile) error {
+		if _, err := f.Read(make([]byte, 1)); err == nil {
+			return errors.New("read allowed on O_WRONLY file")
+		}
+		return nil
+	}, want: "hello"},
+	{name: "wronly trunc", existing: true, flag: os.O_WRONLY | os.O_TRUNC, op: writeString("HE"), want: "HE"},
+	{name: "append after seek", existing: true, flag: os.O_WRONLY | os.O_APPEND, op: func(f WFile) error {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return writeString("!")(f)
+	}, want: "hello!"},
+	{name: "rdwr append", existing: true, flag: os.O_RDWR | os.O_APPEND, op: func(f WFile) error {
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "he" {
+			return fmt.Errorf("read %q, %v", buf, err)
+		}
+		if err := writeString("!")(f); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return writeString("?")(f)
+	}, want: "hello!?"},
+	{name: "append writeat", existing: true, flag: os.O_WRONLY | os.O_APPEND, op: func(f WFile) error {
+		if _, err := f.(io.WriterAt).WriteAt([]byte("x"), 0); err == nil {
+			return errors.New("WriteAt allowed on O_APPEND file")
+		}
+		return nil
+	}, want: "hello"},
+	{name: "excl existing", existing: true, flag: os.O_WRONLY | os.O_CREATE | os.O_EXCL, wantErr: true, want: "hello"},
+	{name: "excl missing", flag: os.O_WRONLY | os.O_CREATE | os.O_EXCL, op: writeString("x"), want: "x"},
+	{name: "excl without create", existing: true, flag: os.O_WRONLY | os.O_EXCL, op: writeString("H"), want: "Hello"},
+	{name: "sync", existing: true, flag: os.O_RDWR | os.O_SYNC, op: writeString("HELLO"), want: "HELLO"},
+}
+
+func writeString(s string) func(f WFile) error {
+	return func(f WFile) error {
+		_, err := f.Write([]byte(s))
+		return err
+	}
+}
+
+func testOpenFileFlags(t *testing.T, fs VFS) {
+	for ii, v := range openFlagTests {
+		name := fmt.Sprintf("f%d", ii)
+		if v.existing {
+			if err := WriteFile(fs, name, []byte("hello"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f, err := fs.OpenFile(name, v.flag, 0644)
+		if (err != nil) != v.wantErr {
+			t.Errorf("%s: OpenFile error = %v, want error %v", v.name, err, v.wantErr)
+			continue
+		}
+		if f != nil {
+			if v.op != nil {
+				if err := v.op(f); err != nil {
+					t.Errorf("%s: %v", v.name, err)
+				}
+			}
+			if err := f.Close(); err != nil {
+				t.Errorf("%s: Close = %v", v.name, err)
+			}
+		}
+		data, err := ReadFile(fs, name)
+		if v.want == "-" {
+			if !IsNotExist(err) {
+				t.Errorf("%s: file should not exist, got %v", v.name, err)
+			}
+			continue
+		}
+		if err != nil || string(data) != v.want {
+			t.Errorf("%s: content = %q, %v, want %q", v.name, data, err, v.want)
+		}
+	}
+	// Creation permissions
+	f, err := fs.OpenFile("perm", os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat("perm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0640 {
+		t.Errorf("created file perm = %o, want 0640", perm)
+	}
+	// Directories can't be opened for writing
+	if err := fs.Mkdir("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, flag := range []int{os.O_WRONLY, os.O_RDWR, os.O_WRONLY | os.O_CREATE} {
+		if _, err := fs.OpenFile("dir", flag, 0644); err == nil {
+			t.Errorf("OpenFile(dir, %#o) should fail", flag)
+		}
+	}
+}
+
+func TestMemoryOpenFileFlags(t *testing.T) {
+	testOpenFileFlags(t, Memory())
+}
+
+func TestTmpFSOpenFileFlags(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testOpenFileFlags(t, fs)
+}
+
+func TestMemoryOpenFileReadOnlyTruncate(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.OpenFile("f", os.O_RDONLY|os.O_TRUNC, 0); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("OpenFile(O_RDONLY|O_TRUNC) = %v, want EINVAL", err)
+	}
+	if data, err := ReadFile(mem, "f"); err != nil || string(data) != "hello" {
+		t.Errorf("content = %q, %v, want \"hello\"", data, err)
+	}
+	if _, err := mem.OpenFile("/", os.O_WRONLY, 0); err == nil {
+		t.Error("OpenFile(/, O_WRONLY) should fail")
+	}
+}
+
+func TestMemoryUmask(t *testing.T) {
+	mem := Memory()
+	u, ok := mem.(Umasker)
+	if !ok {
+		t.Fatal("Memory() should implement Umasker")
+	}
+	if old := u.Umask(022); old != 0 {
+		t.Errorf("default umask = %o, want 0", old)
+	}
+	if err := WriteFile(mem, "f", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Mkdir("d", 0777); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]os.FileMode{"f": 0644, "d": os.ModeDir | 0755} {
+		info, err := mem.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%s mode = %v, want %v", p, info.Mode(), want)
+		}
+	}
+	if old := u.Umask(0); old != 022 {
+		t.Errorf("Umask returned %o, want 022", old)
+	}
+}
+
+// --- Hard links ---
+
+func testLink(t *testing.T, fs VFS) {
+	if err := MkdirAll(fs, "d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "f", []byte("F"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Link(fs, "f", "d/g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Link(fs, "f", "d/g"); !IsExist(err) {
+		t.Errorf("Link over existing entry = %v, want ErrExist", err)
+	}
+	if err := Link(fs, "d", "e"); err == nil {
+		t.Error("allowed hard linking a directory")
+	}
+	if err := Link(fs, "nonexistent", "h"); !IsNotExist(err) {
+		t.Errorf("Link(nonexistent) = %v, want ErrNotExist", err)
+	}
+	// Writes through one name are visible through the other
+	f, err := fs.OpenFile("d/g", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("G")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "f"); err != nil || string(data) != "FG" {
+		t.Errorf("ReadFile(f) = %q, %v, want \"FG\"", data, err)
+	}
+	// Removing one of the names keeps the data
+	if err := fs.Remove("f"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "d/g"); err != nil || string(data) != "FG" {
+		t.Errorf("ReadFile(d/g) after removing f = %q, %v, want \"FG\"", data, err)
+	}
+}
+
+func TestMemoryLink(t *testing.T) {
+	testLink(t, Memory())
+}
+
+func TestTmpFSLink(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testLink(t, fs)
+}
+
+func TestMemoryLinkCount(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := func(p string) int {
+		info, err := mem.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Sys().(*File).Links()
+	}
+	if n := links("a"); n != 1 {
+		t.Errorf("links(a) = %d, want 1", n)
+	}
+	if err := Link(mem, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Link(mem, "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if n := links("a"); n != 3 {
+		t.Errorf("links(a) = %d, want 3", n)
+	}
+	if err := Rename(mem, "c", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := links("b"); n != 2 {
+		t.Errorf("links(b) = %d, want 2", n)
+	}
+	// Renaming a link to another one of the same file does nothing
+	if err := Rename(mem, "b", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if n := links("b"); n != 2 {
+		t.Errorf("links(b) = %d, want 2", n)
+	}
+	if err := WriteFile(mem, "e", []byte("e"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Replacing a link by rename drops its count
+	if err := Rename(mem, "e", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if n := links("b"); n != 1 {
+		t.Errorf("links(b) = %d, want 1", n)
+	}
+	// Files shared in Map are hard links
+	shared := &File{Data: []byte("s")}
+	fs, err := Map(map[string]*File{"x": shared, "y/z": shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "x", []byte("t"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "y/z"); err != nil || string(data) != "t" || shared.Links() != 2 {
+		t.Errorf("ReadFile(y/z) = %q, %v, links %d, want \"t\" with 2 links", data, err, shared.Links())
+	}
+}
+
+func TestLinkWrappers(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "sub/mnt", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "sub/f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := Chroot("sub", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Link(ch, "f", "g"); err != nil {
+		t.Fatal(err)
+	}
+	rew := Rewriter(mem, func(p string) string { return "sub/" + p })
+	if err := Link(rew, "f", "h"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"sub/g", "sub/h"} {
+		if data, err := ReadFile(mem, p); err != nil || string(data) != "f" {
+			t.Errorf("ReadFile(%s) = %q, %v, want \"f\"", p, data, err)
+		}
+	}
+	if err := Link(ReadOnly(mem), "sub/f", "sub/i"); err != ErrReadOnlyFileSystem {
+		t.Errorf("Link on RO fs = %v, want ErrReadOnlyFileSystem", err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(mem, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(Memory(), "/sub/mnt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Link(m, "/sub/f", "/sub/i"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Link(m, "/sub/f", "/sub/mnt/f"); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("Link across mounts = %v, want EXDEV", err)
+	}
+	if err := Link(&errWriteVFSWithClose{vfs: mem}, "sub/f", "sub/j"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Link on VFS without Linker = %v, want ErrUnsupported", err)
+	}
+}
+
+// --- Extended attributes ---
+
+func testXattr(t *testing.T, fs VFS) {
+	if err := MkdirAll(fs, "d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "d/f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Setxattr(fs, "d/f", "user.etag", []byte(`"abc"`)); err != nil {
+		if errors.Is(err, errors.ErrUnsupported) {
+			t.Skipf("xattrs not supported by %s: %v", fs, err)
+		}
+		t.Fatal(err)
+	}
+	if err := Setxattr(fs, "d/f", "user.url", []byte("http://example.com/f")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Setxattr(fs, "d", "user.dir", []byte("yes")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := Getxattr(fs, "d/f", "user.etag"); err != nil || string(value) != `"abc"` {
+		t.Errorf("Getxattr(user.etag) = %q, %v, want \"abc\"", value, err)
+	}
+	if value, err := Getxattr(fs, "d", "user.dir"); err != nil || string(value) != "yes" {
+		t.Errorf("Getxattr(d, user.dir) = %q, %v, want \"yes\"", value, err)
+	}
+	if _, err := Getxattr(fs, "d/f", "user.missing"); !errors.Is(err, ErrNoXattr) {
+		t.Errorf("Getxattr(user.missing) = %v, want ErrNoXattr", err)
+	}
+	if _, err := Getxattr(fs, "nonexistent", "user.etag"); !IsNotExist(err) {
+		t.Errorf("Getxattr(nonexistent) = %v, want ErrNotExist", err)
+	}
+	names, err := Listxattr(fs, "d/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "user.etag" || names[1] != "user.url" {
+		t.Errorf("Listxattr = %v, want [user.etag user.url]", names)
+	}
+	if err := Removexattr(fs, "d/f", "user.etag"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Removexattr(fs, "d/f", "user.etag"); !errors.Is(err, ErrNoXattr) {
+		t.Errorf("Removexattr twice = %v, want ErrNoXattr", err)
+	}
+	if names, err := Listxattr(fs, "d/f"); err != nil || len(names) != 1 || names[0] != "user.url" {
+		t.Errorf("Listxattr after remove = %v, %v, want [user.url]", names, err)
+	}
+}
+
+func TestMemoryXattr(t *testing.T) {
+	testXattr(t, Memory())
+}
+
+func TestTmpFSXattr(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testXattr(t, fs)
+}
+
+func TestMemoryXattrCopiesValues(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	value := []byte("a")
+	if err := Setxattr(mem, "f", "user.a", value); err != nil {
+		t.Fatal(err)
+	}
+	value[0] = 'b'
+	got, err := Getxattr(mem, "f", "user.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got[0] = 'c'
+	if got, err := Getxattr(mem, "f", "user.a"); err != nil || string(got) != "a" {
+		t.Errorf("Getxattr = %q, %v, want \"a\"", got, err)
+	}
+	if err := Setxattr(mem, "f", "", value); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Setxattr with empty name = %v, want EINVAL", err)
+	}
+}
+
+func TestXattrWrappers(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "sub/mnt", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "sub/f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := Chroot("sub", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Setxattr(ch, "f", "user.a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	rew := Rewriter(mem, func(p string) string { return "sub/" + p })
+	if err := Setxattr(rew, "f", "user.b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := Listxattr(mem, "sub/f"); err != nil || len(names) != 2 {
+		t.Errorf("Listxattr(sub/f) = %v, %v, want 2 names", names, err)
+	}
+	ro := ReadOnly(mem)
+	if value, err := Getxattr(ro, "sub/f", "user.a"); err != nil || string(value) != "1" {
+		t.Errorf("Getxattr on RO fs = %q, %v, want \"1\"", value, err)
+	}
+	if err := Setxattr(ro, "sub/f", "user.c", nil); err != ErrReadOnlyFileSystem {
+		t.Errorf("Setxattr on RO fs = %v, want ErrReadOnlyFileSystem", err)
+	}
+	if err := Removexattr(ro, "sub/f", "user.a"); err != ErrReadOnlyFileSystem {
+		t.Errorf("Removexattr on RO fs = %v, want ErrReadOnlyFileSystem", err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(mem, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Removexattr(m, "/sub/f", "user.b"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := Listxattr(m, "/sub/f"); err != nil || len(names) != 1 || names[0] != "user.a" {
+		t.Errorf("Listxattr through Mounter = %v, %v, want [user.a]", names, err)
+	}
+	if _, err := Getxattr(&errWriteVFSWithClose{vfs: mem}, "sub/f", "user.a"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Getxattr on VFS without XattrVFS = %v, want ErrUnsupported", err)
+	}
+}
+
+// --- Locking ---
+
+func openLocker(t *testing.T, fs VFS, p string) (Locker, func()) {
+	f, err := fs.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, ok := f.(Locker)
+	if !ok {
+		t.Fatalf("%T does not implement Locker", f)
+	}
+	return l, func() { _ = f.Close() }
+}
+
+func testLocker(t *testing.T, fs VFS) {
+	l1, close1 := openLocker(t, fs, "f")
+	l2, close2 := openLocker(t, fs, "f")
+	defer close2()
+	if err := l1.Lock(true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := l2.TryLock(false); err != nil || ok {
+		t.Errorf("TryLock(shared) with exclusive lock held = %v, %v, want false", ok, err)
+	}
+	// Convert to a shared lock, allowing other shared locks
+	if err := l1.Lock(false); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := l2.TryLock(false); err != nil || !ok {
+		t.Errorf("TryLock(shared) with shared lock held = %v, %v, want true", ok, err)
+	}
+	if ok, err := l2.TryLock(true); err != nil || ok {
+		t.Errorf("TryLock(exclusive) with shared lock held = %v, %v, want false", ok, err)
+	}
+	// The failed conversion released the shared lock held by l2
+	if ok, err := l1.TryLock(true); err != nil || !ok {
+		t.Errorf("TryLock(exclusive) with no other locks = %v, %v, want true", ok, err)
+	}
+	// Lock blocks until the other handle is closed
+	locked := make(chan error)
+	go func() {
+		locked <- l2.Lock(true)
+	}()
+	select {
+	case err := <-locked:
+		t.Fatalf("Lock(exclusive) did not block, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close1()
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lock(exclusive) still blocked after closing the other handle")
+	}
+}
+
+func TestMemoryLocker(t *testing.T) {
+	testLocker(t, Memory())
+}
+
+func TestTmpFSLocker(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("locking on-disk files is only supported on Linux")
+	}
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testLocker(t, fs)
+}
+
+func TestOSFile(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	if err := WriteFile(fs, "f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	osf, ok := OSFile(f)
+	if !ok {
+		t.Fatalf("OSFile(%T) returned false", f)
+	}
+	if want := filepath.Join(fs.Root(), "f"); osf.Name() != want {
+		t.Errorf("OSFile(f).Name() = %q, want %q", osf.Name(), want)
+	}
+	mf, err := Memory().OpenFile("f", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = mf.Close() }()
+	if _, ok := OSFile(mf); ok {
+		t.Error("OSFile returned true for an in-memory file")
+	}
+}
+
+func TestMemoryLockerHardLink(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "a", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Link(mem, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	la, closeA := openLocker(t, mem, "a")
+	defer closeA()
+	lb, closeB := openLocker(t, mem, "b")
+	defer closeB()
+	if err := la.Lock(true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := lb.TryLock(true); err != nil || ok {
+		t.Errorf("TryLock through hard link = %v, %v, want false", ok, err)
+	}
+}
+
+func TestLockPathWrappers(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := Chroot("sub", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(mem, "/"); err != nil {
+		t.Fatal(err)
+	}
+	wrappers := []VFS{
+		ch,
+		Rewriter(mem, func(p string) string { return "sub/" + p }),
+		m,
+	}
+	for _, fs := range wrappers {
+		p := "f"
+		if fs == m {
+			p = "/sub/f"
+		}
+		unlock, err := LockPath(fs, p)
+		if err != nil {
+			t.Fatalf("LockPath on %s: %v", fs, err)
+		}
+		l, closeL := openLocker(t, mem, "sub/f")
+		if ok, err := l.TryLock(false); err != nil || ok {
+			t.Errorf("TryLock with LockPath held on %s = %v, %v, want false", fs, ok, err)
+		}
+		if err := unlock(); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := l.TryLock(false); err != nil || !ok {
+			t.Errorf("TryLock after unlock on %s = %v, %v, want true", fs, ok, err)
+		}
+		closeL()
+	}
+	if _, err := LockPath(&errWriteVFSWithClose{vfs: mem, path: "x"}, "x"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("LockPath on VFS without Locker = %v, want ErrUnsupported", err)
+	}
+}
+
+// --- Directory streaming ---
+
+func testOpenDir(t *testing.T, fs VFS) {
+	if err := MkdirAll(fs, "d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for ii := 0; ii < 10; ii++ {
+		name := fmt.Sprintf("f%d", ii)
+		if err := WriteFile(fs, "d/"+name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, name)
+	}
+	dir, err := OpenDir(fs, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = dir.Close() }()
+	var names []string
+	for {
+		entries, err := dir.ReadDir(3)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) > 3 {
+			t.Errorf("ReadDir(3) returned %d entries", len(entries))
+		}
+		for _, v := range entries {
+			names = append(names, v.Name())
+		}
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("OpenDir entries = %v, want %v", names, want)
+	}
+	if entries, err := dir.ReadDir(-1); err != nil || len(entries) != 0 {
+		t.Errorf("ReadDir(-1) at end = %v, %v, want no entries", entries, err)
+	}
+	if _, err := OpenDir(fs, "d/f0"); err == nil {
+		t.Error("OpenDir on a file should fail")
+	}
+	if _, err := OpenDir(fs, "nonexistent"); !IsNotExist(err) {
+		t.Errorf("OpenDir(nonexistent) = %v, want ErrNotExist", err)
+	}
+}
+
+func TestMemoryOpenDir(t *testing.T) {
+	testOpenDir(t, Memory())
+}
+
+func TestTmpFSOpenDir(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testOpenDir(t, fs)
+}
+
+func TestMemoryOpenDirConcurrentChanges(t *testing.T) {
+	mem := Memory()
+	for _, p := range []string{"a", "b", "c", "e"} {
+		if err := WriteFile(mem, p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir, err := OpenDir(mem, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := dir.ReadDir(2)
+	if err != nil || len(entries) != 2 || entries[1].Name() != "b" {
+		t.Fatalf("ReadDir(2) = %v, %v, want [a b]", entries, err)
+	}
+	// Removing returned entries and adding new ones after the
+	// cursor must not make it skip or repeat entries
+	for _, p := range []string{"a", "b"} {
+		if err := mem.Remove(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := WriteFile(mem, "d", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = dir.ReadDir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range entries {
+		names = append(names, v.Name())
+	}
+	if want := []string{"c", "d", "e"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir(-1) = %v, want %v", names, want)
+	}
+}
+
+// noReadDirVFS fails on ReadDir, so it can only be listed
+// using OpenDir.
+type noReadDirVFS struct {
+	VFS
+}
+
+func (fs *noReadDirVFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return nil, errors.New("ReadDir should not be called")
+}
+
+func (fs *noReadDirVFS) OpenDir(path string) (DirFile, error) {
+	return fs.VFS.(DirOpener).OpenDir(path)
+}
+
+func TestWalkUsesOpenDir(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "a/b/f", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var visited []string
+	err := Walk(&noReadDirVFS{mem}, "/", func(fs VFS, p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		visited = append(visited, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/", "/a", "/a/b", "/a/b/f"}; !reflect.DeepEqual(visited, want) {
+		t.Errorf("Walk visited %v, want %v", visited, want)
+	}
+}
+
+func TestOpenDirWrappers(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "sub/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "sub/d/f", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := Chroot("sub", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(ch, "/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, fs := range []VFS{ch, Rewriter(mem, func(p string) string { return "sub/" + p }), ReadOnly(ch), m} {
+		if _, ok := fs.(DirOpener); !ok {
+			t.Errorf("%T does not implement DirOpener", fs)
+		}
+		dir, err := OpenDir(fs, "/d")
+		if err != nil {
+			t.Fatalf("OpenDir on %s: %v", fs, err)
+		}
+		entries, err := dir.ReadDir(-1)
+		if err != nil || len(entries) != 1 || entries[0].Name() != "f" {
+			t.Errorf("ReadDir on %s = %v, %v, want [f]", fs, entries, err)
+		}
+		_ = dir.Close()
+	}
+}
+
+// --- Atomic writes ---
+
+// renameOnlyVFS hides the optional interfaces of its VFS,
+// except Renamer.
+type renameOnlyVFS struct {
+	VFS
+}
+
+func (fs *renameOnlyVFS) Rename(oldpath, newpath string) error {
+	return Rename(fs.VFS, oldpath, newpath)
+}
+
+func testAtomic(t *testing.T, fs VFS) {
+	if err := MkdirAll(fs, "d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "d/f", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := CreateAtomic(fs, "d/f", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("new contents")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "d/f"); err != nil || string(data) != "old" {
+		t.Errorf("ReadFile before Commit = %q, %v, want \"old\"", data, err)
+	}
+	if err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Abort(); err != nil {
+		t.Errorf("Abort after Commit = %v, want nil", err)
+	}
+	if err := f.Commit(); err != errFileClosed {
+		t.Errorf("second Commit = %v, want errFileClosed", err)
+	}
+	if data, err := ReadFile(fs, "d/f"); err != nil || string(data) != "new contents" {
+		t.Errorf("ReadFile after Commit = %q, %v, want \"new contents\"", data, err)
+	}
+	// Aborting leaves the file untouched
+	f, err = CreateAtomic(fs, "d/f", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("discarded")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "d/f"); err != nil || string(data) != "new contents" {
+		t.Errorf("ReadFile after Abort = %q, %v, want \"new contents\"", data, err)
+	}
+	if err := WriteFileAtomic(fs, "d/g", []byte("g"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "d/g"); err != nil || string(data) != "g" {
+		t.Errorf("ReadFile(d/g) = %q, %v, want \"g\"", data, err)
+	}
+	// No temporary files are left behind
+	infos, err := fs.ReadDir("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		var names []string
+		for _, v := range infos {
+			names = append(names, v.Name())
+		}
+		t.Errorf("entries in d = %v, want [f g]", names)
+	}
+	if err := WriteFileAtomic(fs, "nonexistent/f", nil, 0644); !IsNotExist(err) {
+		t.Errorf("WriteFileAtomic in nonexistent dir = %v, want ErrNotExist", err)
+	}
+}
+
+func TestMemoryAtomic(t *testing.T) {
+	testAtomic(t, Memory())
+}
+
+func TestTmpFSAtomic(t *testing.T) {
+	fs, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fs.Close() }()
+	testAtomic(t, fs)
+}
+
+func TestRenameAtomic(t *testing.T) {
+	testAtomic(t, &renameOnlyVFS{Memory()})
+}
+
+// syncRecorder records the paths of the files opened from its VFS
+// which are synced.
+type syncRecorder struct {
+	renameOnlyVFS
+	mu     sync.Mutex
+	synced []string
+}
+
+type syncRecorderFile struct {
+	RFile
+	fs   *syncRecorder
+	path string
+}
+
+func (f *syncRecorderFile) Sync() error {
+	f.fs.mu.Lock()
+	f.fs.synced = append(f.fs.synced, f.path)
+	f.fs.mu.Unlock()
+	return f.RFile.(FileSyncer).Sync()
+}
+
+func (fs *syncRecorder) Open(path string) (RFile, error) {
+	f, err := fs.VFS.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &syncRecorderFile{RFile: f, fs: fs, path: path}, nil
+}
+
+func TestRenameAtomicSyncsDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directories can't be synced on Windows")
+	}
+	tmp, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tmp.Close() }()
+	if err := tmp.Mkdir("d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs := &syncRecorder{renameOnlyVFS: renameOnlyVFS{tmp}}
+	if err := WriteFileAtomic(fs, "d/f", []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(fs.synced, "d") {
+		t.Errorf("synced %v after committing, want the parent directory d", fs.synced)
+	}
+}
+
+func TestMemoryAtomicConcurrentReaders(t *testing.T) {
+	mem := Memory()
+	a := bytes.Repeat([]byte("a"), 4096)
+	b := bytes.Repeat([]byte("b"), 8192)
+	if err := WriteFile(mem, "f", a, 0644); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ii := 0; ii < 200; ii++ {
+			data := a
+			if ii%2 == 0 {
+				data = b
+			}
+			if err := WriteFileAtomic(mem, "f", data, 0644); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		data, err := ReadFile(mem, "f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, a) && !bytes.Equal(data, b) {
+			t.Fatalf("read mixed contents of %d bytes", len(data))
+		}
+	}
+}
+
+func TestMemoryAtomicReplacesEntry(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if old := mem.(Umasker).Umask(0022); old != 0 {
+		t.Fatalf("previous umask = %v, want 0", old)
+	}
+	if err := Link(mem, "f", "g"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := mem.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	if err := WriteFileAtomic(mem, "f", bytes.Repeat([]byte("new"), 100), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(mem, "f"); err != nil || !bytes.Equal(data, bytes.Repeat([]byte("new"), 100)) {
+		t.Errorf("ReadFile(f) = %q, %v, want new contents", data, err)
+	}
+	// Like with rename, hard links and open handles keep the old file
+	if data, err := ReadFile(mem, "g"); err != nil || string(data) != "old" {
+		t.Errorf("ReadFile(g) = %q, %v, want \"old\"", data, err)
+	}
+	if data, err := io.ReadAll(r); err != nil || string(data) != "old" {
+		t.Errorf("reading open handle = %q, %v, want \"old\"", data, err)
+	}
+	if info, err := mem.Stat("f"); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Stat(f) = %v, %v, want mode 0644 after umask", info, err)
+	}
+	if err := MkdirAll(mem, "d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(mem, "d", nil, 0644); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("WriteFileAtomic over a directory = %v, want EISDIR", err)
+	}
+}
+
+func TestMemoryAtomicReplacesSymlink(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "target", []byte("target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(mem, "target", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(mem, "link", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := mem.Lstat("link"); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("Lstat(link) = %v, %v, want a regular file", info, err)
+	}
+	checkContents(t, mem, "link", "new")
+	checkContents(t, mem, "target", "target")
+}
+
+func TestAtomicWrappers(t *testing.T) {
+	mem := Memory()
+	if err := MkdirAll(mem, "sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := Chroot("sub", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(ch, "f", []byte("ch"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rew := Rewriter(mem, func(p string) string { return "sub/" + p })
+	if err := WriteFileAtomic(rew, "g", []byte("rew"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(mem, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(m, "/sub/h", []byte("m"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]string{"sub/f": "ch", "sub/g": "rew", "sub/h": "m"} {
+		if data, err := ReadFile(mem, p); err != nil || string(data) != want {
+			t.Errorf("ReadFile(%s) = %q, %v, want %q", p, data, err, want)
+		}
+	}
+	if _, err := CreateAtomic(ReadOnly(mem), "sub/f", 0644); err != ErrReadOnlyFileSystem {
+		t.Errorf("CreateAtomic on RO fs = %v, want ErrReadOnlyFileSystem", err)
+	}
+	if err := WriteFileAtomic(&errWriteVFSWithClose{vfs: mem}, "sub/i", nil, 0644); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("WriteFileAtomic on VFS without Renamer = %v, want ErrUnsupported", err)
+	}
+	if infos, err := mem.ReadDir("sub"); err != nil || len(infos) != 3 {
+		t.Errorf("ReadDir(sub) = %d entries, %v, want 3", len(infos), err)
+	}
+}
+
+func stressIterations() int {
+	if testing.Short() {
+		return 50
+	}
+	return 500
+}
+
+func TestMemoryConcurrentCreateRemove(t *testing.T) {
+	const workers = 16
+	fs := Memory()
+	dirs := []string{"a", "a/b", "c"}
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for ii := 0; ii < workers; ii++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for jj := 0; jj < stressIterations(); jj++ {
+				dir := dirs[(id+jj)%len(dirs)]
+				p := path.Join(dir, fmt.Sprintf("f%d-%d", id, jj))
+				// Other workers might remove the directory between
+				// MkdirAll and WriteFile, so retry until it's written.
+				for {
+					if err := MkdirAll(fs, dir, 0755); err != nil {
+						continue
+					}
+					if err := WriteFile(fs, p, []byte(p), 0644); err == nil {
+						break
+					}
+				}
+				// A directory can't be removed while it contains
+				// the file, so it must be there until we remove it.
+				if data, err := ReadFile(fs, p); err != nil || string(data) != p {
+					errs <- fmt.Errorf("ReadFile(%s) = %q, %v", p, data, err)
+					return
+				}
+				if infos, err := fs.ReadDir(dir); err == nil {
+					if !sort.IsSorted(FileInfos(infos)) {
+						errs <- fmt.Errorf("ReadDir(%s) is not sorted", dir)
+						return
+					}
+				}
+				if err := fs.Remove(p); err != nil {
+					errs <- fmt.Errorf("Remove(%s) = %v", p, err)
+					return
+				}
+				// Removing might fail because it isn't empty or it
+				// was already removed, both are fine.
+				fs.Remove(dir)
+			}
+		}(ii)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	err := Walk(fs, "/", func(fs VFS, p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			t.Errorf("%s was not removed", p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryConcurrentRename(t *testing.T) {
+	const workers = 16
+	fs := Memory()
+	for _, d := range []string{"a", "b"} {
+		if err := fs.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for ii := 0; ii < workers; ii++ {
+		if err := WriteFile(fs, fmt.Sprintf("a/f%d", ii), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for ii := 0; ii < 4; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for jj := 0; jj < stressIterations(); jj++ {
+				for _, d := range []string{"a", "b"} {
+					if _, err := fs.ReadDir(d); err != nil {
+						t.Error(err)
+						return
+					}
+					if err := Walk(fs, d, func(VFS, string, os.FileInfo, error) error { return nil }); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for ii := 0; ii < workers; ii++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			name := fmt.Sprintf("f%d", id)
+			src, dst := "a", "b"
+			for jj := 0; jj < stressIterations(); jj++ {
+				if err := Rename(fs, path.Join(src, name), path.Join(dst, name)); err != nil {
+					t.Error(err)
+					return
+				}
+				src, dst = dst, src
+			}
+		}(ii)
+	}
+	wg.Wait()
+	a, errA := fs.ReadDir("a")
+	b, errB := fs.ReadDir("b")
+	if errA != nil || errB != nil {
+		t.Fatal(errA, errB)
+	}
+	if n := len(a) + len(b); n != workers {
+		t.Errorf("got %d files after renaming, want %d", n, workers)
+	}
+}
@@ -4,38 +4,66 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"compress/gzip"
+	"context"
+	"errors"
 	"io"
+	"maps"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func copyVFS(fs VFS, copier func(p string, info os.FileInfo, f io.Reader) error) error {
-	return Walk(fs, "/", func(vfs VFS, p string, info os.FileInfo, err error) error {
+// copyVFS calls copier for every entry in fs but its root. For symlinks,
+// f reads the link target, and it's nil for directories.
+func copyVFS(ctx context.Context, fs VFS, copier func(p string, info os.FileInfo, f io.Reader) error) error {
+	cfs := AsContextVFS(fs)
+	return WalkContext(ctx, fs, "/", func(vfs VFS, p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		if info.IsDir() {
-			return nil
+			if p == "/" {
+				return nil
+			}
+			return copier(p[1:], info, nil)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := Readlink(fs, p)
+			if err != nil {
+				return err
+			}
+			return copier(p[1:], info, strings.NewReader(target))
 		}
-		f, err := fs.Open(p)
+		f, err := cfs.OpenContext(ctx, p)
 		if err != nil {
 			return err
 		}
 		defer func() { _ = f.Close() }()
-		return copier(p[1:], info, f)
+		return copier(p[1:], info, &contextReader{ctx: ctx, r: f})
 	})
 }
 
 // WriteZip writes the given VFS as a zip file to the given io.Writer.
 func WriteZip(w io.Writer, fs VFS) error {
+	return WriteZipContext(context.Background(), w, fs)
+}
+
+// WriteZipContext is like WriteZip, but it stops writing files when
+// ctx is done, returning its error.
+func WriteZipContext(ctx context.Context, w io.Writer, fs VFS) error {
 	zw := zip.NewWriter(w)
-	err := copyVFS(fs, func(p string, info os.FileInfo, f io.Reader) error {
+	err := copyVFS(ctx, fs, func(p string, info os.FileInfo, f io.Reader) error {
 		hdr, err := zip.FileInfoHeader(info)
 		if err != nil {
 			return err
 		}
 		hdr.Name = p
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
 		fw, err := zw.CreateHeader(hdr)
-		if err != nil {
+		if err != nil || f == nil {
 			return err
 		}
 		_, err = io.Copy(fw, f)
@@ -48,17 +76,64 @@ func WriteZip(w io.Writer, fs VFS) error {
 }
 
 // WriteTar writes the given VFS as a tar file to the given io.Writer.
+// Files with several hard links are written once, and then as links
+// to their first name.
 func WriteTar(w io.Writer, fs VFS) error {
+	return WriteTarContext(context.Background(), w, fs)
+}
+
+// WriteTarContext is like WriteTar, but it stops writing files when
+// ctx is done, returning its error.
+func WriteTarContext(ctx context.Context, w io.Writer, fs VFS) error {
 	tw := tar.NewWriter(w)
-	err := copyVFS(fs, func(p string, info os.FileInfo, f io.Reader) error {
-		hdr, err := tar.FileInfoHeader(info, "")
+	// links maps the files with several hard links to the
+	// name they were first written with
+	links := make(map[any]string)
+	err := copyVFS(ctx, fs, func(p string, info os.FileInfo, f io.Reader) error {
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := io.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			link = string(target)
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
 		if err != nil {
 			return err
 		}
 		hdr.Name = p
-		if err := tw.WriteHeader(hdr); err != nil {
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		records := tarOwner(hdr, info)
+		// Access and change times are only kept for the entries
+		// loaded from tar files with them in PAX records.
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		if id, ok := fileID(info); ok && !info.IsDir() {
+			if first, ok := links[id]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+				return writeTarHeader(tw, hdr, nil)
+			}
+			links[id] = p
+		}
+		if link == "" {
+			xattrs, err := paxXattrs(fs, "/"+p)
+			if err != nil {
+				return err
+			}
+			if records == nil {
+				records = xattrs
+			} else {
+				maps.Copy(records, xattrs)
+			}
+		}
+		if err := writeTarHeader(tw, hdr, records); err != nil {
 			return err
 		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
 		_, err = io.Copy(tw, f)
 		return err
 	})
@@ -68,6 +143,94 @@ func WriteTar(w io.Writer, fs VFS) error {
 	return tw.Close()
 }
 
+// writeTarHeader writes hdr to tw with the given PAX records. The PAX
+// format is only used for keeping them, along with the fractional
+// seconds of the modification time, which is otherwise truncated so
+// the header is written in the more compact USTAR or GNU formats.
+func writeTarHeader(tw *tar.Writer, hdr *tar.Header, records map[string]string) error {
+	if len(records) == 0 {
+		hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+		return tw.WriteHeader(hdr)
+	}
+	hdr.Format, hdr.PAXRecords = tar.FormatPAX, records
+	hdr.AccessTime = paxTime(records["atime"])
+	hdr.ChangeTime = paxTime(records["ctime"])
+	return tw.WriteHeader(hdr)
+}
+
+// tarOwner sets the owner in hdr of the in-memory entry described by
+// info, returning a copy of its PAX records. tar.FileInfoHeader already
+// sets the owner ids for files on disk.
+func tarOwner(hdr *tar.Header, info os.FileInfo) map[string]string {
+	switch e := info.Sys().(type) {
+	case *File:
+		e.RLock()
+		defer e.RUnlock()
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = e.Uid, e.Gid, e.Uname, e.Gname
+		return maps.Clone(e.PAXRecords)
+	case *Dir:
+		e.RLock()
+		defer e.RUnlock()
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = e.Uid, e.Gid, e.Uname, e.Gname
+		return maps.Clone(e.PAXRecords)
+	}
+	return nil
+}
+
+// paxTime parses the time stored in a PAX record, as seconds since
+// the epoch with an optional fractional part. It returns the zero
+// time if v is empty or invalid.
+func paxTime(v string) time.Time {
+	secs, frac, _ := strings.Cut(v, ".")
+	s, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	var ns int64
+	if frac != "" {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		n, err := strconv.ParseUint(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+		if err != nil {
+			return time.Time{}
+		}
+		ns = int64(n)
+	}
+	if strings.HasPrefix(secs, "-") {
+		ns = -ns
+	}
+	return time.Unix(s, ns)
+}
+
+// paxXattrPrefix is the prefix used for PAX records storing extended
+// attributes, as used by GNU tar and star.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// paxXattrs returns the extended attributes of the entry at p as PAX
+// records, or nil if it has none or fs does not support them.
+func paxXattrs(fs VFS, p string) (map[string]string, error) {
+	names, err := Listxattr(fs, p)
+	if err != nil {
+		if errors.Is(err, errors.ErrUnsupported) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	records := make(map[string]string, len(names))
+	for _, name := range names {
+		value, err := Getxattr(fs, p, name)
+		if err != nil {
+			return nil, err
+		}
+		records[paxXattrPrefix+name] = string(value)
+	}
+	return records, nil
+}
+
 // WriteTarGzip writes the given VFS as a tar.gz file to the given io.Writer.
 func WriteTarGzip(w io.Writer, fs VFS) error {
 	gw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
@@ -1,12 +1,15 @@
 package vfs
 
 import (
+	"archive/tar"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 type writeTester struct {
@@ -142,3 +145,127 @@ func TestWriteTarGzipWhenOpenFails(t *testing.T) {
 		t.Fatal("WriteTarGzip when Open fails should return error")
 	}
 }
+
+func TestWriteTarSymlink(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(mem, "f", "l"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteTar(&buf, mem); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "l" {
+			found = true
+			if hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "f" {
+				t.Errorf("symlink header = %c -> %q, want symlink -> \"f\"", hdr.Typeflag, hdr.Linkname)
+			}
+		}
+	}
+	if !found {
+		t.Error("symlink l not written to tar")
+	}
+}
+
+func TestWriteTarXattrs(t *testing.T) {
+	mem := Memory()
+	if err := WriteFile(mem, "f", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Setxattr(mem, "f", "user.etag", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteTar(&buf, mem); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := Tar(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := Getxattr(fs, "f", "user.etag"); err != nil || string(value) != "abc" {
+		t.Errorf("Getxattr after tar round-trip = %q, %v, want \"abc\"", value, err)
+	}
+}
+
+// tarEntries returns a description of each entry in the tar file in data,
+// by name.
+func tarEntries(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	entries := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = fmt.Sprintf("%c %o %s %d:%d %q:%q %q %v %q", hdr.Typeflag, hdr.Mode,
+			hdr.ModTime.UTC().Format(time.RFC3339Nano), hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname,
+			hdr.Linkname, hdr.PAXRecords, contents)
+	}
+	return entries
+}
+
+func TestWriteTarRoundTrip(t *testing.T) {
+	data, _ := tarTreeTestData(t)
+	fs, err := Tar(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteTar(&buf, fs); err != nil {
+		t.Fatal(err)
+	}
+	want, got := tarEntries(t, data), tarEntries(t, buf.Bytes())
+	for name, entry := range want {
+		if got[name] != entry {
+			t.Errorf("%s written as %s, want %s", name, got[name], entry)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("wrote %d entries, want %d", len(got), len(want))
+	}
+}
+
+func TestWriteTarCompactHeaders(t *testing.T) {
+	mtime := time.Date(2021, 2, 3, 4, 5, 6, 7000, time.UTC)
+	fs, err := Map(map[string]*File{"f": {Data: []byte("f"), ModTime: mtime}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteTar(&buf, fs); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := tar.NewReader(&buf).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Entries without PAX records to keep don't need a PAX header
+	if len(hdr.PAXRecords) != 0 || !hdr.ModTime.Equal(mtime.Truncate(time.Second)) {
+		t.Errorf("f written with PAX records %v and time %s, want none and %s", hdr.PAXRecords, hdr.ModTime, mtime.Truncate(time.Second))
+	}
+}
@@ -0,0 +1,114 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// ErrNoXattr is returned when the requested extended attribute does
+// not exist. On Linux, it's syscall.ENODATA, which is also returned
+// by the on-disk file systems.
+var ErrNoXattr error = errNoXattr
+
+// entryXattrs returns the lock and the extended attributes of the given
+// entry, or nil if the entry does not support them.
+func entryXattrs(entry Entry) (*sync.RWMutex, *map[string][]byte) {
+	switch e := entry.(type) {
+	case *File:
+		return &e.RWMutex, &e.Xattrs
+	case *Dir:
+		return &e.RWMutex, &e.Xattrs
+	}
+	return nil, nil
+}
+
+// xattrs returns the entry at path, its lock and its extended attributes.
+// It must always be called with the lock held.
+func (fs *memoryFileSystem) xattrs(op string, path string) (Entry, *sync.RWMutex, *map[string][]byte, error) {
+	entry, _, _, err := fs.entry(path)
+	if err != nil {
+		return nil, nil, nil, &os.PathError{Op: op, Path: path, Err: err}
+	}
+	mu, attrs := entryXattrs(entry)
+	if mu == nil {
+		return nil, nil, nil, &os.PathError{Op: op, Path: path, Err: errors.ErrUnsupported}
+	}
+	return entry, mu, attrs, nil
+}
+
+func (fs *memoryFileSystem) Getxattr(path string, name string) ([]byte, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	_, mu, attrs, err := fs.xattrs("getxattr", path)
+	if err != nil {
+		return nil, err
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	value, ok := (*attrs)[name]
+	if !ok {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: ErrNoXattr}
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (fs *memoryFileSystem) Setxattr(path string, name string, value []byte) error {
+	if name == "" {
+		return &os.PathError{Op: "setxattr", Path: path, Err: syscall.EINVAL}
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	entry, mu, attrs, err := fs.xattrs("setxattr", path)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if err := preserve(entry); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	if *attrs == nil {
+		*attrs = make(map[string][]byte)
+	}
+	(*attrs)[name] = append([]byte{}, value...)
+	return nil
+}
+
+func (fs *memoryFileSystem) Listxattr(path string) ([]string, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	_, mu, attrs, err := fs.xattrs("listxattr", path)
+	if err != nil {
+		return nil, err
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(*attrs))
+	for k := range *attrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fs *memoryFileSystem) Removexattr(path string, name string) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	entry, mu, attrs, err := fs.xattrs("removexattr", path)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := (*attrs)[name]; !ok {
+		return &os.PathError{Op: "removexattr", Path: path, Err: ErrNoXattr}
+	}
+	if err := preserve(entry); err != nil {
+		return &os.PathError{Op: "removexattr", Path: path, Err: err}
+	}
+	delete(*attrs, name)
+	return nil
+}
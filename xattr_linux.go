@@ -0,0 +1,73 @@
+package vfs
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"syscall"
+)
+
+const errNoXattr = syscall.ENODATA
+
+// Getxattr returns the value of the extended attribute name. If the
+// underlying file system does not support extended attributes, the
+// returned error wraps syscall.ENOTSUP.
+func (fs *fileSystem) Getxattr(path string, name string) ([]byte, error) {
+	p := fs.path(path)
+	for {
+		size, err := syscall.Getxattr(p, name, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		buf := make([]byte, size)
+		n, err := syscall.Getxattr(p, name, buf)
+		if err == syscall.ERANGE {
+			// Value grew since we got its size
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		return buf[:n], nil
+	}
+}
+
+func (fs *fileSystem) Setxattr(path string, name string, value []byte) error {
+	if err := syscall.Setxattr(fs.path(path), name, value, 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (fs *fileSystem) Listxattr(path string) ([]string, error) {
+	p := fs.path(path)
+	for {
+		size, err := syscall.Listxattr(p, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+		}
+		buf := make([]byte, size)
+		n, err := syscall.Listxattr(p, buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+		}
+		var names []string
+		for _, v := range bytes.Split(buf[:n], []byte{0}) {
+			if len(v) > 0 {
+				names = append(names, string(v))
+			}
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+}
+
+func (fs *fileSystem) Removexattr(path string, name string) error {
+	if err := syscall.Removexattr(fs.path(path), name); err != nil {
+		return &os.PathError{Op: "removexattr", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package vfs
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoXattr = errors.New("no such attribute")
+
+// Extended attributes for on-disk file systems are only supported
+// on Linux.
+
+func (fs *fileSystem) Getxattr(path string, name string) ([]byte, error) {
+	return nil, &os.PathError{Op: "getxattr", Path: path, Err: errors.ErrUnsupported}
+}
+
+func (fs *fileSystem) Setxattr(path string, name string, value []byte) error {
+	return &os.PathError{Op: "setxattr", Path: path, Err: errors.ErrUnsupported}
+}
+
+func (fs *fileSystem) Listxattr(path string) ([]string, error) {
+	return nil, &os.PathError{Op: "listxattr", Path: path, Err: errors.ErrUnsupported}
+}
+
+func (fs *fileSystem) Removexattr(path string, name string) error {
+	return &os.PathError{Op: "removexattr", Path: path, Err: errors.ErrUnsupported}
+}